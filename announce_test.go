@@ -1,7 +1,9 @@
 package legs
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
@@ -15,6 +17,8 @@ import (
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
 )
@@ -280,3 +284,261 @@ func TestAnnounceRepublish(t *testing.T) {
 		t.Log("Received sync notification for first CID:", firstCid)
 	}
 }
+
+func TestAnnounceRepublishFilterIPs(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcLnkS := test.MkLinkSystem(srcStore)
+	pubHost := test.MkTestHost()
+	dstHost := test.MkTestHost()
+	dstHost2 := test.MkTestHost()
+	dstHost.Peerstore().AddAddrs(pubHost.ID(), pubHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(pubHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+	chainLnks := test.MkChain(srcLnkS, true)
+	require.NoError(t, pub.SetRoot(context.Background(), chainLnks[0].(cidlink.Link).Cid))
+	cids := []cid.Cid{chainLnks[1].(cidlink.Link).Cid, chainLnks[0].(cidlink.Link).Cid}
+
+	topics := test.WaitForMeshWithMessage(t, testTopic, dstHost, dstHost2)
+
+	sub, err := NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil, Topic(topics[0]), ResendAnnounce(true), FilterIPs(true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	psub, err := topics[1].Subscribe()
+	require.NoError(t, err)
+	defer psub.Cancel()
+
+	privAddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9999")
+	require.NoError(t, err)
+	pubAddr, err := multiaddr.NewMultiaddr("/dns4/example.com/tcp/9999")
+	require.NoError(t, err)
+
+	nextRepublished := func() dtsync.Message {
+		ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+		defer cancel()
+		pmsg, err := psub.Next(ctx)
+		require.NoError(t, err)
+		var msg dtsync.Message
+		require.NoError(t, msg.UnmarshalCBOR(bytes.NewBuffer(pmsg.Data)))
+		return msg
+	}
+
+	// The private address is removed from a re-published unsigned message.
+	msg := dtsync.Message{Cid: cids[0]}
+	msg.SetAddrs([]multiaddr.Multiaddr{privAddr, pubAddr})
+	require.NoError(t, sub.AnnounceMessage(context.Background(), pubHost.ID(), msg))
+	republished := nextRepublished()
+	require.Equal(t, cids[0], republished.Cid)
+	addrs, err := republished.GetAddrs()
+	require.NoError(t, err)
+	require.Equal(t, []multiaddr.Multiaddr{pubAddr}, addrs)
+
+	// A signed message is re-published unchanged, so that its signature
+	// remains valid.
+	msg = dtsync.Message{Cid: cids[1]}
+	msg.SetAddrs([]multiaddr.Multiaddr{privAddr, pubAddr})
+	require.NoError(t, msg.Sign(pubHost.Peerstore().PrivKey(pubHost.ID())))
+	require.NoError(t, sub.AnnounceMessage(context.Background(), pubHost.ID(), msg))
+	republished = nextRepublished()
+	require.Equal(t, cids[1], republished.Cid)
+	require.Equal(t, msg.Addrs, republished.Addrs)
+	signer, err := republished.VerifySignature()
+	require.NoError(t, err)
+	require.Equal(t, pubHost.ID(), signer)
+}
+
+func TestAnnounceSequence(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	srcLnkS := test.MkLinkSystem(srcStore)
+	dstHost := test.MkTestHost()
+	srcHost.Peerstore().AddAddrs(dstHost.ID(), dstHost.Addrs(), time.Hour)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil, PersistLatestSync(""))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	chainLnks := test.MkChain(srcLnkS, true)
+	require.NoError(t, pub.SetRoot(context.Background(), chainLnks[0].(cidlink.Link).Cid))
+
+	privKey := srcHost.Peerstore().PrivKey(srcHost.ID())
+	mkMsg := func(lnk ipld.Link, seq uint64) dtsync.Message {
+		msg := dtsync.Message{
+			Cid:       lnk.(cidlink.Link).Cid,
+			Seq:       seq,
+			Timestamp: time.Now().UnixNano(),
+		}
+		msg.SetAddrs(srcHost.Addrs())
+		require.NoError(t, msg.Sign(privKey))
+		return msg
+	}
+
+	msg := mkMsg(chainLnks[1], 10)
+	require.NoError(t, sub.AnnounceMessage(context.Background(), srcHost.ID(), msg))
+	select {
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for SyncFinished")
+	case event := <-watcher:
+		require.Equal(t, msg.Cid, event.Cid)
+	}
+
+	// A replayed or older announce is rejected.
+	err = sub.AnnounceMessage(context.Background(), srcHost.ID(), msg)
+	require.ErrorIs(t, err, ErrStaleAnnounce)
+	err = sub.AnnounceMessage(context.Background(), srcHost.ID(), mkMsg(chainLnks[2], 9))
+	require.ErrorIs(t, err, ErrStaleAnnounce)
+
+	// A sequence number that is not signed by the publisher is rejected.
+	forged := mkMsg(chainLnks[2], 11)
+	forged.Seq = 12
+	err = sub.AnnounceMessage(context.Background(), srcHost.ID(), forged)
+	require.ErrorIs(t, err, dtsync.ErrBadSignature)
+	err = sub.AnnounceMessage(context.Background(), dstHost.ID(), mkMsg(chainLnks[2], 11))
+	require.ErrorIs(t, err, dtsync.ErrBadSignature)
+
+	// An announce with a timestamp outside of the allowed time skew is
+	// rejected.
+	skewed := dtsync.Message{
+		Cid:       chainLnks[2].(cidlink.Link).Cid,
+		Seq:       11,
+		Timestamp: time.Now().Add(-time.Hour).UnixNano(),
+	}
+	require.NoError(t, skewed.Sign(privKey))
+	err = sub.AnnounceMessage(context.Background(), srcHost.ID(), skewed)
+	require.ErrorIs(t, err, ErrAnnounceTimeSkew)
+
+	// An announce from a publisher that is not allowed is ignored, and does
+	// not change the sequence number.
+	sub.SetAllowPeer(func(peer.ID) bool { return false })
+	require.NoError(t, sub.AnnounceMessage(context.Background(), srcHost.ID(), mkMsg(chainLnks[2], 20)))
+	sub.SetAllowPeer(nil)
+
+	// A newer announce is accepted.
+	msg = mkMsg(chainLnks[0], 11)
+	require.NoError(t, sub.AnnounceMessage(context.Background(), srcHost.ID(), msg))
+	select {
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for SyncFinished")
+	case event := <-watcher:
+		require.Equal(t, msg.Cid, event.Cid)
+	}
+
+	// The sequence number is kept after a restart.
+	require.NoError(t, sub.Close())
+	sub, err = NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil, PersistLatestSync(""), NoPubsub())
+	require.NoError(t, err)
+	defer sub.Close()
+	err = sub.AnnounceMessage(context.Background(), srcHost.ID(), msg)
+	require.ErrorIs(t, err, ErrStaleAnnounce)
+}
+
+func TestAnnounceSeqsLimit(t *testing.T) {
+	as := newAnnounceSeqs(nil)
+	for i := 0; i < maxAnnounceSeqs; i++ {
+		require.NoError(t, as.accept(peer.ID(fmt.Sprint("peer", i)), uint64(i+1)))
+	}
+	require.NoError(t, as.accept("newPeer", maxAnnounceSeqs+1))
+	require.Len(t, as.seqs, maxAnnounceSeqs)
+	require.NotContains(t, as.seqs, peer.ID("peer0"), "publisher with lowest sequence should be forgotten")
+	require.Contains(t, as.seqs, peer.ID("newPeer"))
+}
+
+func TestResubscribe(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost := test.MkTestHost()
+	dstHost := test.MkTestHost()
+	defer srcHost.Close()
+	defer dstHost.Close()
+	srcHost.Peerstore().AddAddrs(dstHost.ID(), dstHost.Addrs(), time.Hour)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+	topics := test.WaitForMeshWithMessage(t, testTopic, srcHost, dstHost)
+
+	srcLnkS := test.MkLinkSystem(srcStore)
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic, dtsync.Topic(topics[0]), dtsync.SignAnnounces())
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil,
+		Topic(topics[1]), ResubscribeBackoff(10*time.Millisecond, 50*time.Millisecond))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	events, cncl := sub.OnSyncEvent()
+	defer cncl()
+	watcher, cnclWatcher := sub.OnSyncFinished()
+	defer cnclWatcher()
+
+	// Cancel the subscription without closing the Subscriber, to simulate a
+	// failed subscription.
+	sub.psubMutex.Lock()
+	sub.psub.Cancel()
+	sub.psubMutex.Unlock()
+
+	for _, expect := range []SyncEventType{SyncEventPubsubLost, SyncEventPubsubRestored} {
+		select {
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event", expect)
+		case event := <-events:
+			require.Equal(t, expect, event.Type)
+			if expect == SyncEventPubsubLost {
+				require.ErrorIs(t, event.Err, pubsub.ErrSubscriptionCancelled)
+			}
+		}
+	}
+
+	// Check that announces are received over the new subscription. Announce
+	// until one is received, since the subscription must propagate to the
+	// publisher.
+	chainLnks := test.MkChain(srcLnkS, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	timeout := time.After(10 * time.Second)
+	for received := false; !received; {
+		require.NoError(t, pub.UpdateRoot(context.Background(), headCid))
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for SyncFinished")
+		case <-time.After(200 * time.Millisecond):
+		case event := <-watcher:
+			require.Equal(t, headCid, event.Cid)
+			received = true
+		}
+	}
+
+	// Check that Close stops the watch function, and does not resubscribe.
+	require.NoError(t, sub.Close())
+	select {
+	case <-sub.watchDone:
+	default:
+		t.Fatal("watch function did not exit")
+	}
+}
+
+func TestAnnounceWithoutSource(t *testing.T) {
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	sub, err := NewSubscriber(test.MkTestHost(), dstStore, test.MkLinkSystem(dstStore), testTopic, nil, NoPubsub())
+	require.NoError(t, err)
+	defer sub.Close()
+
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	buf := bytes.NewBuffer(nil)
+	msg := dtsync.Message{Cid: cids[0]}
+	require.NoError(t, msg.MarshalCBOR(buf))
+
+	// An unsigned pubsub message that was not re-published has no source.
+	err = sub.handleAnnounceData(context.Background(), "", buf.Bytes())
+	require.ErrorIs(t, err, errNoSource)
+}
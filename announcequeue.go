@@ -0,0 +1,151 @@
+package legs
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// AnnounceQueuePolicy determines what is done with a new announce when a
+// publisher's announce queue is full.
+type AnnounceQueuePolicy int
+
+const (
+	// DropOldest removes the oldest queued announce to make room for the new
+	// announce.
+	DropOldest AnnounceQueuePolicy = iota
+	// DropNewest discards the new announce, keeping the queued announces.
+	DropNewest
+	// CoalesceSameChain replaces a queued announce that has the same
+	// publisher addresses as the new announce, since the newer announce is
+	// assumed to be for a later head of the same chain. The new announce takes
+	// the place of the replaced announce in the queue. An announce that has
+	// addresses different from all queued announces is queued, dropping the
+	// oldest queued announce if the queue is full.
+	CoalesceSameChain
+)
+
+// AnnounceStats holds counts of announces that were not handled.
+type AnnounceStats struct {
+	// Dropped is the number of announces discarded because they were replaced
+	// by a newer announce or because the announce queue was full.
+	Dropped uint64
+	// Coalesced is the number of queued announces replaced by a newer announce
+	// with the same addresses. See CoalesceSameChain.
+	Coalesced uint64
+}
+
+// pendingAnnounce is an announce waiting to be handled.
+type pendingAnnounce struct {
+	c      cid.Cid
+	addrs  []multiaddr.Multiaddr
+	syncer Syncer
+}
+
+// AnnounceStats returns counts of the announces that were discarded without
+// being handled, since the Subscriber was created.
+func (s *Subscriber) AnnounceStats() AnnounceStats {
+	return AnnounceStats{
+		Dropped:   atomic.LoadUint64(&s.droppedAnnounces),
+		Coalesced: atomic.LoadUint64(&s.coalescedAnnounces),
+	}
+}
+
+// enqueueAsync adds an announce to the handler's queue, according to the
+// configured queue policy, and starts a goroutine to handle the queued
+// announces if one is not already running.
+func (h *handler) enqueueAsync(ctx context.Context, pa pendingAnnounce) {
+	s := h.subscriber
+	h.qlock.Lock()
+	defer h.qlock.Unlock()
+
+	var coalesced bool
+	if s.announceQueuePolicy == CoalesceSameChain {
+		for i := range h.queue {
+			if equalAddrs(h.queue[i].addrs, pa.addrs) {
+				// Replace the queued announce in place, so that the new
+				// announce keeps the position of the one it replaces.
+				log.Infow("Queued announce coalesced with new", "previous_cid", h.queue[i].c, "new_cid", pa.c, "peer", h.peerID)
+				h.queue[i] = pa
+				atomic.AddUint64(&s.coalescedAnnounces, 1)
+				coalesced = true
+				break
+			}
+		}
+	}
+
+	if !coalesced {
+		if len(h.queue) >= s.announceQueueDepth {
+			if s.announceQueuePolicy == DropNewest {
+				log.Infow("Announce queue full; dropped new announce", "cid", pa.c, "peer", h.peerID)
+				atomic.AddUint64(&s.droppedAnnounces, 1)
+				return
+			}
+			log.Infow("Announce queue full; dropped oldest announce", "cid", h.queue[0].c, "peer", h.peerID)
+			h.removeQueued(0)
+			atomic.AddUint64(&s.droppedAnnounces, 1)
+		}
+		h.queue = append(h.queue, pa)
+	}
+	// A new announce supersedes any failed sync waiting to be retried.
+	h.cancelRetry()
+
+	if h.queueRunning {
+		return
+	}
+	h.queueRunning = true
+	s.asyncWG.Add(1)
+	go h.handleQueue(ctx)
+}
+
+// handleQueue handles queued announces, in order, until the queue is empty or
+// the Subscriber is closed.
+func (h *handler) handleQueue(ctx context.Context) {
+	defer h.subscriber.asyncWG.Done()
+	for {
+		h.qlock.Lock()
+		if len(h.queue) == 0 {
+			h.queueRunning = false
+			h.qlock.Unlock()
+			return
+		}
+		select {
+		case <-h.subscriber.closing:
+			log.Infow("Subscriber closing; discarding queued announces", "count", len(h.queue), "peer", h.peerID)
+			h.queue = nil
+			h.queueRunning = false
+			h.qlock.Unlock()
+			return
+		default:
+		}
+		pa := h.queue[0]
+		h.removeQueued(0)
+		h.qlock.Unlock()
+
+		h.latestSyncMu.Lock()
+		h.syncAnnounced(ctx, pa)
+		h.latestSyncMu.Unlock()
+	}
+}
+
+// removeQueued removes the announce at index i from the queue. The caller must
+// hold qlock.
+func (h *handler) removeQueued(i int) {
+	copy(h.queue[i:], h.queue[i+1:])
+	h.queue[len(h.queue)-1] = pendingAnnounce{}
+	h.queue = h.queue[:len(h.queue)-1]
+}
+
+func equalAddrs(a, b []multiaddr.Multiaddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
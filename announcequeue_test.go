@@ -0,0 +1,105 @@
+package legs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounceQueuePolicies(t *testing.T) {
+	addrA := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/1/http")}
+	addrB := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/2/http")}
+	cids, err := test.RandomCids(4)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name            string
+		policy          AnnounceQueuePolicy
+		addrs           [][]multiaddr.Multiaddr
+		expectQueued    []cid.Cid
+		expectDropped   uint64
+		expectCoalesced uint64
+	}{
+		{
+			name:          "drop oldest",
+			policy:        DropOldest,
+			addrs:         [][]multiaddr.Multiaddr{addrA, addrA, addrA},
+			expectQueued:  []cid.Cid{cids[2], cids[3]},
+			expectDropped: 1,
+		},
+		{
+			name:          "drop newest",
+			policy:        DropNewest,
+			addrs:         [][]multiaddr.Multiaddr{addrA, addrA, addrA},
+			expectQueued:  []cid.Cid{cids[1], cids[2]},
+			expectDropped: 1,
+		},
+		{
+			name:            "coalesce same chain",
+			policy:          CoalesceSameChain,
+			addrs:           [][]multiaddr.Multiaddr{addrA, addrB, addrA},
+			expectQueued:    []cid.Cid{cids[3], cids[2]},
+			expectCoalesced: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ds := dssync.MutexWrap(datastore.NewMapDatastore())
+			sub, err := NewSubscriber(test.MkTestHost(), ds, test.MkLinkSystem(ds), testTopic, nil, AnnounceQueue(2, tc.policy))
+			require.NoError(t, err)
+			defer sub.Close()
+
+			pubID := test.MkTestHost().ID()
+			hnd, err := sub.getOrCreateHandler(pubID, true)
+			require.NoError(t, err)
+			// Lock mutex inside sync handler to simulate publisher blocked in sync.
+			hnd.syncMutex.Lock()
+
+			// The first announce is taken from the queue and blocks in the handler.
+			require.NoError(t, sub.Announce(context.Background(), cids[0], pubID, addrA))
+			require.Eventually(t, func() bool {
+				hnd.qlock.Lock()
+				defer hnd.qlock.Unlock()
+				return len(hnd.queue) == 0
+			}, updateTimeout, 10*time.Millisecond)
+
+			for i, addrs := range tc.addrs {
+				require.NoError(t, sub.Announce(context.Background(), cids[i+1], pubID, addrs))
+			}
+
+			hnd.qlock.Lock()
+			queued := queuedCids(hnd.queue)
+			hnd.qlock.Unlock()
+			require.Equal(t, tc.expectQueued, queued)
+
+			stats := sub.AnnounceStats()
+			require.Equal(t, tc.expectDropped, stats.Dropped)
+			require.Equal(t, tc.expectCoalesced, stats.Coalesced)
+
+			hnd.syncMutex.Unlock()
+		})
+	}
+}
+
+func TestAnnounceQueueOption(t *testing.T) {
+	var cfg config
+	require.Error(t, cfg.apply([]Option{AnnounceQueue(0, DropOldest)}))
+	require.Error(t, cfg.apply([]Option{AnnounceQueue(1, AnnounceQueuePolicy(99))}))
+	require.NoError(t, cfg.apply([]Option{AnnounceQueue(1, DropNewest)}))
+}
+
+func queuedCids(queue []pendingAnnounce) []cid.Cid {
+	out := make([]cid.Cid, len(queue))
+	for i := range queue {
+		out[i] = queue[i].c
+	}
+	return out
+}
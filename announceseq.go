@@ -0,0 +1,113 @@
+package legs
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// DefaultAnnounceSeqPrefix is the datastore key prefix under which the
+// sequence number of the last accepted announce from each publisher is stored,
+// when latest syncs are persisted. See PersistLatestSync.
+const DefaultAnnounceSeqPrefix = "/legs/announceSeq"
+
+// maxAnnounceSeqs is the most publishers whose last announce sequence number
+// is kept in memory. When there are more, the publisher that has not announced
+// for the longest time is forgotten. If the sequence numbers are persisted,
+// then a forgotten publisher's sequence number is read again from the
+// datastore. Otherwise, the announce time skew limits the replay of old
+// announces from a forgotten publisher.
+const maxAnnounceSeqs = 4096
+
+// announceSeqs tracks the sequence number of the last accepted announce from
+// each publisher, and optionally stores them in a datastore so that old
+// announces cannot be replayed after a restart.
+type announceSeqs struct {
+	mutex  sync.Mutex
+	seqs   map[peer.ID]uint64
+	ds     datastore.Datastore
+	prefix datastore.Key
+}
+
+// newAnnounceSeqs creates an announceSeqs that is stored in ds, or is only
+// kept in memory if ds is nil.
+func newAnnounceSeqs(ds datastore.Datastore) *announceSeqs {
+	return &announceSeqs{
+		seqs:   make(map[peer.ID]uint64),
+		ds:     ds,
+		prefix: datastore.NewKey(DefaultAnnounceSeqPrefix),
+	}
+}
+
+// accept records seq as the sequence number of the last accepted announce
+// from the publisher. ErrStaleAnnounce is returned if seq is not greater than
+// the sequence number of the last accepted announce.
+func (as *announceSeqs) accept(p peer.ID, seq uint64) error {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	last, ok := as.seqs[p]
+	if !ok {
+		last = as.load(p)
+	}
+	if seq <= last {
+		return ErrStaleAnnounce
+	}
+	if !ok && len(as.seqs) >= maxAnnounceSeqs {
+		as.evict()
+	}
+	as.seqs[p] = seq
+	as.store(p, seq)
+	return nil
+}
+
+// evict removes the publisher with the lowest sequence number. Since
+// publishers use the time as the sequence number, this is usually the
+// publisher that has not announced for the longest time.
+func (as *announceSeqs) evict() {
+	var oldest peer.ID
+	var oldestSeq uint64
+	for p, seq := range as.seqs {
+		if oldest == "" || seq < oldestSeq {
+			oldest = p
+			oldestSeq = seq
+		}
+	}
+	delete(as.seqs, oldest)
+}
+
+func (as *announceSeqs) load(p peer.ID) uint64 {
+	if as.ds == nil {
+		return 0
+	}
+	val, err := as.ds.Get(context.Background(), as.peerKey(p))
+	if err != nil {
+		if err != datastore.ErrNotFound {
+			log.Errorw("Failed to read announce sequence", "err", err, "peer", p)
+		}
+		return 0
+	}
+	if len(val) != 8 {
+		log.Errorw("Failed to decode announce sequence", "peer", p)
+		return 0
+	}
+	return binary.BigEndian.Uint64(val)
+}
+
+func (as *announceSeqs) store(p peer.ID, seq uint64) {
+	if as.ds == nil {
+		return
+	}
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, seq)
+	if err := as.ds.Put(context.Background(), as.peerKey(p), val); err != nil {
+		log.Errorw("Failed to write announce sequence", "err", err, "peer", p)
+	}
+}
+
+func (as *announceSeqs) peerKey(p peer.ID) datastore.Key {
+	return as.prefix.ChildString(p.String())
+}
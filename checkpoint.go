@@ -0,0 +1,457 @@
+package legs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// DefaultCheckpointPrefix is the datastore key prefix under which sync
+// checkpoints are stored if no other prefix is given to ResumableSync.
+const DefaultCheckpointPrefix = "/legs/syncCheckpoint"
+
+// checkpointInterval is the number of blocks that are synced between writes
+// of a sync checkpoint. A sync that is interrupted syncs at most this many
+// blocks again when it is resumed.
+const checkpointInterval = 64
+
+// syncCheckpoint records the progress of a sync with a publisher that has not
+// completed, so that the sync can be resumed instead of starting again at the
+// head.
+type syncCheckpoint struct {
+	// Head is the CID that the interrupted sync was syncing toward.
+	Head cid.Cid
+	// Stop is the stop link of the interrupted sync. A checkpoint is only
+	// valid if the stop link is still the latest sync for the publisher.
+	Stop cid.Cid
+	// Frontier is the links from which the interrupted sync must continue.
+	Frontier []frontierLink
+}
+
+// frontierLink is a link to a block that an interrupted sync had not yet
+// finished syncing.
+type frontierLink struct {
+	Cid cid.Cid
+	// Depth is the number of recursion edges of the selector sequence that
+	// were followed from the head of the sync to reach the link, which is used
+	// to count the resumed sync against the recursion limit of the interrupted
+	// sync.
+	Depth int64
+}
+
+// checkpointStore reads and writes sync checkpoints in a datastore, and
+// reports the blocks written by syncs to the trackers of their frontiers.
+type checkpointStore struct {
+	ds     datastore.Datastore
+	prefix datastore.Key
+
+	trackersMutex sync.Mutex
+	trackers      map[*frontierTracker]struct{}
+}
+
+func newCheckpointStore(ds datastore.Datastore, prefix string) *checkpointStore {
+	if prefix == "" {
+		prefix = DefaultCheckpointPrefix
+	}
+	return &checkpointStore{
+		ds:       ds,
+		prefix:   datastore.NewKey(prefix),
+		trackers: make(map[*frontierTracker]struct{}),
+	}
+}
+
+// get returns the checkpoint for the peer, or nil if there is none.
+func (cs *checkpointStore) get(p peer.ID) *syncCheckpoint {
+	val, err := cs.ds.Get(context.Background(), cs.peerKey(p))
+	if err != nil {
+		if err != datastore.ErrNotFound {
+			log.Errorw("Failed to read sync checkpoint", "err", err, "peer", p)
+		}
+		return nil
+	}
+	var cp syncCheckpoint
+	if err = json.Unmarshal(val, &cp); err != nil {
+		log.Errorw("Failed to decode sync checkpoint", "err", err, "peer", p)
+		return nil
+	}
+	if !cp.Head.Defined() {
+		return nil
+	}
+	return &cp
+}
+
+func (cs *checkpointStore) put(p peer.ID, cp *syncCheckpoint) {
+	val, err := json.Marshal(cp)
+	if err != nil {
+		log.Errorw("Failed to encode sync checkpoint", "err", err, "peer", p)
+		return
+	}
+	ctx := context.Background()
+	key := cs.peerKey(p)
+	if err = cs.ds.Put(ctx, key, val); err != nil {
+		log.Errorw("Failed to write sync checkpoint", "err", err, "peer", p)
+		return
+	}
+	// Sync so that the checkpoint is not lost if the process crashes.
+	if err = cs.ds.Sync(ctx, key); err != nil {
+		log.Errorw("Failed to sync sync checkpoint to datastore", "err", err, "peer", p)
+	}
+}
+
+func (cs *checkpointStore) remove(p peer.ID) {
+	err := cs.ds.Delete(context.Background(), cs.peerKey(p))
+	if err != nil && err != datastore.ErrNotFound {
+		log.Errorw("Failed to delete sync checkpoint", "err", err, "peer", p)
+	}
+}
+
+func (cs *checkpointStore) peerKey(p peer.ID) datastore.Key {
+	return cs.prefix.ChildString(p.String())
+}
+
+// observeWrites wraps a block write opener so that the blocks written by
+// syncs are reported to the frontier trackers of the syncs in progress.
+func (cs *checkpointStore) observeWrites(open linking.BlockWriteOpener) linking.BlockWriteOpener {
+	return func(lctx linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
+		w, commit, err := open(lctx)
+		if err != nil || !cs.tracking() {
+			return w, commit, err
+		}
+		var buf bytes.Buffer
+		return io.MultiWriter(w, &buf), func(lnk ipld.Link) error {
+			if err := commit(lnk); err != nil {
+				return err
+			}
+			cs.blockWritten(lnk, buf.Bytes())
+			return nil
+		}, nil
+	}
+}
+
+// track reports the blocks written to the link system to ft until the
+// returned function is called.
+func (cs *checkpointStore) track(ft *frontierTracker) func() {
+	cs.trackersMutex.Lock()
+	cs.trackers[ft] = struct{}{}
+	cs.trackersMutex.Unlock()
+	return func() {
+		cs.trackersMutex.Lock()
+		delete(cs.trackers, ft)
+		cs.trackersMutex.Unlock()
+	}
+}
+
+func (cs *checkpointStore) tracking() bool {
+	cs.trackersMutex.Lock()
+	defer cs.trackersMutex.Unlock()
+	return len(cs.trackers) != 0
+}
+
+func (cs *checkpointStore) blockWritten(lnk ipld.Link, data []byte) {
+	cl, ok := lnk.(cidlink.Link)
+	if !ok {
+		return
+	}
+	cs.trackersMutex.Lock()
+	defer cs.trackersMutex.Unlock()
+	for ft := range cs.trackers {
+		ft.blockData(cl.Cid, data)
+	}
+}
+
+// pendingLink is a link to a block that a sync has not yet explored, along
+// with the state of the selector at the link.
+type pendingLink struct {
+	sel selector.Selector
+	// edgeSel is the selector sequence with a recursion limit of one, which
+	// is explored alongside sel to count the recursion edges that are
+	// followed. It is nil if the edges can no longer be counted.
+	edgeSel selector.Selector
+	// depth is the number of recursion edges followed to reach the link.
+	depth int64
+	// resume is where a resumed sync must continue from to explore the link.
+	// This is the link itself if it was reached by following a recursion
+	// edge, since the state of the selector is then determined by the depth
+	// alone. Otherwise, it is the link that the block containing this link
+	// resumes from.
+	resume frontierLink
+}
+
+// frontierTracker tracks the frontier of a sync: the links to blocks that are
+// selected but not yet explored. This is done by exploring each block as it
+// is synced, using the same selector as the sync, so that the sync can be
+// resumed from the frontier if it is interrupted.
+type frontierTracker struct {
+	mutex    sync.Mutex
+	lsys     ipld.LinkSystem
+	head     cid.Cid
+	stop     cid.Cid
+	edgeSel  selector.Selector
+	pending  map[cid.Cid][]*pendingLink
+	explored map[cid.Cid]struct{}
+	// unsaved is the number of blocks explored since the checkpoint was last
+	// saved.
+	unsaved int
+	save    func(*syncCheckpoint)
+}
+
+// newFrontierTracker creates a tracker for a sync to head that uses the
+// selector sequence seq and stops at stop. The save function is called
+// periodically with a checkpoint of the sync.
+func newFrontierTracker(lsys ipld.LinkSystem, head, stop cid.Cid, seq ipld.Node, save func(*syncCheckpoint)) (*frontierTracker, error) {
+	edgeSel, err := selector.CompileSelector(ExploreRecursiveWithStopNode(selector.RecursionLimitDepth(1), seq, nil))
+	if err != nil {
+		return nil, err
+	}
+	return &frontierTracker{
+		lsys:     lsys,
+		head:     head,
+		stop:     stop,
+		edgeSel:  edgeSel,
+		pending:  make(map[cid.Cid][]*pendingLink),
+		explored: make(map[cid.Cid]struct{}),
+		save:     save,
+	}, nil
+}
+
+// add adds a link that is reached by following depth recursion edges, and
+// which is selected by sel.
+func (ft *frontierTracker) add(c cid.Cid, depth int64, sel selector.Selector) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	ft.addPending(c, &pendingLink{
+		sel:     sel,
+		edgeSel: ft.edgeSel,
+		depth:   depth,
+		resume:  frontierLink{Cid: c, Depth: depth},
+	})
+}
+
+func (ft *frontierTracker) addPending(c cid.Cid, pl *pendingLink) {
+	if _, ok := ft.explored[c]; ok {
+		// The block is already synced, but may be selected differently by
+		// this link, so explore it again.
+		ft.exploreLocal(c, []*pendingLink{pl})
+		return
+	}
+	for _, other := range ft.pending[c] {
+		if pl.resume.Cid == c && other.resume == pl.resume {
+			// Already pending with the same selector state.
+			return
+		}
+	}
+	ft.pending[c] = append(ft.pending[c], pl)
+}
+
+// isPending returns true if the block has not been explored.
+func (ft *frontierTracker) isPending(c cid.Cid) bool {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	_, ok := ft.pending[c]
+	return ok
+}
+
+// blockData explores a block that was written to the link system.
+func (ft *frontierTracker) blockData(c cid.Cid, data []byte) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	pls, ok := ft.pending[c]
+	if !ok {
+		return
+	}
+	decoder, err := ft.lsys.DecoderChooser(cidlink.Link{Cid: c})
+	if err != nil {
+		return
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err = decoder(nb, bytes.NewReader(data)); err != nil {
+		return
+	}
+	ft.explore(c, nb.Build(), pls)
+}
+
+// blockSynced explores a block that a syncer reported as synced, if it was
+// not already explored when it was written. This covers blocks that were
+// already in the link system.
+func (ft *frontierTracker) blockSynced(c cid.Cid) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	if pls, ok := ft.pending[c]; ok {
+		ft.exploreLocal(c, pls)
+	}
+}
+
+// exploreLocal explores a block, and the pending blocks that it links to,
+// that are in the link system.
+func (ft *frontierTracker) exploreLocal(c cid.Cid, pls []*pendingLink) {
+	n, err := ft.lsys.Load(ipld.LinkContext{}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+	if err != nil {
+		// Not synced, or removed by a block hook after being synced.
+		return
+	}
+	ft.explore(c, n, pls)
+}
+
+// explore records the links in block c that are selected by the pending
+// links to it.
+func (ft *frontierTracker) explore(c cid.Cid, n ipld.Node, pls []*pendingLink) {
+	delete(ft.pending, c)
+	ft.explored[c] = struct{}{}
+	for _, pl := range pls {
+		err := exploreLinks(n, pl.sel, pl.edgeSel, ft.edgeSel, pl.depth, func(lc cid.Cid, sel, edgeSel selector.Selector, depth int64, atEdge bool) {
+			resume := pl.resume
+			if atEdge {
+				resume = frontierLink{Cid: lc, Depth: depth}
+			}
+			ft.addPending(lc, &pendingLink{
+				sel:     sel,
+				edgeSel: edgeSel,
+				depth:   depth,
+				resume:  resume,
+			})
+		})
+		if err != nil {
+			log.Errorw("Cannot explore block to checkpoint sync", "err", err, "cid", c)
+			// Resume from this block if the sync is interrupted.
+			ft.pending[c] = append(ft.pending[c], pl)
+		}
+	}
+
+	ft.unsaved++
+	if ft.unsaved >= checkpointInterval {
+		ft.save(ft.checkpointLocked())
+		ft.unsaved = 0
+	}
+}
+
+// checkpoint returns a checkpoint from which the sync can be resumed.
+func (ft *frontierTracker) checkpoint() *syncCheckpoint {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	return ft.checkpointLocked()
+}
+
+func (ft *frontierTracker) checkpointLocked() *syncCheckpoint {
+	cp := &syncCheckpoint{
+		Head: ft.head,
+		Stop: ft.stop,
+	}
+	seen := make(map[frontierLink]struct{})
+	for _, pls := range ft.pending {
+		for _, pl := range pls {
+			if _, ok := seen[pl.resume]; ok {
+				continue
+			}
+			seen[pl.resume] = struct{}{}
+			cp.Frontier = append(cp.Frontier, pl.resume)
+		}
+	}
+	return cp
+}
+
+// exploreLinks finds the links in n that are selected by sel, in the same way
+// as a traversal, and calls found with the selector at each link. The edge
+// selector is explored alongside sel to count the recursion edges followed:
+// it remains an ExploreRecursive until an edge is followed, and is then reset
+// to edgeRoot. If an edge is followed along with other selectors, then the
+// edges are no longer counted, and the edge selector passed to found is nil.
+// The atEdge argument of found is true if the link was reached by following a
+// recursion edge and nothing else, so that sel is determined by the depth.
+func exploreLinks(n ipld.Node, sel, edgeSel, edgeRoot selector.Selector, depth int64,
+	found func(c cid.Cid, sel, edgeSel selector.Selector, depth int64, atEdge bool)) error {
+	if _, ok := sel.(selector.Reifiable); ok {
+		// Links within an ADL cannot be found without reifying it.
+		return nil
+	}
+	switch n.Kind() {
+	case datamodel.Kind_Map, datamodel.Kind_List:
+	default:
+		return nil
+	}
+
+	explore := func(ps datamodel.PathSegment, v ipld.Node) error {
+		next, err := sel.Explore(n, ps)
+		if err != nil || next == nil {
+			return err
+		}
+		nextDepth := depth
+		var nextEdge selector.Selector
+		var nextAtEdge bool
+		if edgeSel != nil {
+			nextEdge, _ = edgeSel.Explore(n, ps)
+			switch nextEdge.(type) {
+			case selector.ExploreRecursive:
+				// No recursion edge was followed.
+			case nil:
+				// Only a recursion edge was followed.
+				nextDepth++
+				nextEdge = edgeRoot
+				nextAtEdge = true
+			default:
+				// A recursion edge was followed along with other selectors,
+				// so the recursion edges are no longer counted.
+				nextDepth++
+				nextEdge = nil
+			}
+		}
+		if v.Kind() == datamodel.Kind_Link {
+			lnk, _ := v.AsLink()
+			if cl, ok := lnk.(cidlink.Link); ok {
+				found(cl.Cid, next, nextEdge, nextDepth, nextAtEdge)
+			}
+			return nil
+		}
+		return exploreLinks(v, next, nextEdge, edgeRoot, nextDepth, found)
+	}
+
+	attn := sel.Interests()
+	if attn == nil {
+		for itr := selector.NewSegmentIterator(n); !itr.Done(); {
+			ps, v, err := itr.Next()
+			if err != nil {
+				return err
+			}
+			if err = explore(ps, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, ps := range attn {
+		v, err := n.LookupBySegment(ps)
+		if err != nil {
+			continue
+		}
+		if err = explore(ps, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remainingLimit returns what remains of the recursion limit after recursing
+// to the given depth.
+func remainingLimit(limit selector.RecursionLimit, depth int64) selector.RecursionLimit {
+	if limit.Mode() != selector.RecursionLimit_Depth {
+		return limit
+	}
+	remaining := limit.Depth() - depth
+	if remaining < 0 {
+		remaining = 0
+	}
+	return selector.RecursionLimitDepth(remaining)
+}
@@ -0,0 +1,299 @@
+package legs
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// checkpointTestEnv is an httpsync publisher of a chain that subscribers can
+// sync from.
+type checkpointTestEnv struct {
+	pubID     peer.ID
+	pubAddr   multiaddr.Multiaddr
+	srcStore  datastore.Batching
+	chainLnks []ipld.Link
+}
+
+func newCheckpointTestEnv(t *testing.T) *checkpointTestEnv {
+	srcPrivKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	srcHost := test.MkTestHost(libp2p.Identity(srcPrivKey))
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcLnkS := test.MkLinkSystem(srcStore)
+	pub, err := httpsync.NewPublisher("127.0.0.1:0", srcLnkS, srcHost.ID(), srcPrivKey)
+	require.NoError(t, err)
+	t.Cleanup(func() { pub.Close() })
+
+	chainLnks := test.MkChain(srcLnkS, true)
+	require.NoError(t, pub.SetRoot(context.Background(), chainLnks[0].(cidlink.Link).Cid))
+	return &checkpointTestEnv{
+		pubID:     srcHost.ID(),
+		pubAddr:   pub.Address(),
+		srcStore:  srcStore,
+		chainLnks: chainLnks,
+	}
+}
+
+// copyBlock copies a block from the publisher's store, as if it had been
+// synced.
+func (te *checkpointTestEnv) copyBlock(t *testing.T, dstStore datastore.Batching, lnk ipld.Link) {
+	key := datastore.NewKey(lnk.String())
+	val, err := te.srcStore.Get(context.Background(), key)
+	require.NoError(t, err)
+	require.NoError(t, dstStore.Put(context.Background(), key, val))
+}
+
+// syncHead syncs the subscriber to the publisher's head, and returns the
+// SyncFinished and the CIDs of the blocks received.
+func (te *checkpointTestEnv) syncHead(t *testing.T, sub *Subscriber) (SyncFinished, []cid.Cid) {
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+	events, cnclEvents := sub.OnSyncEvent()
+	defer cnclEvents()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	syncCid, err := sub.Sync(ctx, te.pubID, cid.Undef, nil, te.pubAddr)
+	require.NoError(t, err)
+	require.Equal(t, te.chainLnks[0].(cidlink.Link).Cid, syncCid)
+
+	var syncFin SyncFinished
+	select {
+	case syncFin = <-watcher:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for sync finished")
+	}
+
+	var received []cid.Cid
+	for {
+		select {
+		case event := <-events:
+			if event.Type == SyncEventBlockReceived {
+				received = append(received, event.Link)
+			}
+			continue
+		default:
+		}
+		break
+	}
+	return syncFin, received
+}
+
+// storedKeys returns the keys in the datastore.
+func storedKeys(t *testing.T, ds datastore.Batching) []string {
+	results, err := ds.Query(context.Background(), query.Query{KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	keys := make([]string, len(entries))
+	for i := range entries {
+		keys[i] = entries[i].Key
+	}
+	return keys
+}
+
+func TestResumeSyncFromCheckpoint(t *testing.T) {
+	te := newCheckpointTestEnv(t)
+	chainLnks := te.chainLnks
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstLnkS := test.MkLinkSystem(dstStore)
+	sub, err := NewSubscriber(test.MkTestHost(), dstStore, dstLnkS, testTopic, nil, ResumableSync(""))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// Record a checkpoint as if a sync to chainLnks[1] was interrupted after
+	// receiving chainLnks[1], which links to the rest of the chain.
+	te.copyBlock(t, dstStore, chainLnks[1])
+	sub.checkpoints.put(te.pubID, &syncCheckpoint{
+		Head:     chainLnks[1].(cidlink.Link).Cid,
+		Frontier: []frontierLink{{Cid: chainLnks[2].(cidlink.Link).Cid, Depth: 1}},
+	})
+
+	syncFin, received := te.syncHead(t, sub)
+
+	// The new head is synced, and then the interrupted sync is resumed.
+	for _, lnk := range chainLnks {
+		_, err = dstStore.Get(context.Background(), datastore.NewKey(lnk.String()))
+		require.NoError(t, err)
+	}
+	require.Equal(t, chainLnks[0].(cidlink.Link).Cid, syncFin.SyncedCids[0])
+	require.Contains(t, syncFin.SyncedCids, chainLnks[3].(cidlink.Link).Cid)
+
+	// The block received before the sync was interrupted must not have been
+	// fetched again.
+	require.NotContains(t, received, chainLnks[1].(cidlink.Link).Cid)
+	require.Contains(t, received, chainLnks[2].(cidlink.Link).Cid)
+
+	require.Nil(t, sub.checkpoints.get(te.pubID), "checkpoint should be removed after sync completes")
+}
+
+func TestResumeInterruptedSync(t *testing.T) {
+	te := newCheckpointTestEnv(t)
+	chainLnks := te.chainLnks
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	sub, err := NewSubscriber(test.MkTestHost(), dstStore, test.MkLinkSystem(dstStore), testTopic, nil, ResumableSync(""))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// Interrupt the sync by making a block in the middle of the chain
+	// unavailable.
+	ch2Key := datastore.NewKey(chainLnks[2].String())
+	ch2, err := te.srcStore.Get(context.Background(), ch2Key)
+	require.NoError(t, err)
+	require.NoError(t, te.srcStore.Delete(context.Background(), ch2Key))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = sub.Sync(ctx, te.pubID, cid.Undef, nil, te.pubAddr)
+	require.Error(t, err)
+
+	// The checkpoint records the missing block as the frontier, two
+	// recursion edges from the head.
+	cp := sub.checkpoints.get(te.pubID)
+	require.NotNil(t, cp)
+	require.Equal(t, chainLnks[0].(cidlink.Link).Cid, cp.Head)
+	require.Contains(t, cp.Frontier, frontierLink{Cid: chainLnks[2].(cidlink.Link).Cid, Depth: 2})
+	for _, fl := range cp.Frontier {
+		require.NotEqual(t, chainLnks[0].(cidlink.Link).Cid, fl.Cid)
+		require.NotEqual(t, chainLnks[1].(cidlink.Link).Cid, fl.Cid)
+	}
+
+	require.NoError(t, te.srcStore.Put(context.Background(), ch2Key, ch2))
+	_, received := te.syncHead(t, sub)
+	require.NotContains(t, received, chainLnks[0].(cidlink.Link).Cid)
+	require.NotContains(t, received, chainLnks[1].(cidlink.Link).Cid)
+	require.Contains(t, received, chainLnks[2].(cidlink.Link).Cid)
+	for _, lnk := range chainLnks {
+		_, err = dstStore.Get(context.Background(), datastore.NewKey(lnk.String()))
+		require.NoError(t, err)
+	}
+	require.Nil(t, sub.checkpoints.get(te.pubID), "checkpoint should be removed after sync completes")
+}
+
+func TestResumeSyncRecursionLimit(t *testing.T) {
+	te := newCheckpointTestEnv(t)
+	chainLnks := te.chainLnks
+	limit := SyncRecursionLimit(selector.RecursionLimitDepth(3))
+
+	// Sync without interruption to find what the recursion limit allows.
+	refStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	refSub, err := NewSubscriber(test.MkTestHost(), refStore, test.MkLinkSystem(refStore), testTopic, nil, limit)
+	require.NoError(t, err)
+	defer refSub.Close()
+	refFin, _ := te.syncHead(t, refSub)
+	refKeys := storedKeys(t, refStore)
+	require.NotContains(t, refFin.SyncedCids, chainLnks[3].(cidlink.Link).Cid, "recursion limit should stop sync before end of chain")
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	sub, err := NewSubscriber(test.MkTestHost(), dstStore, test.MkLinkSystem(dstStore), testTopic, nil, limit, ResumableSync(""))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// Record a checkpoint as if a sync to the head was interrupted after
+	// receiving the head and the next block in the chain. That block links
+	// to two blocks that have not been received.
+	te.copyBlock(t, dstStore, chainLnks[0])
+	te.copyBlock(t, dstStore, chainLnks[1])
+	srcLnkS := test.MkLinkSystem(te.srcStore)
+	ch3Node, err := srcLnkS.Load(ipld.LinkContext{}, chainLnks[1], basicnode.Prototype.Any)
+	require.NoError(t, err)
+	alpha, err := ch3Node.LookupByString("linkedString")
+	require.NoError(t, err)
+	alphaLnk, err := alpha.AsLink()
+	require.NoError(t, err)
+	sub.checkpoints.put(te.pubID, &syncCheckpoint{
+		Head: chainLnks[0].(cidlink.Link).Cid,
+		Frontier: []frontierLink{
+			{Cid: alphaLnk.(cidlink.Link).Cid, Depth: 2},
+			{Cid: chainLnks[2].(cidlink.Link).Cid, Depth: 2},
+		},
+	})
+
+	_, received := te.syncHead(t, sub)
+	require.NotContains(t, received, chainLnks[0].(cidlink.Link).Cid)
+	require.NotContains(t, received, chainLnks[1].(cidlink.Link).Cid)
+
+	// The resumed sync must sync the same blocks as the uninterrupted sync,
+	// without exceeding its recursion limit.
+	require.ElementsMatch(t, refKeys, storedKeys(t, dstStore))
+}
+
+func TestFrontierTracker(t *testing.T) {
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	lsys := test.MkLinkSystem(store)
+	chainLnks := test.MkChain(lsys, true)
+	ch3 := chainLnks[1].(cidlink.Link).Cid
+	ch2 := chainLnks[2].(cidlink.Link).Cid
+
+	linkIn := func(c cid.Cid, path ...string) cid.Cid {
+		n, err := lsys.Load(ipld.LinkContext{}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+		require.NoError(t, err)
+		for _, seg := range path {
+			n, err = n.LookupByString(seg)
+			require.NoError(t, err)
+		}
+		lnk, err := n.AsLink()
+		require.NoError(t, err)
+		return lnk.(cidlink.Link).Cid
+	}
+	middleMap := linkIn(ch2, "linkedMap")
+	alpha := linkIn(middleMap, "nested", "alink")
+
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	track := func(head cid.Cid, seq ipld.Node) *frontierTracker {
+		ft, err := newFrontierTracker(lsys, head, cid.Undef, seq, func(*syncCheckpoint) {})
+		require.NoError(t, err)
+		sel, err := selector.CompileSelector(ExploreRecursiveWithStopNode(selector.RecursionLimitNone(), seq, nil))
+		require.NoError(t, err)
+		ft.add(head, 0, sel)
+		return ft
+	}
+
+	// Following two path segments within a block to reach a link counts as
+	// one recursion edge.
+	seq := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("linkedMap", ssb.ExploreRecursiveEdge())
+		efsb.Insert("nested", ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("alink", ssb.ExploreRecursiveEdge())
+		}))
+	}).Node()
+	ft := track(ch2, seq)
+	ft.blockSynced(ch2)
+	require.Equal(t, []frontierLink{{Cid: middleMap, Depth: 1}}, ft.checkpoint().Frontier)
+	ft.blockSynced(middleMap)
+	require.Equal(t, []frontierLink{{Cid: alpha, Depth: 2}}, ft.checkpoint().Frontier)
+
+	// A link that is reached in the middle of the selector sequence cannot be
+	// resumed from, so the block that contains it is resumed from instead.
+	seq = ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("ch2", ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("linkedMap", ssb.ExploreRecursiveEdge())
+		}))
+	}).Node()
+	ft = track(ch3, seq)
+	ft.blockSynced(ch3)
+	require.Equal(t, []frontierLink{{Cid: ch3, Depth: 0}}, ft.checkpoint().Frontier)
+	ft.blockSynced(ch2)
+	require.Equal(t, []frontierLink{{Cid: middleMap, Depth: 1}}, ft.checkpoint().Frontier)
+}
@@ -1,5 +1,7 @@
 // Code adapted from original generated by github.com/whyrusleeping/cbor-gen.
-// This adapted code allows for an optional OrigPeer field.
+// This adapted code allows for an optional OrigPeer field, and for optional
+// Seq, Timestamp, PubKey, and Signature fields. If any of the latter are
+// present then all fields, including an empty OrigPeer, are encoded.
 //
 // TODO: Convert Message into IPLD schema and use bindnode for serialization.
 
@@ -8,6 +10,7 @@ package dtsync
 import (
 	"fmt"
 	"io"
+	"math"
 
 	cbg "github.com/whyrusleeping/cbor-gen"
 )
@@ -20,8 +23,15 @@ func (t *Message) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
+	if t.Timestamp < 0 {
+		return fmt.Errorf("negative value in field t.Timestamp")
+	}
+	hasSeq := t.hasSeq()
+
 	var lengthBufMessage []byte
-	if t.OrigPeer == "" {
+	if hasSeq {
+		lengthBufMessage = []byte{136}
+	} else if t.OrigPeer == "" {
 		lengthBufMessage = []byte{131}
 	} else {
 		lengthBufMessage = []byte{132}
@@ -72,7 +82,7 @@ func (t *Message) MarshalCBOR(w io.Writer) error {
 	}
 
 	// OrigPeer is empty so do not encode it.
-	if len(t.OrigPeer) == 0 {
+	if len(t.OrigPeer) == 0 && !hasSeq {
 		return nil
 	}
 
@@ -88,6 +98,31 @@ func (t *Message) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
+	if !hasSeq {
+		return nil
+	}
+
+	// Encode t.Seq and t.Timestamp.
+	if err = cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, t.Seq); err != nil {
+		return err
+	}
+	if err = cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Timestamp)); err != nil {
+		return err
+	}
+
+	// Encode t.PubKey and t.Signature.
+	for _, b := range [][]byte{t.PubKey, t.Signature} {
+		if len(b) > cbg.ByteArrayMaxLen {
+			return fmt.Errorf("byte array in field was too long")
+		}
+		if err = cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajByteString, uint64(len(b))); err != nil {
+			return err
+		}
+		if _, err = w.Write(b); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -105,16 +140,17 @@ func (t *Message) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra > 4 {
+	if extra > 8 {
 		return fmt.Errorf("cbor input had too many fields")
 	}
 	if extra < 3 {
 		return fmt.Errorf("cbor input had too few fields")
 	}
-	var hasOrigPeer bool
-	if extra == 4 {
-		hasOrigPeer = true
+	if extra > 4 && extra < 8 {
+		return fmt.Errorf("cbor input had wrong number of fields")
 	}
+	hasOrigPeer := extra >= 4
+	hasSeq := extra == 8
 
 	// Decode t.Cid.
 	t.Cid, err = cbg.ReadCid(br)
@@ -195,5 +231,52 @@ func (t *Message) UnmarshalCBOR(r io.Reader) error {
 	}
 	t.OrigPeer = string(sval)
 
+	// Seq field does not exist, so nothing more to do.
+	if !hasSeq {
+		return nil
+	}
+
+	// Decode t.Seq and t.Timestamp.
+	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field t.Seq")
+	}
+	t.Seq = extra
+
+	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for field t.Timestamp")
+	}
+	if extra > math.MaxInt64 {
+		return fmt.Errorf("value too large for field t.Timestamp")
+	}
+	t.Timestamp = int64(extra)
+
+	// Decode t.PubKey and t.Signature.
+	for _, field := range []*[]byte{&t.PubKey, &t.Signature} {
+		maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+		if err != nil {
+			return err
+		}
+		if extra > cbg.ByteArrayMaxLen {
+			return fmt.Errorf("byte array too large (%d)", extra)
+		}
+		if maj != cbg.MajByteString {
+			return fmt.Errorf("expected byte array")
+		}
+		if extra > 0 {
+			*field = make([]uint8, extra)
+			if _, err = io.ReadFull(br, *field); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
@@ -1,13 +1,27 @@
 package dtsync
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 
 	"github.com/ipfs/go-cid"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/multiformats/go-multiaddr"
 )
 
-var ErrBadEncoding = errors.New("invalid message encoding")
+// messageSigDomain is prepended to the encoded message to create the data
+// that is signed for an announce message. This keeps a message signature from
+// being valid as any other kind of signature.
+const messageSigDomain = "/legs/announce:"
+
+var (
+	ErrBadEncoding = errors.New("invalid message encoding")
+	// ErrBadSignature is returned when a message signature is invalid or
+	// missing.
+	ErrBadSignature = errors.New("invalid message signature")
+)
 
 // Message is the payload of a gossip pubsub message.
 type Message struct {
@@ -19,6 +33,81 @@ type Message struct {
 	// that are re-published by an indexer, for consumption by othen indexers,
 	// contain this field.
 	OrigPeer string
+
+	// Seq is the sequence number of the message. Each message from a
+	// publisher has a greater sequence number than the previous one. Zero
+	// means the message has no sequence number. Only trusted if the message
+	// is signed.
+	Seq uint64
+	// Timestamp is the time, in unix nanoseconds, that the message was
+	// created.
+	Timestamp int64
+	// PubKey is the encoded public key of the publisher that signed the
+	// message.
+	PubKey []byte
+	// Signature is the publisher's signature of all other fields, except
+	// OrigPeer so that the message can be re-published.
+	Signature []byte
+}
+
+// hasSeq returns true if the message has any of the fields that are encoded
+// after OrigPeer.
+func (m *Message) hasSeq() bool {
+	return m.Seq != 0 || m.Timestamp != 0 || len(m.PubKey) != 0 || len(m.Signature) != 0
+}
+
+// Sign sets the message's public key and signature, signing the message with
+// the publisher's private key. The message must not be modified after
+// signing, other than setting OrigPeer.
+func (m *Message) Sign(privKey ic.PrivKey) error {
+	pubKeyBytes, err := ic.MarshalPublicKey(privKey.GetPublic())
+	if err != nil {
+		return err
+	}
+	m.PubKey = pubKeyBytes
+	data, err := m.sigData()
+	if err != nil {
+		return err
+	}
+	m.Signature, err = privKey.Sign(data)
+	return err
+}
+
+// VerifySignature checks the message signature, and returns the ID of the peer
+// that signed the message. The caller must check that the signer is the
+// expected publisher.
+func (m *Message) VerifySignature() (peer.ID, error) {
+	if len(m.Signature) == 0 || len(m.PubKey) == 0 {
+		return "", fmt.Errorf("%w: message not signed", ErrBadSignature)
+	}
+	pubKey, err := ic.UnmarshalPublicKey(m.PubKey)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrBadSignature, err)
+	}
+	data, err := m.sigData()
+	if err != nil {
+		return "", err
+	}
+	ok, err := pubKey.Verify(data, m.Signature)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrBadSignature, err)
+	}
+	if !ok {
+		return "", ErrBadSignature
+	}
+	return peer.IDFromPublicKey(pubKey)
+}
+
+// sigData returns the data that is signed for the message.
+func (m *Message) sigData() ([]byte, error) {
+	unsigned := *m
+	unsigned.OrigPeer = ""
+	unsigned.Signature = nil
+	buf := bytes.NewBufferString(messageSigDomain)
+	if err := unsigned.MarshalCBOR(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // SetAddrs writes a slice of Multiaddr into the Message as a slice of []byte.
@@ -0,0 +1,84 @@
+package dtsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/test"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	addr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9999")
+	require.NoError(t, err)
+
+	msg := Message{
+		Cid:       cids[0],
+		ExtraData: []byte("t01000"),
+	}
+	msg.SetAddrs([]multiaddr.Multiaddr{addr})
+
+	// Messages without a sequence number keep their original encoding.
+	for _, origPeer := range []string{"", "12D3KooWSomePeer"} {
+		msg.OrigPeer = origPeer
+		buf := bytes.NewBuffer(nil)
+		require.NoError(t, msg.MarshalCBOR(buf))
+		if origPeer == "" {
+			require.Equal(t, byte(131), buf.Bytes()[0])
+		} else {
+			require.Equal(t, byte(132), buf.Bytes()[0])
+		}
+		var decoded Message
+		require.NoError(t, decoded.UnmarshalCBOR(buf))
+		require.Equal(t, msg, decoded)
+	}
+
+	msg.OrigPeer = ""
+	msg.Seq = 7
+	msg.Timestamp = time.Now().UnixNano()
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, msg.MarshalCBOR(buf))
+	var decoded Message
+	require.NoError(t, decoded.UnmarshalCBOR(buf))
+	require.Equal(t, msg, decoded)
+}
+
+func TestMessageSignature(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	require.NoError(t, err)
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+
+	msg := Message{
+		Cid:       cids[0],
+		Seq:       1,
+		Timestamp: time.Now().UnixNano(),
+	}
+	_, err = msg.VerifySignature()
+	require.ErrorIs(t, err, ErrBadSignature)
+
+	require.NoError(t, msg.Sign(privKey))
+	// Setting the original peer does not invalidate the signature.
+	msg.OrigPeer = "12D3KooWRelayedFrom"
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, msg.MarshalCBOR(buf))
+	var decoded Message
+	require.NoError(t, decoded.UnmarshalCBOR(buf))
+	signer, err := decoded.VerifySignature()
+	require.NoError(t, err)
+	require.Equal(t, peerID, signer)
+
+	decoded.Seq++
+	_, err = decoded.VerifySignature()
+	require.ErrorIs(t, err, ErrBadSignature)
+}
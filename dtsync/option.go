@@ -2,16 +2,28 @@ package dtsync
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/filecoin-project/go-legs/gpubsub"
+	"github.com/filecoin-project/go-legs/internal/syncopt"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	"github.com/libp2p/go-libp2p-core/peer"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 )
 
 // config contains all options for configuring dtsync.publisher.
 type config struct {
-	extraData []byte
-	topic     *pubsub.Topic
-	allowPeer func(peer.ID) bool
+	extraData     []byte
+	topic         *pubsub.Topic
+	allowPeer     func(peer.ID) bool
+	historyLimit  int
+	historyDS     datastore.Datastore
+	signAnnounces bool
+
+	announcePeers []peer.AddrInfo
+	noPubsub      bool
+	pubsubOptions []gpubsub.Option
 }
 
 type Option func(*config) error
@@ -26,9 +38,13 @@ func (c *config) apply(opts []Option) error {
 	return nil
 }
 
-// WithExtraData sets the extra data to include in the pubsub message.
+// WithExtraData sets the extra data to include in the pubsub message. The data
+// must not be larger than MaxExtraDataSize.
 func WithExtraData(data []byte) Option {
 	return func(c *config) error {
+		if len(data) > MaxExtraDataSize {
+			return fmt.Errorf("extra data larger than %d bytes", MaxExtraDataSize)
+		}
 		if len(data) != 0 {
 			c.extraData = data
 		}
@@ -36,7 +52,8 @@ func WithExtraData(data []byte) Option {
 	}
 }
 
-// Topic provides an existing pubsub topic.
+// Topic provides an existing pubsub topic. The caller may register a validator
+// created by NewValidator for the topic.
 func Topic(topic *pubsub.Topic) Option {
 	return func(c *config) error {
 		c.topic = topic
@@ -52,3 +69,86 @@ func AllowPeer(allowPeer func(peer.ID) bool) Option {
 		return nil
 	}
 }
+
+// HeadHistory makes the publisher keep a history of the limit most recent
+// heads, signed with the host's private key, and serve it over the head
+// protocol. See Syncer.GetHeadHistory. The history is stored in ds, so that
+// head sequence numbers continue from where they were when the publisher
+// restarts. If ds is nil, then the history is stored in the datastore given to
+// NewPublisher, or only kept in memory by NewPublisherFromExisting.
+func HeadHistory(limit int, ds datastore.Datastore) Option {
+	return func(c *config) error {
+		if limit < 1 {
+			return fmt.Errorf("head history limit must be at least 1")
+		}
+		c.historyLimit = limit
+		c.historyDS = ds
+		return nil
+	}
+}
+
+// SignAnnounces makes the publisher include a sequence number and timestamp in
+// each announce message, and sign the message with the host's private key.
+// This lets subscribers reject announce messages that are older than ones
+// already received, and verify announce messages that are re-published by
+// other peers. Sequence numbers are derived from the time, so that they
+// keep increasing when the publisher restarts.
+//
+// Subscribers that do not support signed announce messages cannot decode
+// them.
+func SignAnnounces() Option {
+	return func(c *config) error {
+		c.signAnnounces = true
+		return nil
+	}
+}
+
+// StreamAnnounce makes the publisher send each announce message directly to
+// the given subscribers, over a libp2p stream protocol, in addition to
+// publishing it over pubsub. Subscribers must be created with the
+// legs.StreamAnnounce option to receive these messages.
+//
+// Messages are sent to the subscribers in the background, so UpdateRoot does
+// not wait for them to be sent and does not return an error if sending fails.
+// Failures to send are logged.
+func StreamAnnounce(peers ...peer.AddrInfo) Option {
+	return func(c *config) error {
+		c.announcePeers = append(c.announcePeers, peers...)
+		return nil
+	}
+}
+
+// NoPubsub makes the publisher not join a pubsub topic, so that announce
+// messages are only sent to the subscribers given by StreamAnnounce.
+func NoPubsub() Option {
+	return func(c *config) error {
+		c.noPubsub = true
+		return nil
+	}
+}
+
+// PubsubOptions configures the gossipsub router and topic that the publisher
+// creates. This option cannot be used with Topic or NoPubsub.
+func PubsubOptions(options ...gpubsub.Option) Option {
+	return func(c *config) error {
+		c.pubsubOptions = append(c.pubsubOptions, options...)
+		return nil
+	}
+}
+
+// SyncOption is an option for configuring Sync.
+type SyncOption = syncopt.Option
+
+// BlockSizeHook sets a function that is called with the size of each block
+// received from a peer over the network. Blocks that are already stored
+// locally are not reported.
+func BlockSizeHook(hook func(peer.ID, cid.Cid, uint64)) SyncOption {
+	return syncopt.BlockSizeHook(hook)
+}
+
+// RateLimitWaitHook sets a function that is called when a sync with a peer
+// hits its rate limit and waits before continuing. The function is given the
+// CID that the sync continues from and the time that the sync waits.
+func RateLimitWaitHook(hook func(peer.ID, cid.Cid, time.Duration)) SyncOption {
+	return syncopt.RateLimitWaitHook(hook)
+}
@@ -11,12 +11,15 @@ import (
 
 	dt "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-legs/gpubsub"
+	"github.com/filecoin-project/go-legs/p2p/protocol/announce"
 	"github.com/filecoin-project/go-legs/p2p/protocol/head"
 	"github.com/hashicorp/go-multierror"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	ma "github.com/multiformats/go-multiaddr"
 )
@@ -29,7 +32,24 @@ type publisher struct {
 	headPublisher *head.Publisher
 	host          host.Host
 	extraData     []byte
-	topic         *pubsub.Topic
+	// topic is nil if the publisher does not use pubsub.
+	topic *pubsub.Topic
+
+	// signAnnounces is true if announce messages are given a sequence number
+	// and signed. See SignAnnounces.
+	signAnnounces bool
+	// lastSeq is the sequence number of the last announce message.
+	lastSeq  uint64
+	seqMutex sync.Mutex
+
+	// topicName is the name of the topic, used for sending announce messages
+	// to announcePeers. See StreamAnnounce.
+	topicName     string
+	announcePeers []peer.ID
+	// announceCtx is canceled when the publisher is closed, to stop sending
+	// announce messages to announcePeers.
+	announceCtx    context.Context
+	cancelAnnounce context.CancelFunc
 }
 
 const shutdownTime = 5 * time.Second
@@ -42,12 +62,24 @@ func NewPublisher(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, t
 		return nil, err
 	}
 
+	if cfg.noPubsub && cfg.topic != nil {
+		return nil, errors.New("topic cannot be used with NoPubsub option")
+	}
+	if len(cfg.pubsubOptions) != 0 && (cfg.topic != nil || cfg.noPubsub) {
+		return nil, errors.New("pubsub options cannot be used with Topic or NoPubsub option")
+	}
+
+	headPublisher, err := newHeadPublisher(host, ds, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create head publisher: %w", err)
+	}
+
 	var cancel context.CancelFunc
 	t := cfg.topic
-	if t == nil {
+	if t == nil && !cfg.noPubsub {
 		var ctx context.Context
 		ctx, cancel = context.WithCancel(context.Background())
-		t, err = gpubsub.MakePubsub(ctx, host, topic)
+		t, err = gpubsub.MakePubsub(ctx, host, topic, append(cfg.pubsubOptions, gpubsub.Validator(NewValidator(nil)))...)
 		if err != nil {
 			cancel()
 			return nil, err
@@ -62,7 +94,6 @@ func NewPublisher(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, t
 		return nil, err
 	}
 
-	headPublisher := head.NewPublisher()
 	startHeadPublisher(host, topic, headPublisher)
 
 	p := &publisher{
@@ -72,7 +103,11 @@ func NewPublisher(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, t
 		headPublisher: headPublisher,
 		host:          host,
 		topic:         t,
+		topicName:     topic,
+		signAnnounces: cfg.signAnnounces,
+		announcePeers: addAnnouncePeers(host, cfg.announcePeers),
 	}
+	p.announceCtx, p.cancelAnnounce = context.WithCancel(context.Background())
 
 	if len(cfg.extraData) != 0 {
 		p.extraData = cfg.extraData
@@ -80,6 +115,43 @@ func NewPublisher(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, t
 	return p, nil
 }
 
+// addAnnouncePeers adds the addresses of the subscribers that announce messages
+// are sent to, to the host's peerstore, and returns their IDs.
+func addAnnouncePeers(host host.Host, peers []peer.AddrInfo) []peer.ID {
+	if len(peers) == 0 {
+		return nil
+	}
+	ids := make([]peer.ID, len(peers))
+	for i, ai := range peers {
+		host.Peerstore().AddAddrs(ai.ID, ai.Addrs, peerstore.PermanentAddrTTL)
+		ids[i] = ai.ID
+	}
+	return ids
+}
+
+// newHeadPublisher creates a head publisher, that keeps a head history if
+// configured to. The history is stored in ds if the config does not give a
+// datastore for it, or is kept in memory if ds is also nil.
+func newHeadPublisher(host host.Host, ds datastore.Datastore, cfg config) (*head.Publisher, error) {
+	if cfg.historyLimit == 0 {
+		return head.NewPublisher(), nil
+	}
+	if cfg.historyDS != nil {
+		ds = cfg.historyDS
+	}
+	var history *head.History
+	if ds != nil {
+		var err error
+		history, err = head.LoadHistory(context.Background(), ds, "", cfg.historyLimit)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		history = head.NewHistory(cfg.historyLimit)
+	}
+	return head.NewPublisherWithHistory(history, host.Peerstore().PrivKey(host.ID()))
+}
+
 func startHeadPublisher(host host.Host, topic string, headPublisher *head.Publisher) {
 	go func() {
 		log.Infow("Starting head publisher for topic", "topic", topic, "host", host.ID())
@@ -100,12 +172,24 @@ func NewPublisherFromExisting(dtManager dt.Manager, host host.Host, topic string
 		return nil, err
 	}
 
+	if cfg.noPubsub && cfg.topic != nil {
+		return nil, errors.New("topic cannot be used with NoPubsub option")
+	}
+	if len(cfg.pubsubOptions) != 0 && (cfg.topic != nil || cfg.noPubsub) {
+		return nil, errors.New("pubsub options cannot be used with Topic or NoPubsub option")
+	}
+
+	headPublisher, err := newHeadPublisher(host, nil, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create head publisher: %w", err)
+	}
+
 	var cancel context.CancelFunc
 	t := cfg.topic
-	if t == nil {
+	if t == nil && !cfg.noPubsub {
 		var ctx context.Context
 		ctx, cancel = context.WithCancel(context.Background())
-		t, err = gpubsub.MakePubsub(ctx, host, topic)
+		t, err = gpubsub.MakePubsub(ctx, host, topic, append(cfg.pubsubOptions, gpubsub.Validator(NewValidator(nil)))...)
 		if err != nil {
 			cancel()
 			return nil, err
@@ -119,7 +203,6 @@ func NewPublisherFromExisting(dtManager dt.Manager, host host.Host, topic string
 		}
 		return nil, fmt.Errorf("cannot configure datatransfer: %w", err)
 	}
-	headPublisher := head.NewPublisher()
 	startHeadPublisher(host, topic, headPublisher)
 
 	p := &publisher{
@@ -127,7 +210,11 @@ func NewPublisherFromExisting(dtManager dt.Manager, host host.Host, topic string
 		headPublisher: headPublisher,
 		host:          host,
 		topic:         t,
+		topicName:     topic,
+		signAnnounces: cfg.signAnnounces,
+		announcePeers: addAnnouncePeers(host, cfg.announcePeers),
 	}
+	p.announceCtx, p.cancelAnnounce = context.WithCancel(context.Background())
 
 	if len(cfg.extraData) != 0 {
 		p.extraData = cfg.extraData
@@ -158,16 +245,59 @@ func (p *publisher) UpdateRootWithAddrs(ctx context.Context, c cid.Cid, addrs []
 		ExtraData: p.extraData,
 	}
 	msg.SetAddrs(addrs)
+	if p.signAnnounces {
+		if err = p.signMessage(&msg); err != nil {
+			return fmt.Errorf("cannot sign announce message: %w", err)
+		}
+	}
 	buf := bytes.NewBuffer(nil)
 	if err := msg.MarshalCBOR(buf); err != nil {
 		return err
 	}
-	return p.topic.Publish(ctx, buf.Bytes())
+
+	p.streamAnnounce(buf.Bytes())
+	if p.topic != nil {
+		return p.topic.Publish(ctx, buf.Bytes())
+	}
+	return nil
+}
+
+// streamAnnounce sends the encoded announce message to each of the announce
+// peers in the background, so that updating the root is not delayed by
+// subscribers that are slow or unreachable. Failures are logged.
+func (p *publisher) streamAnnounce(data []byte) {
+	for _, peerID := range p.announcePeers {
+		go func(peerID peer.ID) {
+			err := announce.Send(p.announceCtx, p.host, p.topicName, peerID, data)
+			if err != nil {
+				log.Errorw("Failed to send announce", "err", err, "peer", peerID)
+			}
+		}(peerID)
+	}
+}
+
+// signMessage gives the message the next sequence number and the current time,
+// and signs it.
+func (p *publisher) signMessage(msg *Message) error {
+	now := time.Now()
+	p.seqMutex.Lock()
+	seq := uint64(now.UnixNano())
+	if seq <= p.lastSeq {
+		seq = p.lastSeq + 1
+	}
+	p.lastSeq = seq
+	p.seqMutex.Unlock()
+
+	msg.Seq = seq
+	msg.Timestamp = now.UnixNano()
+	return msg.Sign(p.host.Peerstore().PrivKey(p.host.ID()))
 }
 
 func (p *publisher) Close() error {
 	var errs error
 	p.closeOnce.Do(func() {
+		p.cancelAnnounce()
+
 		err := p.headPublisher.Close()
 		if err != nil {
 			errs = multierror.Append(errs, err)
@@ -180,13 +310,15 @@ func (p *publisher) Close() error {
 			}
 		}
 
-		t := time.AfterFunc(shutdownTime, p.cancelPubSub)
-		if err = p.topic.Close(); err != nil {
-			log.Errorw("Failed to close pubsub topic", "err", err)
-			errs = multierror.Append(errs, err)
+		if p.topic != nil {
+			t := time.AfterFunc(shutdownTime, p.cancelPubSub)
+			if err = p.topic.Close(); err != nil {
+				log.Errorw("Failed to close pubsub topic", "err", err)
+				errs = multierror.Append(errs, err)
+			}
+			t.Stop()
 		}
 
-		t.Stop()
 		if p.cancelPubSub != nil {
 			p.cancelPubSub()
 		}
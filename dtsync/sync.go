@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	dt "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-legs/internal/syncopt"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-graphsync"
@@ -42,11 +44,16 @@ type Sync struct {
 
 	rateLimiters map[peer.ID]*rate.Limiter
 	rateMutex    sync.Mutex
+
+	rateLimitWaitHook func(peer.ID, cid.Cid, time.Duration)
 }
 
 // NewSyncWithDT creates a new Sync with a datatransfer.Manager provided by the
 // caller.
-func NewSyncWithDT(host host.Host, dtManager dt.Manager, gs graphsync.GraphExchange, ls *ipld.LinkSystem, blockHook func(peer.ID, cid.Cid)) (*Sync, error) {
+func NewSyncWithDT(host host.Host, dtManager dt.Manager, gs graphsync.GraphExchange, ls *ipld.LinkSystem, blockHook func(peer.ID, cid.Cid), options ...SyncOption) (*Sync, error) {
+	var cfg syncopt.Config
+	cfg.Apply(options)
+
 	err := registerVoucher(dtManager, &Voucher{}, nil)
 	if err != nil {
 		return nil, err
@@ -57,18 +64,21 @@ func NewSyncWithDT(host host.Host, dtManager dt.Manager, gs graphsync.GraphExcha
 		dtManager:    dtManager,
 		ls:           ls,
 		rateLimiters: map[peer.ID]*rate.Limiter{},
-	}
 
-	if blockHook != nil {
-		s.unregHook = gs.RegisterIncomingBlockHook(s.addRateLimiting(addIncomingBlockHook(nil, blockHook), s.getRateLimiter, gs))
+		rateLimitWaitHook: cfg.RateLimitWaitHook,
 	}
 
+	s.registerBlockHooks(gs, blockHook, cfg.BlockSizeHook)
+
 	s.unsubEvents = dtManager.SubscribeToEvents(s.onEvent)
 	return s, nil
 }
 
 // NewSync creates a new Sync with its own datatransfer.Manager.
-func NewSync(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, blockHook func(peer.ID, cid.Cid)) (*Sync, error) {
+func NewSync(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, blockHook func(peer.ID, cid.Cid), options ...SyncOption) (*Sync, error) {
+	var cfg syncopt.Config
+	cfg.Apply(options)
+
 	dtManager, gs, dtClose, err := makeDataTransfer(host, ds, lsys, nil)
 	if err != nil {
 		return nil, err
@@ -80,12 +90,12 @@ func NewSync(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, blockH
 		ls:           &lsys,
 		dtClose:      dtClose,
 		rateLimiters: make(map[peer.ID]*rate.Limiter),
-	}
 
-	if blockHook != nil {
-		s.unregHook = gs.RegisterIncomingBlockHook(s.addRateLimiting(addIncomingBlockHook(nil, blockHook), s.getRateLimiter, gs))
+		rateLimitWaitHook: cfg.RateLimitWaitHook,
 	}
 
+	s.registerBlockHooks(gs, blockHook, cfg.BlockSizeHook)
+
 	s.unsubEvents = dtManager.SubscribeToEvents(s.onEvent)
 	return s, nil
 }
@@ -131,6 +141,33 @@ func (s *Sync) addRateLimiting(bFn graphsync.OnIncomingBlockHook, rateLimiter fu
 	}
 }
 
+// registerBlockHooks registers the graphsync incoming block hook that applies
+// rate limiting and calls the given hooks, if any hook is given.
+func (s *Sync) registerBlockHooks(gs graphsync.GraphExchange, blockHook func(peer.ID, cid.Cid), blockSizeHook func(peer.ID, cid.Cid, uint64)) {
+	if blockHook == nil && blockSizeHook == nil {
+		return
+	}
+	var bFn graphsync.OnIncomingBlockHook
+	if blockSizeHook != nil {
+		bFn = addBlockSizeHook(nil, blockSizeHook)
+	}
+	if blockHook != nil {
+		bFn = addIncomingBlockHook(bFn, blockHook)
+	}
+	s.unregHook = gs.RegisterIncomingBlockHook(s.addRateLimiting(bFn, s.getRateLimiter, gs))
+}
+
+func addBlockSizeHook(bFn graphsync.OnIncomingBlockHook, blockSizeHook func(peer.ID, cid.Cid, uint64)) graphsync.OnIncomingBlockHook {
+	return func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+		if size := blockData.BlockSizeOnWire(); size != 0 {
+			blockSizeHook(p, blockData.Link().(cidlink.Link).Cid, size)
+		}
+		if bFn != nil {
+			bFn(p, responseData, blockData, hookActions)
+		}
+	}
+}
+
 func addIncomingBlockHook(bFn graphsync.OnIncomingBlockHook, blockHook func(peer.ID, cid.Cid)) graphsync.OnIncomingBlockHook {
 	return func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
 		blockHook(p, blockData.Link().(cidlink.Link).Cid)
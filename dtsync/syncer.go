@@ -6,6 +6,7 @@ import (
 	"io"
 	"time"
 
+	"github.com/filecoin-project/go-legs/internal/syncopt"
 	"github.com/filecoin-project/go-legs/p2p/protocol/head"
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
@@ -32,6 +33,12 @@ func (s *Syncer) GetHead(ctx context.Context) (cid.Cid, error) {
 	return head.QueryRootCid(ctx, s.sync.host, s.topicName, s.peerID)
 }
 
+// GetHeadHistory gets the publisher's signed history of heads, from oldest to
+// latest. The publisher must be configured with the HeadHistory option.
+func (s *Syncer) GetHeadHistory(ctx context.Context) ([]head.HeadRecord, error) {
+	return head.QueryHistory(ctx, s.sync.host, s.topicName, s.peerID)
+}
+
 // Sync opens a datatransfer data channel and uses the selector to pull data
 // from the provider.
 func (s *Syncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error {
@@ -76,13 +83,11 @@ func (s *Syncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error
 			// a relatively heavy operation (essentially restarting the sync).
 			// Note, cannot use s.rateLimiter.WaitN here because that waits,
 			// but also consumes n tokens.
-			waitMsec := 1000.0 * float64(s.rateLimiter.Burst()) / float64(s.rateLimiter.Limit())
-			var waitTime time.Duration
-			waitTime = time.Duration(waitMsec) * time.Millisecond
-			if waitTime == 0 {
-				waitTime = time.Duration(1000*waitMsec) * time.Microsecond
-			}
+			waitTime := syncopt.RefillWait(s.rateLimiter)
 			log.Infow("Hit rate limit. Waiting and will retry later", "cid", nextCid, "source_peer", s.peerID, "delay", waitTime.String())
+			if s.sync.rateLimitWaitHook != nil {
+				s.sync.rateLimitWaitHook(s.peerID, err.stoppedAtCid, waitTime)
+			}
 			select {
 			case <-time.After(waitTime):
 			case <-ctx.Done():
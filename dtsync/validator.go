@@ -0,0 +1,76 @@
+package dtsync
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+const (
+	// MaxMessageSize is the largest encoded announce message that is accepted
+	// from pubsub.
+	MaxMessageSize = 64 << 10
+	// MaxExtraDataSize is the largest extra data that an announce message may
+	// contain.
+	MaxExtraDataSize = 4 << 10
+)
+
+// NewValidator creates a pubsub validator for the announce topic. A message is
+// rejected, so that it is not forwarded and its sender's peer score is
+// penalized, if it is too large, cannot be decoded, or has an invalid
+// signature. A message is ignored, and not forwarded, if allowPeer returns
+// false for the publisher. A nil allowPeer allows all publishers.
+//
+// The publisher is the message's OrigPeer if the message was re-published,
+// and otherwise the pubsub peer that sent it. A message that was not
+// re-published is rejected if it has no source, as when pubsub messages are
+// not signed. See gpubsub.SignaturePolicy.
+func NewValidator(allowPeer func(peer.ID) bool) pubsub.ValidatorEx {
+	return func(ctx context.Context, from peer.ID, psMsg *pubsub.Message) pubsub.ValidationResult {
+		if len(psMsg.Data) > MaxMessageSize {
+			log.Infow("Rejected announce message that is too large", "size", len(psMsg.Data), "from", from)
+			return pubsub.ValidationReject
+		}
+		var msg Message
+		if err := msg.UnmarshalCBOR(bytes.NewReader(psMsg.Data)); err != nil {
+			log.Infow("Rejected announce message with invalid encoding", "err", err, "from", from)
+			return pubsub.ValidationReject
+		}
+		if len(msg.ExtraData) > MaxExtraDataSize {
+			log.Infow("Rejected announce message with extra data that is too large", "size", len(msg.ExtraData), "from", from)
+			return pubsub.ValidationReject
+		}
+		if _, err := msg.GetAddrs(); err != nil {
+			log.Infow("Rejected announce message with invalid addresses", "err", err, "from", from)
+			return pubsub.ValidationReject
+		}
+
+		publisher := psMsg.GetFrom()
+		if msg.OrigPeer != "" {
+			var err error
+			publisher, err = peer.Decode(msg.OrigPeer)
+			if err != nil {
+				log.Infow("Rejected announce message with invalid original peer", "err", err, "from", from)
+				return pubsub.ValidationReject
+			}
+		} else if publisher == "" {
+			log.Infow("Rejected announce message with no source", "from", from)
+			return pubsub.ValidationReject
+		}
+
+		if msg.Seq != 0 || len(msg.Signature) != 0 {
+			signer, err := msg.VerifySignature()
+			if err != nil || signer != publisher {
+				log.Infow("Rejected announce message with invalid signature", "err", err, "publisher", publisher, "from", from)
+				return pubsub.ValidationReject
+			}
+		}
+
+		if allowPeer != nil && !allowPeer(publisher) {
+			return pubsub.ValidationIgnore
+		}
+		return pubsub.ValidationAccept
+	}
+}
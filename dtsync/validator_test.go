@@ -0,0 +1,113 @@
+package dtsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/filecoin-project/go-legs/test"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pubsubpb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidator(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pubID, err := peer.IDFromPublicKey(pubKey)
+	require.NoError(t, err)
+	_, otherPubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	otherID, err := peer.IDFromPublicKey(otherPubKey)
+	require.NoError(t, err)
+
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	addr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9999")
+	require.NoError(t, err)
+
+	newMsg := func() Message {
+		msg := Message{
+			Cid:       cids[0],
+			ExtraData: []byte("t01000"),
+		}
+		msg.SetAddrs([]multiaddr.Multiaddr{addr})
+		return msg
+	}
+	psMsg := func(from peer.ID, msg Message) *pubsub.Message {
+		buf := bytes.NewBuffer(nil)
+		require.NoError(t, msg.MarshalCBOR(buf))
+		return psData(from, buf.Bytes())
+	}
+
+	validate := NewValidator(func(peerID peer.ID) bool {
+		return peerID == pubID
+	})
+	ctx := context.Background()
+
+	// Unsigned message from allowed publisher.
+	require.Equal(t, pubsub.ValidationAccept, validate(ctx, pubID, psMsg(pubID, newMsg())))
+
+	// Message from publisher that is not allowed.
+	require.Equal(t, pubsub.ValidationIgnore, validate(ctx, otherID, psMsg(otherID, newMsg())))
+
+	// Re-published message is checked against the original publisher.
+	msg := newMsg()
+	msg.OrigPeer = pubID.String()
+	require.Equal(t, pubsub.ValidationAccept, validate(ctx, otherID, psMsg(otherID, msg)))
+	msg.OrigPeer = "not-a-peer"
+	require.Equal(t, pubsub.ValidationReject, validate(ctx, otherID, psMsg(otherID, msg)))
+
+	// Message without a source, as sent with a pubsub signature policy that
+	// does not sign messages, is only accepted if re-published.
+	require.Equal(t, pubsub.ValidationReject, validate(ctx, otherID, psMsg("", newMsg())))
+	msg.OrigPeer = pubID.String()
+	require.Equal(t, pubsub.ValidationAccept, validate(ctx, otherID, psMsg("", msg)))
+
+	// Signed message.
+	msg = newMsg()
+	msg.Seq = 1
+	require.NoError(t, msg.Sign(privKey))
+	require.Equal(t, pubsub.ValidationAccept, validate(ctx, pubID, psMsg(pubID, msg)))
+
+	// Signed message re-published with a different original publisher.
+	msg.OrigPeer = otherID.String()
+	require.Equal(t, pubsub.ValidationReject, validate(ctx, pubID, psMsg(pubID, msg)))
+
+	// Message modified after signing.
+	msg.OrigPeer = ""
+	msg.Seq = 2
+	require.Equal(t, pubsub.ValidationReject, validate(ctx, pubID, psMsg(pubID, msg)))
+
+	// Malformed and oversized messages.
+	require.Equal(t, pubsub.ValidationReject, validate(ctx, pubID, psData(pubID, []byte("not cbor"))))
+	require.Equal(t, pubsub.ValidationReject, validate(ctx, pubID, psData(pubID, make([]byte, MaxMessageSize+1))))
+	msg = newMsg()
+	msg.ExtraData = make([]byte, MaxExtraDataSize+1)
+	require.Equal(t, pubsub.ValidationReject, validate(ctx, pubID, psMsg(pubID, msg)))
+	msg = newMsg()
+	msg.Addrs = [][]byte{[]byte("bad addr")}
+	require.Equal(t, pubsub.ValidationReject, validate(ctx, pubID, psMsg(pubID, msg)))
+
+	// Nil allowPeer allows all publishers.
+	require.Equal(t, pubsub.ValidationAccept, NewValidator(nil)(ctx, otherID, psMsg(otherID, newMsg())))
+}
+
+func psData(from peer.ID, data []byte) *pubsub.Message {
+	return &pubsub.Message{
+		Message: &pubsubpb.Message{
+			From: []byte(from),
+			Data: data,
+		},
+	}
+}
+
+func TestExtraDataLimit(t *testing.T) {
+	var cfg config
+	require.Error(t, cfg.apply([]Option{WithExtraData(make([]byte, MaxExtraDataSize+1))}))
+	require.NoError(t, cfg.apply([]Option{WithExtraData(make([]byte, MaxExtraDataSize))}))
+}
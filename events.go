@@ -0,0 +1,315 @@
+package legs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// syncEventBufferSize is the capacity of each OnSyncEvent channel. Events are
+// dropped for a reader whose channel is full.
+const syncEventBufferSize = 64
+
+// Transport names the transport that a sync uses.
+type Transport string
+
+const (
+	// TransportDataTransfer is used by syncs over graphsync datatransfer.
+	TransportDataTransfer Transport = "dtsync"
+	// TransportHTTP is used by syncs over HTTP.
+	TransportHTTP Transport = "httpsync"
+)
+
+// SyncEventType identifies the kind of a SyncEvent.
+type SyncEventType int
+
+const (
+	// SyncEventStarted is sent when a sync with a publisher starts.
+	SyncEventStarted SyncEventType = iota
+	// SyncEventSegmentStarted is sent when a segment of a segmented sync
+	// starts. The Link field is the CID the segment starts at.
+	SyncEventSegmentStarted
+	// SyncEventSegmentFinished is sent when a segment of a segmented sync
+	// finishes. The Link field is the CID the segment started at.
+	SyncEventSegmentFinished
+	// SyncEventBlockReceived is sent when a block is received from the
+	// publisher. The Link field is the CID of the block and Bytes is its
+	// size.
+	SyncEventBlockReceived
+	// SyncEventRateLimitWait is sent when a sync waits because its rate limit
+	// is reached. The Wait field is the time the sync waits.
+	SyncEventRateLimitWait
+	// SyncEventFinished is sent when a sync completes successfully.
+	SyncEventFinished
+	// SyncEventFailed is sent when a sync fails. The Err field holds the
+	// error.
+	SyncEventFailed
+	// SyncEventChainFork is sent when a synced head does not lead to the
+	// latest synced CID, because the publisher rewound or forked its chain.
+	// The Link field is the latest synced CID. See OnChainFork.
+	SyncEventChainFork
+	// SyncEventPubsubLost is sent when the pubsub subscription fails, and the
+	// Subscriber stops receiving announces over pubsub until it resubscribes.
+	// The Err field holds the error. This event is not specific to a sync or
+	// publisher.
+	SyncEventPubsubLost
+	// SyncEventPubsubRestored is sent when the Subscriber resubscribes to the
+	// pubsub topic after the subscription failed. The Wait field is the time
+	// that the subscription was lost for. This event is not specific to a
+	// sync or publisher.
+	SyncEventPubsubRestored
+)
+
+// String returns the name of the event type.
+func (t SyncEventType) String() string {
+	switch t {
+	case SyncEventStarted:
+		return "started"
+	case SyncEventSegmentStarted:
+		return "segment-started"
+	case SyncEventSegmentFinished:
+		return "segment-finished"
+	case SyncEventBlockReceived:
+		return "block-received"
+	case SyncEventRateLimitWait:
+		return "rate-limit-wait"
+	case SyncEventFinished:
+		return "finished"
+	case SyncEventFailed:
+		return "failed"
+	case SyncEventChainFork:
+		return "chain-fork"
+	case SyncEventPubsubLost:
+		return "pubsub-lost"
+	case SyncEventPubsubRestored:
+		return "pubsub-restored"
+	}
+	return "unknown"
+}
+
+// SyncEvent notifies an OnSyncEvent reader of the progress of a sync.
+type SyncEvent struct {
+	// Type is the kind of event.
+	Type SyncEventType
+	// PeerID identifies the publisher being synced with.
+	PeerID peer.ID
+	// Cid is the CID that the sync is syncing to.
+	Cid cid.Cid
+	// Transport is the transport used by the sync.
+	Transport Transport
+	// Link is the CID of a received block, the start of a segment, or the
+	// latest synced CID, depending on the event type.
+	Link cid.Cid
+	// Bytes is the size of a received block.
+	Bytes uint64
+	// Wait is the time the sync waits due to rate limiting, or the time that
+	// the pubsub subscription was lost for.
+	Wait time.Duration
+	// Err is the error that caused a sync or the pubsub subscription to fail.
+	Err error
+}
+
+// activeSync describes a sync that is in progress with a publisher.
+type activeSync struct {
+	target    cid.Cid
+	transport Transport
+}
+
+// syncEvents tracks syncs in progress and delivers SyncEvents to the
+// OnSyncEvent readers.
+type syncEvents struct {
+	// active maps a publisher to the sync in progress with it. Syncs with
+	// the same publisher are serialized, so there is at most one.
+	active      map[peer.ID]activeSync
+	activeMutex sync.Mutex
+
+	outChans []chan SyncEvent
+	outMutex sync.Mutex
+}
+
+func newSyncEvents() *syncEvents {
+	return &syncEvents{
+		active: make(map[peer.ID]activeSync),
+	}
+}
+
+// OnSyncEvent creates a channel that receives events about the progress of
+// syncs, and adds that channel to the list of event channels.
+//
+// Events are sent without waiting for a reader, so events are dropped if the
+// reader does not keep up with them.
+//
+// Calling the returned cancel function removes the channel from the list of
+// event channels, and it closes the channel to allow any reading goroutines
+// to stop waiting on the channel.
+func (s *Subscriber) OnSyncEvent() (<-chan SyncEvent, context.CancelFunc) {
+	return s.syncEvents.subscribe()
+}
+
+func (se *syncEvents) subscribe() (<-chan SyncEvent, context.CancelFunc) {
+	ch := make(chan SyncEvent, syncEventBufferSize)
+	se.outMutex.Lock()
+	defer se.outMutex.Unlock()
+
+	se.outChans = append(se.outChans, ch)
+	cncl := func() {
+		se.outMutex.Lock()
+		defer se.outMutex.Unlock()
+		for i, ca := range se.outChans {
+			if ca == ch {
+				se.outChans[i] = se.outChans[len(se.outChans)-1]
+				se.outChans[len(se.outChans)-1] = nil
+				se.outChans = se.outChans[:len(se.outChans)-1]
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cncl
+}
+
+// close closes all event channels.
+func (se *syncEvents) close() {
+	se.outMutex.Lock()
+	for _, ch := range se.outChans {
+		close(ch)
+	}
+	se.outChans = nil
+	se.outMutex.Unlock()
+}
+
+func (se *syncEvents) send(event SyncEvent) {
+	se.outMutex.Lock()
+	defer se.outMutex.Unlock()
+	for _, ch := range se.outChans {
+		select {
+		case ch <- event:
+		default:
+			log.Debugw("Dropped sync event for slow reader", "type", event.Type, "peer", event.PeerID)
+		}
+	}
+}
+
+// start records the start of a sync with a publisher and sends a
+// SyncEventStarted.
+func (se *syncEvents) start(peerID peer.ID, target cid.Cid, transport Transport) {
+	se.activeMutex.Lock()
+	se.active[peerID] = activeSync{
+		target:    target,
+		transport: transport,
+	}
+	se.activeMutex.Unlock()
+
+	se.send(SyncEvent{
+		Type:      SyncEventStarted,
+		PeerID:    peerID,
+		Cid:       target,
+		Transport: transport,
+	})
+}
+
+// end records the end of a sync with a publisher and sends a
+// SyncEventFinished, or a SyncEventFailed if err is not nil.
+func (se *syncEvents) end(peerID peer.ID, err error) {
+	se.activeMutex.Lock()
+	as, ok := se.active[peerID]
+	delete(se.active, peerID)
+	se.activeMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	event := SyncEvent{
+		Type:      SyncEventFinished,
+		PeerID:    peerID,
+		Cid:       as.target,
+		Transport: as.transport,
+	}
+	if err != nil {
+		event.Type = SyncEventFailed
+		event.Err = err
+	}
+	se.send(event)
+}
+
+// sendActive sends an event about the sync in progress with the event's
+// peer. The event is not sent if there is no sync in progress.
+func (se *syncEvents) sendActive(event SyncEvent) {
+	se.activeMutex.Lock()
+	as, ok := se.active[event.PeerID]
+	se.activeMutex.Unlock()
+	if !ok {
+		return
+	}
+	event.Cid = as.target
+	event.Transport = as.transport
+	se.send(event)
+}
+
+func (se *syncEvents) segment(peerID peer.ID, start cid.Cid, finished bool) {
+	event := SyncEvent{
+		Type:   SyncEventSegmentStarted,
+		PeerID: peerID,
+		Link:   start,
+	}
+	if finished {
+		event.Type = SyncEventSegmentFinished
+	}
+	se.sendActive(event)
+}
+
+func (se *syncEvents) blockReceived(peerID peer.ID, c cid.Cid, size uint64) {
+	se.sendActive(SyncEvent{
+		Type:   SyncEventBlockReceived,
+		PeerID: peerID,
+		Link:   c,
+		Bytes:  size,
+	})
+}
+
+func (se *syncEvents) rateLimitWait(peerID peer.ID, c cid.Cid, wait time.Duration) {
+	se.sendActive(SyncEvent{
+		Type:   SyncEventRateLimitWait,
+		PeerID: peerID,
+		Link:   c,
+		Wait:   wait,
+	})
+}
+
+func (se *syncEvents) chainFork(fork ChainFork) {
+	se.sendActive(SyncEvent{
+		Type:   SyncEventChainFork,
+		PeerID: fork.PeerID,
+		Link:   fork.LatestSync,
+	})
+}
+
+// syncerTransport returns the transport used by the syncer.
+func syncerTransport(syncer Syncer) Transport {
+	switch syncer.(type) {
+	case *httpsync.Syncer:
+		return TransportHTTP
+	case *dtsync.Syncer:
+		return TransportDataTransfer
+	}
+	return ""
+}
+
+func (se *syncEvents) pubsubLost(err error) {
+	se.send(SyncEvent{
+		Type: SyncEventPubsubLost,
+		Err:  err,
+	})
+}
+
+func (se *syncEvents) pubsubRestored(outage time.Duration) {
+	se.send(SyncEvent{
+		Type: SyncEventPubsubRestored,
+		Wait: outage,
+	})
+}
@@ -0,0 +1,108 @@
+package legs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestSyncEvents(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Every(10*time.Millisecond), 1)
+	te := setupPublisherSubscriber(t, []legs.Option{
+		legs.RateLimiter(func(peer.ID) *rate.Limiter { return limiter }),
+	})
+
+	chainLnks := test.MkChain(te.srcLinkSys, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	require.NoError(t, te.pub.UpdateRoot(context.Background(), headCid))
+
+	events, cancel := te.sub.OnSyncEvent()
+	defer cancel()
+
+	ctx, syncCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer syncCancel()
+	_, err := te.sub.Sync(ctx, te.srcHost.ID(), cid.Undef, nil, te.pubAddr)
+	require.NoError(t, err)
+
+	got := readSyncEvents(t, events)
+	require.Equal(t, legs.SyncEventStarted, got[0].Type)
+	require.Equal(t, headCid, got[0].Cid)
+	require.Equal(t, legs.TransportHTTP, got[0].Transport)
+	require.Equal(t, legs.SyncEventFinished, got[len(got)-1].Type)
+
+	var blocks, waits int
+	for _, event := range got {
+		require.Equal(t, te.srcHost.ID(), event.PeerID)
+		switch event.Type {
+		case legs.SyncEventBlockReceived:
+			require.NotZero(t, event.Bytes)
+			blocks++
+		case legs.SyncEventRateLimitWait:
+			require.NotZero(t, event.Wait)
+			waits++
+		}
+	}
+	// The chain has 8 distinct blocks.
+	require.Equal(t, 8, blocks)
+	require.NotZero(t, waits)
+
+	// Check that a failed sync is reported.
+	cids, _ := test.RandomCids(1)
+	_, err = te.sub.Sync(ctx, te.srcHost.ID(), cids[0], nil, te.pubAddr)
+	require.Error(t, err)
+	got = readSyncEvents(t, events)
+	require.Equal(t, legs.SyncEventStarted, got[0].Type)
+	require.Equal(t, cids[0], got[0].Cid)
+	require.Equal(t, legs.SyncEventFailed, got[len(got)-1].Type)
+	require.Error(t, got[len(got)-1].Err)
+}
+
+// readSyncEvents reads events until a sync finishes or fails.
+func readSyncEvents(t *testing.T, events <-chan legs.SyncEvent) []legs.SyncEvent {
+	var got []legs.SyncEvent
+	timeout := time.After(updateTimeout)
+	for {
+		select {
+		case event := <-events:
+			got = append(got, event)
+			if event.Type == legs.SyncEventFinished || event.Type == legs.SyncEventFailed {
+				return got
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for sync events")
+		}
+	}
+}
+
+func TestSyncFailedOnAnnounce(t *testing.T) {
+	te := setupPublisherSubscriber(t, nil)
+
+	failed, cancel := te.sub.OnSyncFailed()
+	defer cancel()
+
+	// Announce a CID that the publisher does not have.
+	cids, _ := test.RandomCids(1)
+	addrs := []multiaddr.Multiaddr{te.pubAddr}
+	require.NoError(t, te.sub.Announce(context.Background(), cids[0], te.srcHost.ID(), addrs))
+
+	select {
+	case event := <-failed:
+		require.Equal(t, cids[0], event.Cid)
+		require.Equal(t, te.srcHost.ID(), event.PeerID)
+		require.Equal(t, addrs, event.Addrs)
+		require.Equal(t, legs.TransportHTTP, event.Transport)
+		require.Error(t, event.Err)
+		require.Equal(t, 1, event.Attempts)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sync failed event")
+	}
+}
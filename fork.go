@@ -0,0 +1,188 @@
+package legs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ErrChainFork is returned by a sync that was rejected because the publisher's
+// head no longer leads to the latest synced CID. See OnChainFork.
+var ErrChainFork = errors.New("chain does not lead to latest sync")
+
+// ChainForkPolicy determines what is done when a synced head does not lead to
+// the latest synced CID, meaning that the publisher has rewound or forked its
+// chain.
+type ChainForkPolicy int
+
+const (
+	// ForkAccept accepts any new head without checking whether it leads to
+	// the latest synced CID, and updates the latest sync to the new head.
+	// Since the check is not done, chain forks are not reported. This is the
+	// default.
+	ForkAccept ChainForkPolicy = iota
+	// ForkReject fails the sync with ErrChainFork, and keeps the latest sync
+	// unchanged.
+	ForkReject
+	// ForkDecide calls a function, given to OnChainFork, to decide whether to
+	// accept or reject the new chain.
+	ForkDecide
+	// ForkResync accepts the new chain, and syncs it again from the new head
+	// without stopping at the latest synced CID, as in a first sync with the
+	// publisher. This makes sure that every block of the new chain that the
+	// selector visits is synced and seen by the block hooks.
+	ForkResync
+)
+
+// maxForkCheckLinks is the most links that the check for a chain fork loads.
+// If there are more, then whether the chain forked is not known.
+const maxForkCheckLinks = 1 << 16
+
+// ChainFork describes a synced head that does not lead to the latest synced
+// CID.
+type ChainFork struct {
+	// PeerID identifies the publisher whose chain forked.
+	PeerID peer.ID
+	// LatestSync is the latest synced CID, that the new chain does not lead
+	// to.
+	LatestSync cid.Cid
+	// Head is the head of the new chain.
+	Head cid.Cid
+}
+
+// checkChainFork checks whether the new head leads to the stop CID, and
+// applies the chain fork policy if not. An error is returned if the new chain
+// is rejected. Returns true if the new chain must be synced again from the
+// head.
+func (h *handler) checkChainFork(ctx context.Context, head, stop cid.Cid, seq ipld.Node) (bool, error) {
+	if h.subscriber.forkPolicy == ForkAccept || stop == cid.Undef || head == stop {
+		return false, nil
+	}
+	leads, err := leadsTo(ctx, h.subscriber.lsys, head, stop, seq)
+	if err != nil {
+		log.Errorw("Cannot check for chain fork", "err", err, "peer", h.peerID, "head", head)
+		return false, nil
+	}
+	switch leads {
+	case leadsYes:
+		return false, nil
+	case leadsUnknown:
+		log.Warnw("Cannot tell if new head leads to latest sync; not treated as chain fork", "peer", h.peerID, "latestSync", stop, "head", head)
+		return false, nil
+	}
+
+	fork := ChainFork{
+		PeerID:     h.peerID,
+		LatestSync: stop,
+		Head:       head,
+	}
+	log.Warnw("New head does not lead to latest sync; publisher chain was rewound or forked", "peer", h.peerID, "latestSync", stop, "head", head)
+	h.subscriber.syncEvents.chainFork(fork)
+
+	switch h.subscriber.forkPolicy {
+	case ForkResync:
+		return true, nil
+	case ForkDecide:
+		if h.subscriber.forkDecide(fork) {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("%w: %s does not lead to %s", ErrChainFork, head, stop)
+}
+
+// leadsResult is whether a DAG leads to a target CID.
+type leadsResult int
+
+const (
+	leadsYes leadsResult = iota
+	leadsNo
+	// leadsUnknown means the target was not found, but the DAG could not be
+	// walked completely.
+	leadsUnknown
+)
+
+// errReachedTarget stops the walk done by leadsTo when the target is found.
+var errReachedTarget = errors.New("reached target")
+
+// leadsTo returns whether the DAG rooted at head leads to the target CID. The
+// DAG is walked with the selector seq, without a recursion limit, through the
+// blocks that are in the link system. This finds the target even if the sync
+// that reached head stopped short of it, such as because of a recursion limit,
+// as long as the blocks between them were synced previously.
+//
+// If the target is not found, but a block on the way cannot be loaded, such as
+// one that was never synced or that was removed by a block hook, or the walk
+// loads more than maxForkCheckLinks links, then leadsUnknown is returned.
+func leadsTo(ctx context.Context, lsys ipld.LinkSystem, head, target cid.Cid, seq ipld.Node) (leadsResult, error) {
+	compiled, err := selector.CompileSelector(ExploreRecursiveWithStopNode(selector.RecursionLimitNone(), seq, nil))
+	if err != nil {
+		return leadsUnknown, err
+	}
+
+	var missing bool
+	seen := make(map[cid.Cid]struct{})
+	readOpener := lsys.StorageReadOpener
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		c := lnk.(cidlink.Link).Cid
+		if c == target {
+			return nil, errReachedTarget
+		}
+		if _, ok := seen[c]; ok {
+			return nil, traversal.SkipMe{}
+		}
+		seen[c] = struct{}{}
+		r, err := readOpener(lctx, lnk)
+		if err != nil {
+			log.Debugw("Cannot load block to check for chain fork", "err", err, "cid", c)
+			missing = true
+			return nil, traversal.SkipMe{}
+		}
+		return r, nil
+	}
+
+	root, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: head}, basicnode.Prototype.Any)
+	if err != nil {
+		if errors.As(err, &traversal.SkipMe{}) {
+			return leadsUnknown, nil
+		}
+		return leadsUnknown, err
+	}
+	prog := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: basicnode.Chooser,
+		},
+		Budget: &traversal.Budget{
+			NodeBudget: math.MaxInt64,
+			LinkBudget: maxForkCheckLinks,
+		},
+	}
+	err = prog.WalkAdv(root, compiled, func(traversal.Progress, ipld.Node, traversal.VisitReason) error {
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, errReachedTarget) {
+			return leadsYes, nil
+		}
+		var budgetErr *traversal.ErrBudgetExceeded
+		if errors.As(err, &budgetErr) {
+			return leadsUnknown, nil
+		}
+		return leadsUnknown, err
+	}
+	if missing {
+		return leadsUnknown, nil
+	}
+	return leadsNo, nil
+}
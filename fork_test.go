@@ -0,0 +1,196 @@
+package legs_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainRewind(t *testing.T) {
+	for _, policy := range []legs.ChainForkPolicy{legs.ForkAccept, legs.ForkReject, legs.ForkResync} {
+		te := setupPublisherSubscriber(t, []legs.Option{legs.OnChainFork(policy, nil)})
+
+		chainLnks := test.MkChain(te.srcLinkSys, true)
+		headCid := chainLnks[0].(cidlink.Link).Cid
+		// ch2 is an ancestor of the head.
+		oldCid := chainLnks[2].(cidlink.Link).Cid
+		ch1Cid := chainLnks[3].(cidlink.Link).Cid
+
+		events, cancel := te.sub.OnSyncEvent()
+
+		ctx, syncCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		require.NoError(t, te.pub.UpdateRoot(ctx, headCid))
+		_, err := te.sub.Sync(ctx, te.srcHost.ID(), cid.Undef, nil, te.pubAddr)
+		require.NoError(t, err)
+		for _, event := range readSyncEvents(t, events) {
+			require.NotEqual(t, legs.SyncEventChainFork, event.Type)
+		}
+
+		// Rewind the publisher's chain.
+		hooked := make(map[cid.Cid]int)
+		hook := func(_ peer.ID, c cid.Cid, _ legs.SegmentSyncActions) {
+			hooked[c]++
+		}
+		require.NoError(t, te.pub.UpdateRoot(ctx, oldCid))
+		_, err = te.sub.Sync(ctx, te.srcHost.ID(), cid.Undef, nil, te.pubAddr, legs.ScopedBlockHook(hook))
+
+		var forked bool
+		for _, event := range readSyncEvents(t, events) {
+			if event.Type == legs.SyncEventChainFork {
+				require.Equal(t, oldCid, event.Cid)
+				require.Equal(t, headCid, event.Link)
+				forked = true
+			}
+		}
+
+		latest := te.sub.GetLatestSync(te.srcHost.ID()).(cidlink.Link).Cid
+		switch policy {
+		case legs.ForkAccept:
+			require.False(t, forked, "chain fork not checked when accepting")
+			require.NoError(t, err)
+			require.Equal(t, oldCid, latest)
+		case legs.ForkReject:
+			require.True(t, forked, "expected chain fork event")
+			require.True(t, errors.Is(err, legs.ErrChainFork))
+			require.Equal(t, headCid, latest)
+		case legs.ForkResync:
+			require.True(t, forked, "expected chain fork event")
+			require.NoError(t, err)
+			require.Equal(t, oldCid, latest)
+			// The new chain is synced again from its head.
+			require.Equal(t, 2, hooked[oldCid])
+			require.Equal(t, 2, hooked[ch1Cid])
+		}
+		syncCancel()
+		cancel()
+	}
+}
+
+func TestChainForkUnknown(t *testing.T) {
+	te := setupPublisherSubscriber(t, []legs.Option{
+		legs.OnChainFork(legs.ForkReject, nil),
+		legs.SyncRecursionLimit(selector.RecursionLimitDepth(1)),
+	})
+
+	chainLnks := test.MkChain(te.srcLinkSys, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	ch1Cid := chainLnks[3].(cidlink.Link).Cid
+
+	events, cancel := te.sub.OnSyncEvent()
+	defer cancel()
+	ctx, syncCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer syncCancel()
+
+	require.NoError(t, te.pub.UpdateRoot(ctx, ch1Cid))
+	_, err := te.sub.Sync(ctx, te.srcHost.ID(), cid.Undef, nil, te.pubAddr)
+	require.NoError(t, err)
+	readSyncEvents(t, events)
+
+	// The recursion limit stops the sync of the head before it reaches the
+	// latest sync, and the blocks in between were never synced, so whether
+	// the head leads to the latest sync is not known. This is not treated as
+	// a chain fork.
+	require.NoError(t, te.pub.UpdateRoot(ctx, headCid))
+	_, err = te.sub.Sync(ctx, te.srcHost.ID(), cid.Undef, nil, te.pubAddr)
+	require.NoError(t, err)
+	for _, event := range readSyncEvents(t, events) {
+		require.NotEqual(t, legs.SyncEventChainFork, event.Type)
+	}
+	require.Equal(t, headCid, te.sub.GetLatestSync(te.srcHost.ID()).(cidlink.Link).Cid)
+}
+
+func TestChainRecursionLimitNotFork(t *testing.T) {
+	te := setupPublisherSubscriber(t, []legs.Option{
+		legs.OnChainFork(legs.ForkReject, nil),
+		legs.SyncRecursionLimit(selector.RecursionLimitDepth(1)),
+	})
+
+	chainLnks := test.MkChain(te.srcLinkSys, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	ch3Cid := chainLnks[1].(cidlink.Link).Cid
+	ch1Cid := chainLnks[3].(cidlink.Link).Cid
+
+	events, cancel := te.sub.OnSyncEvent()
+	defer cancel()
+	ctx, syncCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer syncCancel()
+
+	require.NoError(t, te.pub.UpdateRoot(ctx, ch1Cid))
+	_, err := te.sub.Sync(ctx, te.srcHost.ID(), cid.Undef, nil, te.pubAddr)
+	require.NoError(t, err)
+	readSyncEvents(t, events)
+
+	// Sync the middle of the chain without updating the latest sync.
+	_, err = te.sub.Sync(ctx, te.srcHost.ID(), ch3Cid, nil, te.pubAddr)
+	require.NoError(t, err)
+	readSyncEvents(t, events)
+
+	// The recursion limit stops the sync of the head before it reaches the
+	// latest sync, but the blocks synced previously show that the head leads
+	// to it.
+	require.NoError(t, te.pub.UpdateRoot(ctx, headCid))
+	_, err = te.sub.Sync(ctx, te.srcHost.ID(), cid.Undef, nil, te.pubAddr)
+	require.NoError(t, err)
+	for _, event := range readSyncEvents(t, events) {
+		require.NotEqual(t, legs.SyncEventChainFork, event.Type)
+	}
+	require.Equal(t, headCid, te.sub.GetLatestSync(te.srcHost.ID()).(cidlink.Link).Cid)
+}
+
+func TestChainForkDecide(t *testing.T) {
+	forks := make(chan legs.ChainFork, 1)
+	decide := func(fork legs.ChainFork) bool {
+		forks <- fork
+		return false
+	}
+	_, err := legs.NewSubscriber(test.MkTestHost(), nil, test.MkLinkSystem(nil), testTopic, nil, legs.OnChainFork(legs.ForkDecide, nil))
+	require.Error(t, err, "expected error without decide function")
+
+	te := setupPublisherSubscriber(t, []legs.Option{legs.OnChainFork(legs.ForkDecide, decide)})
+
+	chainLnks := test.MkChain(te.srcLinkSys, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, te.pub.UpdateRoot(ctx, chainLnks[1].(cidlink.Link).Cid))
+	_, err = te.sub.Sync(ctx, te.srcHost.ID(), cid.Undef, nil, te.pubAddr)
+	require.NoError(t, err)
+
+	// Moving forward along the same chain is not a fork.
+	require.NoError(t, te.pub.UpdateRoot(ctx, headCid))
+	_, err = te.sub.Sync(ctx, te.srcHost.ID(), cid.Undef, nil, te.pubAddr)
+	require.NoError(t, err)
+	require.Len(t, forks, 0)
+
+	// Publish a head that forks the chain from before the latest sync.
+	forkLnk, err := test.Store(te.srcStore, fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("fork").AssignBool(true)
+		na.AssembleEntry("ch2").AssignLink(chainLnks[2])
+	}))
+	require.NoError(t, err)
+	forkCid := forkLnk.(cidlink.Link).Cid
+	require.NoError(t, te.pub.UpdateRoot(ctx, forkCid))
+	_, err = te.sub.Sync(ctx, te.srcHost.ID(), cid.Undef, nil, te.pubAddr)
+	require.True(t, errors.Is(err, legs.ErrChainFork))
+
+	select {
+	case fork := <-forks:
+		require.Equal(t, te.srcHost.ID(), fork.PeerID)
+		require.Equal(t, headCid, fork.LatestSync)
+		require.Equal(t, forkCid, fork.Head)
+	default:
+		t.Fatal("decide function not called")
+	}
+	require.Equal(t, headCid, te.sub.GetLatestSync(te.srcHost.ID()).(cidlink.Link).Cid)
+}
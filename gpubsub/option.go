@@ -0,0 +1,140 @@
+package gpubsub
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// config contains all options for configuring pubsub.
+type config struct {
+	validator pubsub.ValidatorEx
+
+	directPeers        []peer.AddrInfo
+	directConnectTicks uint64
+
+	peerScoreParams     *pubsub.PeerScoreParams
+	peerScoreThresholds *pubsub.PeerScoreThresholds
+	topicScoreParams    *pubsub.TopicScoreParams
+
+	gossipSubParams *pubsub.GossipSubParams
+	signPolicy      *pubsub.MessageSignaturePolicy
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// apply applies the given options to this config.
+func (c *config) apply(opts []Option) error {
+	for i, opt := range opts {
+		if err := opt(c); err != nil {
+			return fmt.Errorf("option %d failed: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// Validator registers a validator for the topic, that is called for each
+// message received before it is delivered or forwarded.
+func Validator(validator pubsub.ValidatorEx) Option {
+	return func(c *config) error {
+		c.validator = validator
+		return nil
+	}
+}
+
+// DirectPeers sets peers that messages are always sent to and received from,
+// regardless of the mesh. Direct peers must be configured symmetrically, so
+// that each is a direct peer of the other.
+func DirectPeers(peers ...peer.AddrInfo) Option {
+	return func(c *config) error {
+		c.directPeers = append(c.directPeers, peers...)
+		return nil
+	}
+}
+
+// DirectConnectTicks sets the number of heartbeats between checks that the host
+// is connected to its direct peers. The default is 30.
+func DirectConnectTicks(ticks uint64) Option {
+	return func(c *config) error {
+		if ticks == 0 {
+			return errors.New("direct connect ticks must be greater than zero")
+		}
+		c.directConnectTicks = ticks
+		return nil
+	}
+}
+
+// PeerScore enables peer scoring with the given parameters and thresholds. A
+// nil value uses the corresponding default from DefaultPeerScoreParams or
+// DefaultPeerScoreThresholds.
+func PeerScore(params *pubsub.PeerScoreParams, thresholds *pubsub.PeerScoreThresholds) Option {
+	return func(c *config) error {
+		if params == nil {
+			params = DefaultPeerScoreParams()
+		}
+		if thresholds == nil {
+			thresholds = DefaultPeerScoreThresholds()
+		}
+		c.peerScoreParams = params
+		c.peerScoreThresholds = thresholds
+		return nil
+	}
+}
+
+// TopicScore sets the score parameters for the announce topic. Peer scoring is
+// enabled with default parameters if PeerScore is not also given. See
+// DefaultTopicScoreParams.
+func TopicScore(params *pubsub.TopicScoreParams) Option {
+	return func(c *config) error {
+		if params == nil {
+			return errors.New("nil topic score params")
+		}
+		c.topicScoreParams = params
+		return nil
+	}
+}
+
+// MeshDegree sets the target number of peers in the topic mesh, d, and the low
+// and high watermarks, dlo and dhi, at which peers are added to or removed from
+// the mesh.
+func MeshDegree(d, dlo, dhi int) Option {
+	return func(c *config) error {
+		if dlo < 1 || dlo > d || d > dhi {
+			return fmt.Errorf("invalid mesh degree: must have 0 < dlo <= d <= dhi")
+		}
+		params := pubsub.DefaultGossipSubParams()
+		params.D = d
+		params.Dlo = dlo
+		params.Dhi = dhi
+		// Keep the other degree parameters within the limits that the new
+		// degree places on them.
+		params.Dscore = min(params.Dscore, d)
+		params.Dout = min(params.Dout, min(dlo-1, d/2))
+		c.gossipSubParams = &params
+		return nil
+	}
+}
+
+// SignaturePolicy sets the policy for signing published messages and verifying
+// received messages. The default is pubsub.StrictSign. Subscribers identify the
+// publisher of a message by its signed source, so a policy that does not sign
+// messages is only suitable for publishers that announce to subscribers over
+// the announce stream protocol, or for announces that are re-published with
+// their original publisher. Subscribers reject other messages that have no
+// signed source.
+func SignaturePolicy(policy pubsub.MessageSignaturePolicy) Option {
+	return func(c *config) error {
+		c.signPolicy = &policy
+		return nil
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -2,7 +2,7 @@ package gpubsub
 
 import (
 	"context"
-	"errors"
+	"fmt"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p-core/host"
@@ -16,8 +16,16 @@ var log = logging.Logger("go-legs-gpubsub")
 // directConnectTicks makes pubsub check it's connected to direct peers every N seconds.
 const directConnectTicks uint64 = 30
 
-func MakePubsub(ctx context.Context, h host.Host, topic string) (*pubsub.Topic, error) {
-	p, err := pubsub.NewGossipSub(ctx, h,
+// MakePubsub creates a gossipsub router on the host, and joins the topic.
+func MakePubsub(ctx context.Context, h host.Host, topic string, options ...Option) (*pubsub.Topic, error) {
+	cfg := config{
+		directConnectTicks: directConnectTicks,
+	}
+	if err := cfg.apply(options); err != nil {
+		return nil, err
+	}
+
+	psOpts := []pubsub.Option{
 		pubsub.WithPeerExchange(true),
 		pubsub.WithMessageIdFn(func(pmsg *pubsubpb.Message) string {
 			h, _ := blake2b.New256(nil)
@@ -25,21 +33,56 @@ func MakePubsub(ctx context.Context, h host.Host, topic string) (*pubsub.Topic,
 			return string(h.Sum(nil))
 		}),
 		pubsub.WithFloodPublish(true),
-		pubsub.WithDirectConnectTicks(directConnectTicks),
+		pubsub.WithDirectConnectTicks(cfg.directConnectTicks),
 		pubsub.WithRawTracer(&loggingTracer{log}),
-	)
+	}
+	if len(cfg.directPeers) != 0 {
+		psOpts = append(psOpts, pubsub.WithDirectPeers(cfg.directPeers))
+	}
+	if cfg.gossipSubParams != nil {
+		psOpts = append(psOpts, pubsub.WithGossipSubParams(*cfg.gossipSubParams))
+	}
+	if cfg.signPolicy != nil {
+		psOpts = append(psOpts, pubsub.WithMessageSignaturePolicy(*cfg.signPolicy))
+	}
+	if cfg.peerScoreParams != nil || cfg.topicScoreParams != nil {
+		params, thresholds := cfg.peerScoreParams, cfg.peerScoreThresholds
+		if params == nil {
+			params, thresholds = DefaultPeerScoreParams(), DefaultPeerScoreThresholds()
+		}
+		if cfg.topicScoreParams != nil {
+			// Copy the params so that the caller's are not modified.
+			paramsCopy := *params
+			paramsCopy.Topics = make(map[string]*pubsub.TopicScoreParams, len(params.Topics)+1)
+			for name, topicParams := range params.Topics {
+				paramsCopy.Topics[name] = topicParams
+			}
+			paramsCopy.Topics[topic] = cfg.topicScoreParams
+			params = &paramsCopy
+		}
+		psOpts = append(psOpts, pubsub.WithPeerScore(params, thresholds))
+	}
+
+	p, err := pubsub.NewGossipSub(ctx, h, psOpts...)
 	if err != nil {
 		msg := "failed to create pubsub"
 		log.Errorw(msg, "topic", topic, "peer", h.ID(), "err", err)
-		return nil, errors.New(msg)
+		return nil, fmt.Errorf("%s: %w", msg, err)
 	}
 
 	log.Infof("Instantiated pubsub with peer ID %s", h.ID())
+	if cfg.validator != nil {
+		if err = p.RegisterTopicValidator(topic, cfg.validator); err != nil {
+			msg := "failed to register topic validator"
+			log.Errorw(msg, "topic", topic, "err", err)
+			return nil, fmt.Errorf("%s: %w", msg, err)
+		}
+	}
 	t, err := p.Join(topic)
 	if err != nil {
 		msg := "failed to join topic"
 		log.Errorw(msg, "topic", topic, "err", err)
-		return nil, errors.New(msg)
+		return nil, fmt.Errorf("%s: %w", msg, err)
 	}
 	log.Infof("Joined pubsub topic %s", topic)
 	return t, nil
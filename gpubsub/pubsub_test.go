@@ -0,0 +1,152 @@
+package gpubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/stretchr/testify/require"
+)
+
+const testTopic = "/legs/testtopic"
+
+func TestValidator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srcHost := test.MkTestHost()
+	dstHost := test.MkTestHost()
+	connect(t, srcHost, dstHost)
+
+	validated := make(chan string, 2)
+	validator := func(_ context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		validated <- string(msg.Data)
+		if string(msg.Data) == "reject" {
+			return pubsub.ValidationReject
+		}
+		return pubsub.ValidationAccept
+	}
+
+	srcTopic, err := MakePubsub(ctx, srcHost, testTopic, DirectPeers(*host.InfoFromHost(dstHost)))
+	require.NoError(t, err)
+	dstTopic, err := MakePubsub(ctx, dstHost, testTopic, DirectPeers(*host.InfoFromHost(srcHost)), Validator(validator))
+	require.NoError(t, err)
+	sub, err := dstTopic.Subscribe()
+	require.NoError(t, err)
+	defer sub.Cancel()
+	waitForPeer(t, srcTopic, dstHost.ID())
+
+	require.NoError(t, srcTopic.Publish(ctx, []byte("reject")))
+	require.NoError(t, srcTopic.Publish(ctx, []byte("accept")))
+
+	// Only the accepted message is delivered.
+	msg, err := sub.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "accept", string(msg.Data))
+	require.Equal(t, srcHost.ID(), msg.ReceivedFrom)
+	// Validation is concurrent, so the messages may be validated in any order.
+	require.ElementsMatch(t, []string{"reject", "accept"}, []string{<-validated, <-validated})
+}
+
+func TestPeerScore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Invalid score parameters show that they are given to the router.
+	_, err := MakePubsub(ctx, test.MkTestHost(), testTopic, TopicScore(&pubsub.TopicScoreParams{TopicWeight: -1}))
+	require.Error(t, err)
+
+	params := DefaultPeerScoreParams()
+	params.Topics = map[string]*pubsub.TopicScoreParams{
+		"/other/topic": DefaultTopicScoreParams(),
+	}
+	badThresholds := DefaultPeerScoreThresholds()
+	badThresholds.GossipThreshold = 1
+	_, err = MakePubsub(ctx, test.MkTestHost(), testTopic, PeerScore(params, badThresholds))
+	require.Error(t, err)
+
+	// The topic score parameters are added to a copy of the peer score
+	// parameters.
+	_, err = MakePubsub(ctx, test.MkTestHost(), testTopic, PeerScore(params, nil), TopicScore(DefaultTopicScoreParams()))
+	require.NoError(t, err)
+	require.Len(t, params.Topics, 1)
+	_, ok := params.Topics[testTopic]
+	require.False(t, ok)
+
+	// A peer that sends too many invalid messages is graylisted, so that its
+	// later messages are ignored, only if the topic is scored.
+	require.True(t, acceptedAfterInvalid(t, ctx))
+	require.False(t, acceptedAfterInvalid(t, ctx, TopicScore(DefaultTopicScoreParams())))
+}
+
+// acceptedAfterInvalid returns whether a subscriber, with the given options,
+// receives a valid message from a peer that has sent it invalid messages.
+func acceptedAfterInvalid(t *testing.T, ctx context.Context, options ...Option) bool {
+	srcHost := test.MkTestHost()
+	dstHost := test.MkTestHost()
+	connect(t, srcHost, dstHost)
+
+	validated := make(chan struct{}, 16)
+	validator := func(_ context.Context, _ peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		validated <- struct{}{}
+		if strings.HasPrefix(string(msg.Data), "reject") {
+			return pubsub.ValidationReject
+		}
+		return pubsub.ValidationAccept
+	}
+	srcTopic, err := MakePubsub(ctx, srcHost, testTopic)
+	require.NoError(t, err)
+	dstTopic, err := MakePubsub(ctx, dstHost, testTopic, append(options, Validator(validator))...)
+	require.NoError(t, err)
+	sub, err := dstTopic.Subscribe()
+	require.NoError(t, err)
+	defer sub.Cancel()
+	waitForPeer(t, srcTopic, dstHost.ID())
+
+	// With the default topic score parameters, six invalid messages put the
+	// peer's score below the default graylist threshold. The messages differ,
+	// since messages with the same data have the same ID.
+	const invalid = 6
+	for i := 0; i < invalid; i++ {
+		require.NoError(t, srcTopic.Publish(ctx, []byte(fmt.Sprint("reject ", i))))
+	}
+	for i := 0; i < invalid; i++ {
+		<-validated
+	}
+	// Give the router time to record the last rejection.
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, srcTopic.Publish(ctx, []byte("accept")))
+	nextCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	msg, err := sub.Next(nextCtx)
+	if err != nil {
+		return false
+	}
+	require.Equal(t, "accept", string(msg.Data))
+	return true
+}
+
+func connect(t *testing.T, a, b host.Host) {
+	b.Peerstore().AddAddrs(a.ID(), a.Addrs(), time.Hour)
+	require.NoError(t, a.Connect(context.Background(), *host.InfoFromHost(b)))
+}
+
+// waitForPeer waits until the topic has the peer, so that messages published
+// to the topic are sent to it.
+func waitForPeer(t *testing.T, topic *pubsub.Topic, p peer.ID) {
+	require.Eventually(t, func() bool {
+		for _, tp := range topic.ListPeers() {
+			if tp == p {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,63 @@
+package gpubsub
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// DefaultPeerScoreParams returns peer score parameters that penalize peers for
+// misbehavior, without scoring any topic. Topic scores are added by
+// TopicScore.
+func DefaultPeerScoreParams() *pubsub.PeerScoreParams {
+	return &pubsub.PeerScoreParams{
+		Topics:           make(map[string]*pubsub.TopicScoreParams),
+		AppSpecificScore: func(peer.ID) float64 { return 0 },
+
+		IPColocationFactorWeight:    -10,
+		IPColocationFactorThreshold: 10,
+
+		BehaviourPenaltyWeight:    -10,
+		BehaviourPenaltyThreshold: 6,
+		BehaviourPenaltyDecay:     pubsub.ScoreParameterDecay(time.Hour),
+
+		DecayInterval: time.Second,
+		DecayToZero:   0.01,
+		RetainScore:   time.Hour,
+	}
+}
+
+// DefaultPeerScoreThresholds returns peer score thresholds that graylist peers
+// whose score is dominated by penalties.
+func DefaultPeerScoreThresholds() *pubsub.PeerScoreThresholds {
+	return &pubsub.PeerScoreThresholds{
+		GossipThreshold:             -500,
+		PublishThreshold:            -1000,
+		GraylistThreshold:           -2500,
+		AcceptPXThreshold:           10,
+		OpportunisticGraftThreshold: 5,
+	}
+}
+
+// DefaultTopicScoreParams returns topic score parameters suitable for the
+// low-frequency traffic of an announce topic. Since announces are infrequent,
+// mesh peers are not penalized for failing to deliver messages. Peers are
+// rewarded for time in the mesh and for first deliveries of messages, and are
+// heavily penalized for delivering invalid messages.
+func DefaultTopicScoreParams() *pubsub.TopicScoreParams {
+	return &pubsub.TopicScoreParams{
+		TopicWeight: 1,
+
+		TimeInMeshWeight:  0.01,
+		TimeInMeshQuantum: time.Second,
+		TimeInMeshCap:     3600,
+
+		FirstMessageDeliveriesWeight: 1,
+		FirstMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(24 * time.Hour),
+		FirstMessageDeliveriesCap:    10,
+
+		InvalidMessageDeliveriesWeight: -100,
+		InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(24 * time.Hour),
+	}
+}
@@ -0,0 +1,70 @@
+package legs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/filecoin-project/go-legs/p2p/protocol/head"
+	"github.com/ipfs/go-cid"
+)
+
+// ErrHeadHistory is returned by a sync of an announced head that is not
+// consistent with the publisher's signed head history. See CheckHeadHistory.
+var ErrHeadHistory = errors.New("announced head not consistent with head history")
+
+// headHistorySyncer is a Syncer that can get the publisher's signed history of
+// heads. Both the dtsync and httpsync syncers are.
+type headHistorySyncer interface {
+	GetHeadHistory(context.Context) ([]head.HeadRecord, error)
+}
+
+// checkHeadHistory checks the announced head c against the publisher's signed
+// head history. The caller must hold latestSyncMu.
+func (h *handler) checkHeadHistory(ctx context.Context, c cid.Cid, syncer Syncer) error {
+	hs, ok := syncer.(headHistorySyncer)
+	if !ok {
+		return fmt.Errorf("%w: syncer cannot get head history", ErrHeadHistory)
+	}
+	records, err := hs.GetHeadHistory(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get head history: %w", err)
+	}
+	if err = head.CheckHistory(records); err != nil {
+		return fmt.Errorf("%w: %s", ErrHeadHistory, err)
+	}
+
+	announced := findHeadRecord(records, c)
+	if announced == -1 {
+		return fmt.Errorf("%w: %s is not in head history", ErrHeadHistory, c)
+	}
+	latestSync, ok := h.subscriber.latestSyncHander.GetLatestSync(h.peerID)
+	if !ok || latestSync == cid.Undef {
+		return nil
+	}
+	latest := findHeadRecord(records, latestSync)
+	if latest == -1 {
+		// The latest sync is older than the history, or the publisher
+		// rolled back past it. The chain fork check finds which.
+		log.Infow("Latest sync is not in head history", "peer", h.peerID, "latestSync", latestSync)
+		return nil
+	}
+	if records[announced].Seq < records[latest].Seq {
+		return fmt.Errorf("%w: %s was published before latest sync %s", ErrHeadHistory, c, latestSync)
+	}
+	if skipped := announced - latest - 1; skipped > 0 {
+		log.Infow("Announced head skips heads in head history", "peer", h.peerID, "cid", c, "skipped", skipped)
+	}
+	return nil
+}
+
+// findHeadRecord returns the index of the latest record of the head c, or -1
+// if there is none.
+func findHeadRecord(records []head.HeadRecord, c cid.Cid) int {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Cid == c {
+			return i
+		}
+	}
+	return -1
+}
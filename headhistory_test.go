@@ -0,0 +1,80 @@
+package legs_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckHeadHistory(t *testing.T) {
+	srcPrivKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	srcHost := test.MkTestHost(libp2p.Identity(srcPrivKey))
+	srcLinkSys := test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore()))
+	pub, err := httpsync.NewPublisher("127.0.0.1:0", srcLinkSys, srcHost.ID(), srcPrivKey, httpsync.HeadHistory(10, nil))
+	require.NoError(t, err)
+	defer pub.Close()
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	sub, err := legs.NewSubscriber(test.MkTestHost(), dstStore, test.MkLinkSystem(dstStore), testTopic, nil, legs.CheckHeadHistory())
+	require.NoError(t, err)
+	defer sub.Close()
+
+	chainLnks := test.MkChain(srcLinkSys, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	oldCid := chainLnks[2].(cidlink.Link).Cid
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, pub.SetRoot(ctx, oldCid))
+	require.NoError(t, pub.SetRoot(ctx, headCid))
+
+	finished, cncl := sub.OnSyncFinished()
+	defer cncl()
+	failed, cnclFailed := sub.OnSyncFailed()
+	defer cnclFailed()
+	addrs := []multiaddr.Multiaddr{pub.Address()}
+
+	expectFailed := func(c cid.Cid) {
+		select {
+		case event := <-failed:
+			require.Equal(t, c, event.Cid)
+			require.True(t, errors.Is(event.Err, legs.ErrHeadHistory), "unexpected error: %s", event.Err)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for sync failed event")
+		}
+	}
+
+	// A head that is in the history is synced.
+	require.NoError(t, sub.Announce(ctx, headCid, srcHost.ID(), addrs))
+	select {
+	case event := <-finished:
+		require.Equal(t, headCid, event.Cid)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for sync finished event")
+	}
+
+	// A head that is not in the history is not synced.
+	cids, err := test.RandomCids(1)
+	require.NoError(t, err)
+	require.NoError(t, sub.Announce(ctx, cids[0], srcHost.ID(), addrs))
+	expectFailed(cids[0])
+
+	// A head published before the latest synced head is not synced.
+	require.NoError(t, sub.Announce(ctx, oldCid, srcHost.ID(), addrs))
+	expectFailed(oldCid)
+	require.Equal(t, headCid, sub.GetLatestSync(srcHost.ID()).(cidlink.Link).Cid)
+}
@@ -2,12 +2,26 @@ package legs_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/httpannounce"
 	"github.com/filecoin-project/go-legs/httpsync"
 	"github.com/filecoin-project/go-legs/test"
 	"github.com/ipfs/go-cid"
@@ -250,3 +264,233 @@ func TestSyncFnHttp(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestHttpsSync(t *testing.T) {
+	certFile, keyFile, certPool := mkSelfSignedCert(t)
+
+	srcPrivKey, _, err := ic.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal("Err generating private key", err)
+	}
+	srcHost := test.MkTestHost(libp2p.Identity(srcPrivKey))
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcLinkSys := test.MkLinkSystem(srcStore)
+	pub, err := httpsync.NewPublisher("127.0.0.1:0", srcLinkSys, srcHost.ID(), srcPrivKey, httpsync.TLSCertFiles(certFile, keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	pubAddr := pub.Address()
+	if _, err = pubAddr.ValueForProtocol(multiaddr.P_TLS); err != nil {
+		t.Fatal("publisher address has no tls component:", pubAddr)
+	}
+
+	rootLnk, err := test.Store(srcStore, basicnode.NewString("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.UpdateRoot(context.Background(), rootLnk.(cidlink.Link).Cid); err != nil {
+		t.Fatal(err)
+	}
+
+	newSubscriber := func(options ...legs.Option) *legs.Subscriber {
+		dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+		sub, err := legs.NewSubscriber(test.MkTestHost(), dstStore, test.MkLinkSystem(dstStore), testTopic, nil, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			sub.Close()
+		})
+		return sub
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Sync using a client that trusts the publisher's certificate.
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: certPool,
+			},
+		},
+	}
+	sub := newSubscriber(legs.HttpClient(client))
+	syncCid, err := sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, pubAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !syncCid.Equals(rootLnk.(cidlink.Link).Cid) {
+		t.Fatalf("didn't get expected cid. expected %s, got %s", rootLnk, syncCid)
+	}
+
+	// Check that a client that does not trust the certificate fails to sync.
+	sub = newSubscriber()
+	if _, err = sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, pubAddr); err == nil {
+		t.Fatal("expected sync to fail with untrusted certificate")
+	}
+}
+
+// mkSelfSignedCert writes a self-signed certificate for 127.0.0.1, and its
+// key, to files. It returns the file names and a pool containing the
+// certificate.
+func mkSelfSignedCert(t *testing.T) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"go-legs test"}},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	if err = os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(cert)
+	return certFile, keyFile, certPool
+}
+
+func TestHttpAllowPeer(t *testing.T) {
+	srcPrivKey, _, err := ic.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal("Err generating private key", err)
+	}
+	dstPrivKey, _, err := ic.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal("Err generating private key", err)
+	}
+	srcHost := test.MkTestHost(libp2p.Identity(srcPrivKey))
+	dstHost := test.MkTestHost(libp2p.Identity(dstPrivKey))
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	allowPeer := func(peerID peer.ID) bool {
+		return peerID == dstHost.ID()
+	}
+	pub, err := httpsync.NewPublisher("127.0.0.1:0", test.MkLinkSystem(srcStore), srcHost.ID(), srcPrivKey, httpsync.AllowPeer(allowPeer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	rootLnk, err := test.Store(srcStore, basicnode.NewString("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.UpdateRoot(context.Background(), rootLnk.(cidlink.Link).Cid); err != nil {
+		t.Fatal(err)
+	}
+
+	newSubscriber := func(h host.Host, options ...legs.Option) *legs.Subscriber {
+		dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+		sub, err := legs.NewSubscriber(h, dstStore, test.MkLinkSystem(dstStore), testTopic, nil, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			sub.Close()
+		})
+		return sub
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// An allowed peer that signs its requests can sync.
+	sub := newSubscriber(dstHost, legs.HttpSyncOptions(httpsync.SignRequests(dstPrivKey)))
+	syncCid, err := sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, pub.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !syncCid.Equals(rootLnk.(cidlink.Link).Cid) {
+		t.Fatalf("didn't get expected cid. expected %s, got %s", rootLnk, syncCid)
+	}
+
+	// A peer that does not sign its requests cannot sync.
+	sub = newSubscriber(test.MkTestHost())
+	if _, err = sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, pub.Address()); err == nil {
+		t.Fatal("expected sync to fail without signed requests")
+	}
+
+	// A peer that is not allowed cannot sync.
+	otherPrivKey, _, err := ic.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal("Err generating private key", err)
+	}
+	sub = newSubscriber(test.MkTestHost(libp2p.Identity(otherPrivKey)), legs.HttpSyncOptions(httpsync.SignRequests(otherPrivKey)))
+	if _, err = sub.Sync(ctx, srcHost.ID(), cid.Undef, nil, pub.Address()); err == nil {
+		t.Fatal("expected sync to fail for peer that is not allowed")
+	}
+}
+
+func TestHttpAnnounce(t *testing.T) {
+	te := setupPublisherSubscriber(t, nil)
+
+	handler, err := httpannounce.NewHandler(te.sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	watcher, cncl := te.sub.OnSyncFinished()
+	defer cncl()
+
+	chainLnks := test.MkChain(te.srcLinkSys, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	if err = te.pub.SetRoot(context.Background(), headCid); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := dtsync.Message{
+		Cid: headCid,
+	}
+	msg.SetAddrs([]multiaddr.Multiaddr{te.pubAddr})
+	if err = msg.Sign(te.srcHost.Peerstore().PrivKey(te.srcHost.ID())); err != nil {
+		t.Fatal(err)
+	}
+	if err = httpannounce.Send(context.Background(), ts.URL, te.srcHost.ID(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for sync from announce")
+	case event := <-watcher:
+		if event.Cid != headCid {
+			t.Fatalf("expected sync to %s, got %s", headCid, event.Cid)
+		}
+		if event.PeerID != te.srcHost.ID() {
+			t.Fatal("sync with wrong publisher", event.PeerID)
+		}
+	}
+}
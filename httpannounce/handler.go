@@ -0,0 +1,276 @@
+// Package httpannounce sends and receives announce messages over HTTP, for
+// subscribers that are not reachable over pubsub.
+package httpannounce
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/dtsync"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/time/rate"
+)
+
+var log = logging.Logger("go-legs-httpannounce")
+
+const (
+	cborContentType = "application/cbor"
+	jsonContentType = "application/json"
+	// publisherHeader is the HTTP header that gives the publisher's peer ID.
+	// For a signed message, it must match the peer that signed the message.
+	publisherHeader = "X-Legs-Publisher"
+	// maxMessageSize is the largest encoded announce message accepted.
+	maxMessageSize = 1 << 20
+	// limiterIdleTime is the time after which an unused rate limiter is
+	// removed.
+	limiterIdleTime = 10 * time.Minute
+)
+
+// Announcer handles announce messages received by the handler. It is
+// implemented by legs.Subscriber, which also filters the announced addresses
+// according to its FilterIPs option.
+type Announcer interface {
+	AnnounceMessage(ctx context.Context, peerID peer.ID, msg dtsync.Message) error
+}
+
+type handler struct {
+	announcer Announcer
+
+	allowUnsigned bool
+	rateLimit     rate.Limit
+	rateBurst     int
+	// limiters holds a rate limiter for each client. See limiterKey.
+	limiters   map[string]*limiter
+	limitersMu sync.Mutex
+	// lastPrune is when idle rate limiters were last removed.
+	lastPrune time.Time
+}
+
+type limiter struct {
+	*rate.Limiter
+	lastUsed time.Time
+}
+
+// NewHandler creates an http.Handler that accepts announce messages, as
+// dtsync.Message encoded in CBOR or JSON, in PUT or POST requests. Each
+// message is passed to the announcer.
+//
+// The message must be signed, and the publisher is the peer that signed it. If
+// the request gives the publisher's ID in the X-Legs-Publisher header, or the
+// message has an OrigPeer, then it must match the signer. Unsigned messages
+// are rejected unless the AllowUnsigned option is given. Responses are status
+// 204 if the message is accepted, 400 if it is malformed or its timestamp is
+// outside the allowed time skew, 403 if it is not signed or its signature is
+// invalid, 409 if it is older than a previously accepted message, and 429 if
+// the client is rate limited.
+func NewHandler(announcer Announcer, options ...Option) (http.Handler, error) {
+	var cfg config
+	if err := cfg.apply(options); err != nil {
+		return nil, err
+	}
+	return &handler{
+		announcer:     announcer,
+		allowUnsigned: cfg.allowUnsigned,
+		rateLimit:     cfg.rateLimit,
+		rateBurst:     cfg.rateBurst,
+		limiters:      make(map[string]*limiter),
+	}, nil
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, "cannot read announce message", http.StatusBadRequest)
+		return
+	}
+	msg, err := decodeMessage(r.Header.Get("Content-Type"), data)
+	if err != nil {
+		log.Debugw("Cannot decode announce message", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var peerID peer.ID
+	signed := len(msg.Signature) != 0
+	if signed {
+		peerID, err = signerID(r.Header.Get(publisherHeader), msg)
+		if err != nil {
+			log.Infow("Rejected announce with invalid signature", "err", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	} else {
+		if !h.allowUnsigned {
+			http.Error(w, "announce message not signed", http.StatusForbidden)
+			return
+		}
+		peerID, err = claimedID(r.Header.Get(publisherHeader), msg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !h.allow(limiterKey(r, peerID, signed)) {
+		log.Infow("Rate limited announce", "peer", peerID, "remote", r.RemoteAddr)
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	// The announcer may continue handling the announce after the request
+	// finishes, so it is not given the request context.
+	err = h.announcer.AnnounceMessage(context.Background(), peerID, msg)
+	if err != nil {
+		log.Infow("Rejected announce", "err", err, "peer", peerID)
+		switch {
+		case errors.Is(err, dtsync.ErrBadSignature):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, legs.ErrStaleAnnounce):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, legs.ErrAnnounceTimeSkew):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, "cannot handle announce", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// limiterKey returns the key of the rate limiter for a request. This is the
+// client's IP address, followed by the publisher if the message is signed, so
+// that a client cannot avoid the rate limit by claiming to be many
+// publishers.
+func limiterKey(r *http.Request, peerID peer.ID, signed bool) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !signed {
+		return host
+	}
+	return host + "/" + peerID.String()
+}
+
+// allow returns true if the client is not rate limited.
+func (h *handler) allow(key string) bool {
+	if h.rateLimit == 0 {
+		return true
+	}
+	now := time.Now()
+	h.limitersMu.Lock()
+	defer h.limitersMu.Unlock()
+
+	if now.Sub(h.lastPrune) > limiterIdleTime {
+		for id, l := range h.limiters {
+			if now.Sub(l.lastUsed) > limiterIdleTime {
+				delete(h.limiters, id)
+			}
+		}
+		h.lastPrune = now
+	}
+
+	l, ok := h.limiters[key]
+	if !ok {
+		l = &limiter{
+			Limiter: rate.NewLimiter(h.rateLimit, h.rateBurst),
+		}
+		h.limiters[key] = l
+	}
+	l.lastUsed = now
+	return l.AllowN(now, 1)
+}
+
+// decodeMessage decodes an announce message according to its content type.
+// CBOR is assumed if the content type is not given.
+func decodeMessage(contentType string, data []byte) (dtsync.Message, error) {
+	var msg dtsync.Message
+	mediaType := cborContentType
+	if contentType != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return msg, fmt.Errorf("invalid content type: %w", err)
+		}
+	}
+	switch mediaType {
+	case cborContentType, "application/octet-stream":
+		if err := msg.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+			return msg, fmt.Errorf("%w: %s", dtsync.ErrBadEncoding, err)
+		}
+	case jsonContentType:
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return msg, fmt.Errorf("%w: %s", dtsync.ErrBadEncoding, err)
+		}
+	default:
+		return msg, fmt.Errorf("unsupported content type: %s", mediaType)
+	}
+	if !msg.Cid.Defined() {
+		return msg, errors.New("announce message has no cid")
+	}
+	if _, err := msg.GetAddrs(); err != nil {
+		return msg, fmt.Errorf("invalid announce addresses: %w", err)
+	}
+	return msg, nil
+}
+
+// signerID verifies the signature of a message, and returns the ID of the
+// peer that signed it. The publisher claimed by the header or the message's
+// OrigPeer, if any, must be the signer.
+func signerID(header string, msg dtsync.Message) (peer.ID, error) {
+	signer, err := msg.VerifySignature()
+	if err != nil {
+		return "", err
+	}
+	for _, claimed := range []string{header, msg.OrigPeer} {
+		if claimed != "" && claimed != signer.String() {
+			return "", fmt.Errorf("%w: signed by %s instead of publisher", dtsync.ErrBadSignature, signer)
+		}
+	}
+	return signer, nil
+}
+
+// claimedID returns the ID of the publisher that an unsigned message claims
+// to be from. This is given by the header, the message's OrigPeer, or
+// otherwise the /p2p component of an announced address. The ID is not
+// authenticated.
+func claimedID(header string, msg dtsync.Message) (peer.ID, error) {
+	claimed := header
+	if claimed == "" {
+		claimed = msg.OrigPeer
+	}
+	if claimed != "" {
+		peerID, err := peer.Decode(claimed)
+		if err != nil {
+			return "", fmt.Errorf("invalid publisher id: %w", err)
+		}
+		return peerID, nil
+	}
+	addrs, err := msg.GetAddrs()
+	if err != nil {
+		return "", fmt.Errorf("invalid announce addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if _, id := peer.SplitAddr(addr); id != "" {
+			return id, nil
+		}
+	}
+	return "", errors.New("announce message does not identify publisher")
+}
@@ -0,0 +1,281 @@
+package httpannounce
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-legs"
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/test"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+type testAnnouncer struct {
+	err     error
+	peerIDs []peer.ID
+	msgs    []dtsync.Message
+}
+
+func (a *testAnnouncer) AnnounceMessage(_ context.Context, peerID peer.ID, msg dtsync.Message) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.peerIDs = append(a.peerIDs, peerID)
+	a.msgs = append(a.msgs, msg)
+	return nil
+}
+
+func mkKey(t *testing.T) (ic.PrivKey, peer.ID) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privKey, peerID
+}
+
+func mkPeerID(t *testing.T) peer.ID {
+	_, peerID := mkKey(t)
+	return peerID
+}
+
+func mkSigned(t *testing.T, privKey ic.PrivKey, msg dtsync.Message) dtsync.Message {
+	if err := msg.Sign(privKey); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSendAndReceive(t *testing.T) {
+	announcer := &testAnnouncer{}
+	h, err := NewHandler(announcer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	privKey, peerID := mkKey(t)
+	cids, err := test.RandomCids(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := dtsync.Message{
+		Cid:       cids[0],
+		ExtraData: []byte("t01000"),
+	}
+	msg.SetAddrs([]multiaddr.Multiaddr{addr})
+
+	if err = Send(context.Background(), ts.URL, peerID, mkSigned(t, privKey, msg)); err != nil {
+		t.Fatal(err)
+	}
+	msg.Cid = cids[1]
+	if err = Send(context.Background(), ts.URL, peerID, mkSigned(t, privKey, msg), SendJSON()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(announcer.msgs) != 2 {
+		t.Fatalf("expected 2 announces, got %d", len(announcer.msgs))
+	}
+	for i, got := range announcer.msgs {
+		if announcer.peerIDs[i] != peerID {
+			t.Fatal("wrong publisher", announcer.peerIDs[i])
+		}
+		if got.Cid != cids[i] {
+			t.Fatal("wrong cid", got.Cid)
+		}
+		if string(got.ExtraData) != "t01000" {
+			t.Fatal("wrong extra data")
+		}
+		if got.OrigPeer != "" {
+			t.Fatal("direct announce has original peer", got.OrigPeer)
+		}
+		addrs, err := got.GetAddrs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || !addrs[0].Equal(addr) {
+			t.Fatal("wrong addresses", addrs)
+		}
+	}
+
+	// Unsigned messages are rejected.
+	err = Send(context.Background(), ts.URL, peerID, msg)
+	if err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Fatal("expected unsigned message to be rejected, got", err)
+	}
+
+	// A message signed by a peer other than the publisher is rejected.
+	otherKey, _ := mkKey(t)
+	err = Send(context.Background(), ts.URL, peerID, mkSigned(t, otherKey, msg))
+	if err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Fatal("expected message signed by other peer to be rejected, got", err)
+	}
+	if len(announcer.msgs) != 2 {
+		t.Fatalf("expected 2 announces, got %d", len(announcer.msgs))
+	}
+}
+
+func TestPublisherFromAddrs(t *testing.T) {
+	announcer := &testAnnouncer{}
+	h, err := NewHandler(announcer, AllowUnsigned())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peerID := mkPeerID(t)
+	cids, err := test.RandomCids(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9999/p2p/" + peerID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"Cid":{"/":"` + cids[0].String() + `"},"Addrs":["` + encodeAddr(addr) + `"]}`
+	req := httptest.NewRequest(http.MethodPost, "/announce", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+	if len(announcer.peerIDs) != 1 || announcer.peerIDs[0] != peerID {
+		t.Fatal("publisher not identified from address")
+	}
+
+	// Without a publisher ID the message is rejected.
+	body = `{"Cid":{"/":"` + cids[0].String() + `"}}`
+	req = httptest.NewRequest(http.MethodPost, "/announce", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func encodeAddr(addr multiaddr.Multiaddr) string {
+	return base64.StdEncoding.EncodeToString(addr.Bytes())
+}
+
+func TestHandlerErrors(t *testing.T) {
+	announcer := &testAnnouncer{}
+	h, err := NewHandler(announcer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+
+	resp, err = http.Post(ts.URL, "application/cbor", strings.NewReader("not cbor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	privKey, peerID := mkKey(t)
+	cids, err := test.RandomCids(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := mkSigned(t, privKey, dtsync.Message{Cid: cids[0]})
+
+	for _, tc := range []struct {
+		err    error
+		status string
+	}{
+		{legs.ErrStaleAnnounce, "409"},
+		{legs.ErrAnnounceTimeSkew, "400"},
+		{dtsync.ErrBadSignature, "403"},
+		{errors.New("other error"), "500"},
+	} {
+		announcer.err = tc.err
+		err = Send(context.Background(), ts.URL, peerID, msg)
+		if err == nil || !strings.Contains(err.Error(), "status "+tc.status) {
+			t.Fatalf("expected status %s, got %v", tc.status, err)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	if _, err := NewHandler(&testAnnouncer{}, RateLimit(1, 0)); err == nil {
+		t.Fatal("expected error for zero burst")
+	}
+
+	h, err := NewHandler(&testAnnouncer{}, RateLimit(0.001, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	privKey, peerID := mkKey(t)
+	cids, err := test.RandomCids(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := mkSigned(t, privKey, dtsync.Message{Cid: cids[0]})
+
+	for i := 0; i < 2; i++ {
+		if err = Send(context.Background(), ts.URL, peerID, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = Send(context.Background(), ts.URL, peerID, msg)
+	if err == nil || !strings.Contains(err.Error(), "status 429") {
+		t.Fatal("expected rate limit error, got", err)
+	}
+
+	// Another publisher is not rate limited.
+	otherKey, otherID := mkKey(t)
+	if err = Send(context.Background(), ts.URL, otherID, mkSigned(t, otherKey, dtsync.Message{Cid: cids[0]})); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unsigned messages from the same client share a rate limit, whatever
+	// publisher they claim to be from.
+	h, err = NewHandler(&testAnnouncer{}, RateLimit(0.001, 2), AllowUnsigned())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts2 := httptest.NewServer(h)
+	defer ts2.Close()
+	unsigned := dtsync.Message{Cid: cids[0]}
+	for i := 0; i < 2; i++ {
+		if err = Send(context.Background(), ts2.URL, mkPeerID(t), unsigned); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = Send(context.Background(), ts2.URL, mkPeerID(t), unsigned)
+	if err == nil || !strings.Contains(err.Error(), "status 429") {
+		t.Fatal("expected rate limit error, got", err)
+	}
+}
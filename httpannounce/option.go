@@ -0,0 +1,83 @@
+package httpannounce
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// config contains all options for configuring the announce handler.
+type config struct {
+	allowUnsigned bool
+	rateLimit     rate.Limit
+	rateBurst     int
+}
+
+type Option func(*config) error
+
+// apply applies the given options to this config.
+func (c *config) apply(opts []Option) error {
+	for i, opt := range opts {
+		if err := opt(c); err != nil {
+			return fmt.Errorf("option %d failed: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// AllowUnsigned makes the handler accept announce messages that are not
+// signed. The publisher of an unsigned message is given by the
+// X-Legs-Publisher header, the message's OrigPeer, or otherwise the /p2p
+// component of an announced address. Since none of these are authenticated,
+// any client can announce for any publisher.
+func AllowUnsigned() Option {
+	return func(c *config) error {
+		c.allowUnsigned = true
+		return nil
+	}
+}
+
+// RateLimit limits the rate of announce messages accepted from each client to
+// limit messages per second, allowing bursts of up to burst messages. A
+// client is identified by its IP address and, for a signed message, the
+// publisher that signed it. Unsigned messages from the same IP address share
+// a limit. Messages over the limit are answered with status 429. By default,
+// announce messages are not rate limited.
+func RateLimit(limit rate.Limit, burst int) Option {
+	return func(c *config) error {
+		if limit <= 0 {
+			return errors.New("announce rate limit must be positive")
+		}
+		if burst < 1 {
+			return errors.New("announce rate limit burst must be at least 1")
+		}
+		c.rateLimit = limit
+		c.rateBurst = burst
+		return nil
+	}
+}
+
+// sendConfig contains all options for sending announce messages.
+type sendConfig struct {
+	client *http.Client
+	json   bool
+}
+
+type SendOption func(*sendConfig)
+
+// HttpClient sets the HTTP client used to send announce messages. If not set,
+// http.DefaultClient is used.
+func HttpClient(client *http.Client) SendOption {
+	return func(c *sendConfig) {
+		c.client = client
+	}
+}
+
+// SendJSON sends announce messages encoded as JSON instead of CBOR.
+func SendJSON() SendOption {
+	return func(c *sendConfig) {
+		c.json = true
+	}
+}
@@ -0,0 +1,57 @@
+package httpannounce
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Send sends an announce message from the publisher, peerID, to the announce
+// handler at announceURL. The message should be signed by the publisher, since
+// the handler rejects unsigned messages by default. The publisher is given in
+// a header, which the handler checks against the signer of the message, so the
+// message's OrigPeer is left unset and the announce is not seen as relayed.
+// The message is encoded as CBOR unless the SendJSON option is given.
+func Send(ctx context.Context, announceURL string, peerID peer.ID, msg dtsync.Message, options ...SendOption) error {
+	var cfg sendConfig
+	for _, opt := range options {
+		opt(&cfg)
+	}
+	if cfg.client == nil {
+		cfg.client = http.DefaultClient
+	}
+
+	buf := bytes.NewBuffer(nil)
+	contentType := cborContentType
+	if cfg.json {
+		if err := json.NewEncoder(buf).Encode(msg); err != nil {
+			return err
+		}
+		contentType = jsonContentType
+	} else if err := msg.MarshalCBOR(buf); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, announceURL, buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(publisherHeader, peerID.String())
+	resp, err := cfg.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("announce rejected with status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package httpsync
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// authHeader is the request header that holds a subscriber's signature of
+	// the request. Its value is the subscriber's base64 encoded public key,
+	// the request time as unix seconds, and the base64 encoded signature,
+	// separated by periods.
+	authHeader = "X-Legs-Auth"
+	// authSigDomain is prepended to the data signed for a request, so that a
+	// request signature is not valid as any other kind of signature.
+	authSigDomain = "/legs/httpsync/request:"
+	// authMaxSkew is the largest difference between the time of a signed
+	// request and the publisher's time, for the request to be accepted.
+	authMaxSkew = 5 * time.Minute
+)
+
+var errNoAuth = errors.New("request not signed")
+
+// signRequest adds a signature of the request for the publisher, pubID, made
+// with the subscriber's private key, to the request's headers.
+func signRequest(req *http.Request, pubID peer.ID, privKey ic.PrivKey) error {
+	pubKeyBytes, err := ic.MarshalPublicKey(privKey.GetPublic())
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig, err := privKey.Sign(authSigData(pubID, req.URL.RequestURI(), ts))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(authHeader, strings.Join([]string{
+		base64.StdEncoding.EncodeToString(pubKeyBytes),
+		ts,
+		base64.StdEncoding.EncodeToString(sig),
+	}, "."))
+	return nil
+}
+
+// verifyRequest checks the signature of a request made to the publisher,
+// pubID, and returns the ID of the peer that signed the request.
+func verifyRequest(r *http.Request, pubID peer.ID) (peer.ID, error) {
+	val := r.Header.Get(authHeader)
+	if val == "" {
+		return "", errNoAuth
+	}
+	parts := strings.Split(val, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed request signature")
+	}
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("malformed public key: %w", err)
+	}
+	pubKey, err := ic.UnmarshalPublicKey(pubKeyBytes)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key: %w", err)
+	}
+	unixSecs, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed request time: %w", err)
+	}
+	skew := time.Since(time.Unix(unixSecs, 0))
+	if skew > authMaxSkew || skew < -authMaxSkew {
+		return "", errors.New("request time outside of allowed range")
+	}
+	sig, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed signature: %w", err)
+	}
+	ok, err := pubKey.Verify(authSigData(pubID, r.RequestURI, parts[1]), sig)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New("invalid request signature")
+	}
+	return peer.IDFromPublicKey(pubKey)
+}
+
+// authSigData returns the data signed for a request. The data includes the
+// publisher's ID and the requested URI, so that the signature is not valid
+// for requests to other publishers or for other resources.
+func authSigData(pubID peer.ID, requestURI, ts string) []byte {
+	return []byte(authSigDomain + pubID.String() + "\n" + requestURI + "\n" + ts)
+}
@@ -0,0 +1,83 @@
+package httpsync
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestSignedRequest(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pubPubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubID, err := peer.IDFromPublicKey(pubPubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRequest := func(uri string) *http.Request {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:1234"+uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Set as a server sees the request.
+		req.RequestURI = req.URL.RequestURI()
+		return req
+	}
+
+	if _, err = verifyRequest(newRequest("/head"), pubID); err != errNoAuth {
+		t.Fatal("expected error for unsigned request, got", err)
+	}
+
+	req := newRequest("/head")
+	if err = signRequest(req, pubID, privKey); err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := verifyRequest(req, pubID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peerID != subID {
+		t.Fatal("wrong peer ID from signed request")
+	}
+
+	// Check that the signature is not valid for another publisher.
+	if _, err = verifyRequest(req, subID); err == nil {
+		t.Fatal("expected error for request signed for another publisher")
+	}
+
+	// Check that the signature is not valid for another resource.
+	otherReq := newRequest("/car/root?selector=x")
+	otherReq.Header = req.Header
+	if _, err = verifyRequest(otherReq, pubID); err == nil {
+		t.Fatal("expected error for request signed for another resource")
+	}
+
+	// Check that an old signature is rejected.
+	parts := strings.Split(req.Header.Get(authHeader), ".")
+	ts := strconv.FormatInt(time.Now().Add(-2*authMaxSkew).Unix(), 10)
+	sig, err := privKey.Sign(authSigData(pubID, "/head", ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(authHeader, parts[0]+"."+ts+"."+base64.StdEncoding.EncodeToString(sig))
+	if _, err = verifyRequest(req, pubID); err == nil {
+		t.Fatal("expected error for old request")
+	}
+}
@@ -0,0 +1,482 @@
+package httpsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorbuilder "github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// carPath is the path, under the publisher's root, of the CAR export of
+	// a DAG. The root CID of the DAG follows this path.
+	carPath = "car"
+	// carContentType is the media type of a CAR export.
+	carContentType = "application/vnd.ipld.car; version=1"
+
+	// exportHeader is the response header that a publisher uses to list the
+	// export formats it supports.
+	exportHeader = "X-Legs-Export"
+	// carExport is the exportHeader value for CAR export support.
+	carExport = "car"
+
+	// Query parameters of a CAR export request. The selector is given as
+	// dag-json. If no selector is given, the export explores all links,
+	// stopping at the stop CID if given, up to the depth if given.
+	selectorParam = "selector"
+	stopParam     = "stop"
+	depthParam    = "depth"
+)
+
+// carExportSupport records whether a publisher supports CAR export.
+type carExportSupport int
+
+const (
+	carExportUnknown carExportSupport = iota
+	carExportSupported
+	carExportUnsupported
+)
+
+// carExports caches whether each publisher supports CAR export, so that it is
+// only requested when it is not known.
+type carExports struct {
+	mutex   sync.Mutex
+	support map[peer.ID]carExportSupport
+}
+
+func (ce *carExports) get(p peer.ID) carExportSupport {
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+	return ce.support[p]
+}
+
+func (ce *carExports) set(p peer.ID, support carExportSupport) {
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+	if ce.support == nil {
+		ce.support = make(map[peer.ID]carExportSupport)
+	}
+	ce.support[p] = support
+}
+
+// setCarExport records whether the publisher supports CAR export, from the
+// headers of a response to a head request.
+func (s *Syncer) setCarExport(header http.Header) {
+	support := carExportUnsupported
+	if header.Get(exportHeader) == carExport {
+		support = carExportSupported
+	}
+	s.sync.carExports.set(s.peerID, support)
+}
+
+// supportsCarExport returns true if the publisher supports CAR export. If
+// this is not yet known, then the publisher's head is requested to find out.
+// Whether the publisher supports CAR export is updated each time its head is
+// fetched.
+func (s *Syncer) supportsCarExport(ctx context.Context) bool {
+	support := s.sync.carExports.get(s.peerID)
+	if support == carExportUnknown {
+		err := s.fetchResponse(ctx, "head", nil, "", cid.Undef, func(resp *http.Response) error {
+			s.setCarExport(resp.Header)
+			return nil
+		})
+		if err != nil {
+			log.Warnw("Cannot determine if publisher supports CAR export", "err", err, "peer", s.peerID)
+			s.sync.carExports.set(s.peerID, carExportUnsupported)
+		}
+		support = s.sync.carExports.get(s.peerID)
+	}
+	return support == carExportSupported
+}
+
+// fetchCar requests a CAR export of the DAG at root, with the selector sel,
+// and stores the blocks from the export that the selector visits.
+func (s *Syncer) fetchCar(ctx context.Context, root cid.Cid, sel ipld.Node) error {
+	xsel, err := selector.CompileSelector(sel)
+	if err != nil {
+		return err
+	}
+	var selBuf bytes.Buffer
+	if err = dagjson.Encode(sel, &selBuf); err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set(selectorParam, selBuf.String())
+
+	return s.retryRateLimited(ctx, root, func() error {
+		return s.fetchResponse(ctx, path.Join(carPath, root.String()), query, carContentType, root, func(resp *http.Response) error {
+			scratch, readErr := readCar(resp.Body, s.sync.maxBlockSize)
+			if len(scratch) == 0 {
+				return readErr
+			}
+			// Store the blocks read before any error, so that only the rest
+			// are fetched individually.
+			if err := s.storeCarBlocks(ctx, root, xsel, scratch); err != nil {
+				return err
+			}
+			if readErr != nil {
+				log.Warnw("Car export ended early; remaining blocks are fetched individually", "err", readErr, "root", root, "blocks", len(scratch))
+			}
+			return nil
+		})
+	})
+}
+
+// readCar reads the blocks from a CARv1 stream into a scratch map, without
+// storing them. At most maxCarScratchSize bytes of blocks are read, and any
+// blocks after that are left to be fetched individually. If reading fails
+// after the header, then the blocks read before the failure are returned
+// along with the error.
+func readCar(r io.Reader, maxBlockSize int64) (map[cid.Cid][]byte, error) {
+	br := bufio.NewReader(r)
+	header, err := readCarSection(br, maxBlockSize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read car header: %w", err)
+	}
+	if err = checkCarHeader(header); err != nil {
+		return nil, err
+	}
+
+	scratch := make(map[cid.Cid][]byte)
+	var total int
+	for total < maxCarScratchSize {
+		section, err := readCarSection(br, maxBlockSize)
+		if err != nil {
+			if err == io.EOF {
+				return scratch, nil
+			}
+			return scratch, err
+		}
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return scratch, err
+		}
+		scratch[c] = section[n:]
+		total += len(section)
+	}
+	log.Warnw("Car export exceeds scratch space; remaining blocks are fetched individually", "size", total)
+	return scratch, nil
+}
+
+// storeCarBlocks walks the DAG at root with the selector, and stores each
+// block from scratch that the walk loads and that is not already stored. This
+// keeps blocks in the export that the selector does not visit from being
+// stored. The walk skips any block that is neither stored nor in scratch, and
+// that is then fetched individually. Each stored block is subject to the rate
+// limiter, as when blocks are fetched individually.
+func (s *Syncer) storeCarBlocks(ctx context.Context, root cid.Cid, sel selector.Selector, scratch map[cid.Cid][]byte) error {
+	carLs := cidlink.DefaultLinkSystem()
+	// Trusted because storeBlock verifies each block against its CID.
+	carLs.TrustedStorage = true
+	carLs.StorageReadOpener = func(lc ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		r, err := s.sync.lsys.StorageReadOpener(lc, l)
+		if err == nil {
+			// Already stored.
+			return r, nil
+		}
+		c := l.(cidlink.Link).Cid
+		data, ok := scratch[c]
+		if !ok {
+			return nil, traversal.SkipMe{}
+		}
+		if s.rateLimiter != nil {
+			if err = s.waitRateLimit(ctx, c); err != nil {
+				return nil, &rateLimitErr{
+					resource: path.Join(carPath, c.String()),
+					rootURL:  s.rootURL,
+					source:   s.peerID,
+					local:    true,
+				}
+			}
+		}
+		if err = s.storeBlock(c, data); err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+
+	rootNode, err := carLs.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, basicnode.Prototype.Any)
+	if err != nil {
+		if errors.As(err, &traversal.SkipMe{}) {
+			return nil
+		}
+		return err
+	}
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     carLs,
+			LinkTargetNodePrototypeChooser: basicnode.Chooser,
+		},
+	}
+	return progress.WalkAdv(rootNode, sel, func(traversal.Progress, datamodel.Node, traversal.VisitReason) error {
+		return nil
+	})
+}
+
+// readCarSection reads a varint length-prefixed section of a CAR stream.
+// Returns io.EOF if there are no more sections.
+func readCarSection(br *bufio.Reader, maxSize int64) ([]byte, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	// A section may hold a CID as well as maxSize bytes of block data.
+	if size > uint64(maxSize)+cidMaxSize {
+		return nil, fmt.Errorf("car section size %d exceeds maximum", size)
+	}
+	section := make([]byte, size)
+	if _, err = io.ReadFull(br, section); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return section, nil
+}
+
+const (
+	// cidMaxSize is a generous upper bound on the encoded size of a CID.
+	cidMaxSize = 256
+	// maxCarScratchSize is the most data read from a CAR export before the
+	// blocks in it are stored.
+	maxCarScratchSize = 64 << 20
+	// maxCarExportLinks is the most links that a CAR export loads. A
+	// subscriber fetches any blocks beyond this individually.
+	maxCarExportLinks = 1 << 14
+)
+
+func checkCarHeader(header []byte) error {
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagcbor.Decode(nb, bytes.NewReader(header)); err != nil {
+		return fmt.Errorf("cannot decode car header: %w", err)
+	}
+	versionNode, err := nb.Build().LookupByString("version")
+	if err != nil {
+		return fmt.Errorf("car header missing version: %w", err)
+	}
+	version, err := versionNode.AsInt()
+	if err != nil {
+		return fmt.Errorf("invalid car version: %w", err)
+	}
+	if version != 1 {
+		return fmt.Errorf("unsupported car version %d", version)
+	}
+	return nil
+}
+
+// writeCarHeader writes a CARv1 header with the root CID.
+func writeCarHeader(w io.Writer, root cid.Cid) error {
+	header := fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("roots").CreateList(1, func(la fluent.ListAssembler) {
+			la.AssembleValue().AssignLink(cidlink.Link{Cid: root})
+		})
+		na.AssembleEntry("version").AssignInt(1)
+	})
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(header, &buf); err != nil {
+		return err
+	}
+	return writeCarSection(w, buf.Bytes())
+}
+
+// writeCarBlock writes a CAR section holding a block.
+func writeCarBlock(w io.Writer, c cid.Cid, data []byte) error {
+	return writeCarSection(w, c.Bytes(), data)
+}
+
+func writeCarSection(w io.Writer, parts ...[]byte) error {
+	var size int
+	for _, part := range parts {
+		size += len(part)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(size))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// carSelector returns the selector for a CAR export request.
+func carSelector(query url.Values) (ipld.Node, error) {
+	if selParam := query.Get(selectorParam); selParam != "" {
+		nb := basicnode.Prototype.Any.NewBuilder()
+		if err := dagjson.Decode(nb, bytes.NewBufferString(selParam)); err != nil {
+			return nil, fmt.Errorf("cannot decode selector: %w", err)
+		}
+		return nb.Build(), nil
+	}
+
+	limit := selector.RecursionLimitNone()
+	if depthParam := query.Get(depthParam); depthParam != "" {
+		depth, err := strconv.ParseInt(depthParam, 10, 64)
+		if err != nil || depth < 0 {
+			return nil, errors.New("invalid depth")
+		}
+		limit = selector.RecursionLimitDepth(depth)
+	}
+	ssb := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.ExploreRecursive(limit, ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	if stopParam := query.Get(stopParam); stopParam != "" {
+		stop, err := cid.Decode(stopParam)
+		if err != nil {
+			return nil, errors.New("invalid stop cid")
+		}
+		sel = withStopAt(sel, stop)
+	}
+	return sel, nil
+}
+
+// withStopAt adds a stop condition, for the link to stop, to a recursive
+// selector.
+func withStopAt(sel ipld.Node, stop cid.Cid) ipld.Node {
+	recursive, _ := sel.LookupByString(selector.SelectorKey_ExploreRecursive)
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry(selector.SelectorKey_ExploreRecursive).CreateMap(recursive.Length()+1, func(na fluent.MapAssembler) {
+			iter := recursive.MapIterator()
+			for !iter.Done() {
+				k, v, _ := iter.Next()
+				key, _ := k.AsString()
+				na.AssembleEntry(key).AssignNode(v)
+			}
+			cond := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+				na.AssembleEntry(string(selector.ConditionMode_Link)).AssignLink(cidlink.Link{Cid: stop})
+			})
+			na.AssembleEntry(selector.SelectorKey_StopAt).AssignNode(cond)
+		})
+	})
+}
+
+// serveCar serves a CAR export of the DAG at root, containing each block that
+// the selector in the request visits. The traversal stops after loading
+// maxCarExportLinks links, however many the selector would visit.
+func (p *publisher) serveCar(w http.ResponseWriter, r *http.Request, root cid.Cid) {
+	selNode, err := carSelector(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sel, err := selector.CompileSelector(selNode)
+	if err != nil {
+		http.Error(w, "invalid selector", http.StatusBadRequest)
+		return
+	}
+
+	// Load the root before writing anything, so that a missing root is
+	// reported with an error status.
+	lnk := cidlink.Link{Cid: root}
+	rootData, err := p.loadRaw(r.Context(), lnk)
+	if err != nil {
+		if isNotFound(err) {
+			http.Error(w, "cid not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "unable to load data for cid", http.StatusInternalServerError)
+		log.Errorw("Failed to load requested block", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", carContentType)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	if err = writeCarHeader(bw, root); err != nil {
+		log.Errorw("Failed to write car header", "err", err)
+		return
+	}
+
+	// Write each block as the traversal loads it.
+	written := make(map[cid.Cid]struct{})
+	exportLs := cidlink.DefaultLinkSystem()
+	exportLs.TrustedStorage = true
+	exportLs.StorageReadOpener = func(lc ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		c := l.(cidlink.Link).Cid
+		var data []byte
+		if c == root {
+			data = rootData
+		} else {
+			var err error
+			data, err = p.loadRaw(lc.Ctx, l)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := written[c]; !ok {
+			if err := writeCarBlock(bw, c, data); err != nil {
+				return nil, err
+			}
+			written[c] = struct{}{}
+		}
+		return bytes.NewReader(data), nil
+	}
+
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            r.Context(),
+			LinkSystem:                     exportLs,
+			LinkTargetNodePrototypeChooser: basicnode.Chooser,
+		},
+		Path: datamodel.NewPath([]datamodel.PathSegment{}),
+		Budget: &traversal.Budget{
+			NodeBudget: math.MaxInt64,
+			LinkBudget: maxCarExportLinks,
+		},
+	}
+	rootNode, err := exportLs.Load(ipld.LinkContext{Ctx: r.Context()}, lnk, basicnode.Prototype.Any)
+	if err != nil {
+		log.Errorw("Failed to load root node for car export", "err", err, "root", root)
+		return
+	}
+	err = progress.WalkMatching(rootNode, sel, func(traversal.Progress, datamodel.Node) error {
+		return nil
+	})
+	if err != nil {
+		// The response is already started, so the subscriber sees a truncated
+		// export and fetches the remaining blocks individually.
+		var budgetErr *traversal.ErrBudgetExceeded
+		if errors.As(err, &budgetErr) {
+			log.Infow("Car export reached link limit", "root", root, "limit", maxCarExportLinks)
+			return
+		}
+		log.Errorw("Failed to traverse dag for car export", "err", err, "root", root)
+	}
+}
+
+// loadRaw reads the stored bytes of the block for the link.
+func (p *publisher) loadRaw(ctx context.Context, l ipld.Link) ([]byte, error) {
+	r, err := p.lsys.StorageReadOpener(ipld.LinkContext{Ctx: ctx}, l)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
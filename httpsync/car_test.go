@@ -0,0 +1,300 @@
+package httpsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	maurl "github.com/filecoin-project/go-legs/httpsync/multiaddr"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorbuilder "github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+)
+
+type countingTransport struct {
+	requests int32
+	carPaths int32
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&ct.requests, 1)
+	if strings.Contains(req.URL.Path, "/"+carPath+"/") {
+		atomic.AddInt32(&ct.carPaths, 1)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestSyncCarExport(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcLinkSys := test.MkLinkSystem(datastore.NewMapDatastore())
+	chainLnks := test.MkChain(srcLinkSys, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+
+	pub, err := NewPublisher("127.0.0.1:0", srcLinkSys, peerID, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err = pub.SetRoot(context.Background(), headCid); err != nil {
+		t.Fatal(err)
+	}
+
+	ssb := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+
+	syncChain := func(t *testing.T, addr multiaddr.Multiaddr) *countingTransport {
+		ct := &countingTransport{}
+		dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+		sync := NewSync(test.MkLinkSystem(dstStore), &http.Client{Transport: ct}, nil)
+		defer sync.Close()
+		syncer, err := sync.NewSyncer(peerID, addr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = syncer.Sync(context.Background(), headCid, sel); err != nil {
+			t.Fatal(err)
+		}
+		for _, lnk := range chainLnks {
+			if has, _ := dstStore.Has(context.Background(), datastore.NewKey(lnk.String())); !has {
+				t.Fatal("block not synced", lnk)
+			}
+		}
+		return ct
+	}
+
+	// All blocks are fetched with one CAR export, after checking that the
+	// publisher supports it.
+	ct := syncChain(t, pub.Address())
+	if ct.requests != 2 || ct.carPaths != 1 {
+		t.Fatalf("expected head and car requests, got %d requests", ct.requests)
+	}
+
+	// Check that blocks are fetched individually if the CAR export fails.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/"+carPath+"/") {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		pub.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	tsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := maurl.ToMultiaddr(tsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct = syncChain(t, addr)
+	// The chain has 8 distinct blocks.
+	if ct.carPaths != 1 || ct.requests != 2+8 {
+		t.Fatalf("expected fallback to fetching blocks individually, got %d requests", ct.requests)
+	}
+
+	// Check that the blocks read before a CAR export is cut off are kept, and
+	// only the rest are fetched individually.
+	truncated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/"+carPath+"/") {
+			pub.ServeHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		pub.ServeHTTP(rec, r)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		body := rec.Body.Bytes()
+		_, _ = w.Write(body[:len(body)/2])
+	}))
+	defer truncated.Close()
+	tsURL, err = url.Parse(truncated.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err = maurl.ToMultiaddr(tsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct = syncChain(t, addr)
+	if ct.carPaths != 1 || ct.requests <= 2 || ct.requests >= 2+8 {
+		t.Fatalf("expected blocks from truncated export to be kept, got %d requests", ct.requests)
+	}
+
+	// Check that whether the publisher supports CAR export is only requested
+	// by the first sync with the publisher.
+	ct = &countingTransport{}
+	sync := NewSync(test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore())), &http.Client{Transport: ct}, nil)
+	defer sync.Close()
+	for i := 0; i < 2; i++ {
+		syncer, err := sync.NewSyncer(peerID, pub.Address(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = syncer.Sync(context.Background(), headCid, sel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ct.requests != 3 || ct.carPaths != 2 {
+		t.Fatalf("expected one head request and two car requests, got %d requests", ct.requests)
+	}
+}
+
+func TestReadTruncatedCar(t *testing.T) {
+	srcStore := datastore.NewMapDatastore()
+	chainLnks := test.MkChain(test.MkLinkSystem(srcStore), true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	headData, err := srcStore.Get(context.Background(), datastore.NewKey(chainLnks[0].String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = writeCarHeader(&buf, headCid); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeCarBlock(&buf, headCid, headData); err != nil {
+		t.Fatal(err)
+	}
+	// Start a section that ends before its length.
+	buf.Write([]byte{0x40, 0x01})
+
+	scratch, err := readCar(&buf, defaultMaxBlockSize)
+	if err == nil {
+		t.Fatal("expected error reading truncated car")
+	}
+	if !bytes.Equal(scratch[headCid], headData) {
+		t.Fatal("expected block read before error to be returned")
+	}
+}
+
+func TestCarSelectorQuery(t *testing.T) {
+	cids, err := test.RandomCids(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{}
+	query.Set(stopParam, cids[0].String())
+	query.Set(depthParam, "5")
+	sel, err := carSelector(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = selector.CompileSelector(sel); err != nil {
+		t.Fatal(err)
+	}
+	stopAt, err := sel.LookupByString(selector.SelectorKey_ExploreRecursive)
+	if err == nil {
+		stopAt, err = stopAt.LookupByString(selector.SelectorKey_StopAt)
+	}
+	if err != nil {
+		t.Fatal("selector has no stop condition:", err)
+	}
+
+	query.Set(depthParam, "-1")
+	if _, err = carSelector(query); err == nil {
+		t.Fatal("expected error for invalid depth")
+	}
+	query.Del(depthParam)
+	query.Set(stopParam, "bogus")
+	if _, err = carSelector(query); err == nil {
+		t.Fatal("expected error for invalid stop cid")
+	}
+}
+
+func TestStoreCarBlocksOnlySelected(t *testing.T) {
+	srcStore := datastore.NewMapDatastore()
+	chainLnks := test.MkChain(test.MkLinkSystem(srcStore), true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	otherData := []byte("not in chain")
+	otherCid, err := cid.Prefix{
+		Version:  1,
+		Codec:    cid.Raw,
+		MhType:   uint64(multicodec.Sha2_256),
+		MhLength: -1,
+	}.Sum(otherData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherLnk := cidlink.Link{Cid: otherCid}
+	if err = srcStore.Put(context.Background(), datastore.NewKey(otherLnk.String()), otherData); err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a CAR that holds the blocks of the chain and a block that the
+	// selector does not visit.
+	var buf bytes.Buffer
+	if err = writeCarHeader(&buf, headCid); err != nil {
+		t.Fatal(err)
+	}
+	results, err := srcStore.Query(context.Background(), query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for result := range results.Next() {
+		c, err := cid.Decode(strings.TrimPrefix(result.Key, "/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = writeCarBlock(&buf, c, result.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scratch, err := readCar(&buf, defaultMaxBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := scratch[otherCid]; !ok {
+		t.Fatal("expected unselected block to be read from car")
+	}
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	sync := NewSync(test.MkLinkSystem(dstStore), nil, nil)
+	defer sync.Close()
+	syncer, err := sync.NewSyncer(test.MkTestHost().ID(), multiaddr.StringCast("/ip4/127.0.0.1/tcp/1/http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssb := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel, err := selector.CompileSelector(ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syncer.storeCarBlocks(context.Background(), headCid, sel, scratch); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lnk := range chainLnks {
+		if has, _ := dstStore.Has(context.Background(), datastore.NewKey(lnk.String())); !has {
+			t.Fatal("selected block not stored", lnk)
+		}
+	}
+	if has, _ := dstStore.Has(context.Background(), datastore.NewKey(otherLnk.String())); has {
+		t.Fatal("block not visited by selector was stored")
+	}
+}
@@ -2,7 +2,9 @@ package httpsync
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 
 	"github.com/ipfs/go-cid"
@@ -11,8 +13,18 @@ import (
 	"github.com/ipld/go-ipld-prime/node/bindnode"
 	"github.com/ipld/go-ipld-prime/schema"
 	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
 )
 
+// blockSigDomain is prepended to a block's CID to create the data that is
+// signed for the block. This keeps a block signature from being valid as a
+// signature of the head, which is the signed CID alone.
+const blockSigDomain = "/legs/httpsync/block:"
+
+// ErrBlockSignature is returned when a block served by a publisher is not
+// signed, or its signature is not valid.
+var ErrBlockSignature = errors.New("missing or invalid block signature")
+
 var typeSystem *schema.TypeSystem = createTypeSystem()
 
 func createTypeSystem() *schema.TypeSystem {
@@ -122,3 +134,30 @@ func openSignedHeadEnvelop(pubKey ic.PubKey, envelop signedHead) (cid.Cid, error
 
 	return envelop.Head.Cid, err
 }
+
+// signBlock returns the base64 encoded signature for the block with CID c.
+func signBlock(c cid.Cid, privKey ic.PrivKey) (string, error) {
+	sig, err := privKey.Sign(blockSigData(c))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// verifyBlockSig checks that the base64 encoded signature, sig, is a valid
+// signature of the block with CID c by the peer with pubKey.
+func verifyBlockSig(pubKey ic.PubKey, peerID peer.ID, c cid.Cid, sig string) error {
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || len(sigBytes) == 0 {
+		return fmt.Errorf("%w for %s from %s", ErrBlockSignature, c, peerID)
+	}
+	ok, err := pubKey.Verify(blockSigData(c), sigBytes)
+	if err != nil || !ok {
+		return fmt.Errorf("%w for %s from %s", ErrBlockSignature, c, peerID)
+	}
+	return nil
+}
+
+func blockSigData(c cid.Cid) []byte {
+	return append([]byte(blockSigDomain), c.Bytes()...)
+}
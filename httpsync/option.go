@@ -0,0 +1,165 @@
+package httpsync
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-legs/internal/syncopt"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// config contains all options for configuring httpsync.publisher.
+type config struct {
+	allowPeer    func(peer.ID) bool
+	historyLimit int
+	historyDS    datastore.Datastore
+	signBlocks   bool
+	tlsConfig    *tls.Config
+}
+
+type Option func(*config) error
+
+// apply applies the given options to this config.
+func (c *config) apply(opts []Option) error {
+	for i, opt := range opts {
+		if err := opt(c); err != nil {
+			return fmt.Errorf("option %d failed: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// AllowPeer sets the function that determines whether to allow or reject
+// requests from a peer. When set, the publisher only serves requests that are
+// signed by the requesting peer, and the function allows. Subscribers sign
+// their requests when configured with SignRequests. Blocks are then marked as
+// private, so that they are not stored by shared caches.
+func AllowPeer(allowPeer func(peer.ID) bool) Option {
+	return func(c *config) error {
+		c.allowPeer = allowPeer
+		return nil
+	}
+}
+
+// HeadHistory makes the publisher keep a history of the limit most recent
+// heads, and serve it signed with the publisher's private key. See
+// Syncer.GetHeadHistory. If ds is not nil, then the history is stored in ds,
+// so that head sequence numbers continue from where they were when the
+// publisher restarts. Otherwise, the history is only kept in memory.
+func HeadHistory(limit int, ds datastore.Datastore) Option {
+	return func(c *config) error {
+		if limit < 1 {
+			return fmt.Errorf("head history limit must be at least 1")
+		}
+		c.historyLimit = limit
+		c.historyDS = ds
+		return nil
+	}
+}
+
+// SignBlocks makes the publisher sign each block that it serves, so that a
+// subscriber can verify that a block served by an intermediary, such as a
+// CDN or caching proxy, came from the publisher. See RequireSignedBlocks.
+func SignBlocks() Option {
+	return func(c *config) error {
+		c.signBlocks = true
+		return nil
+	}
+}
+
+// TLSConfig makes the publisher serve HTTPS using the TLS configuration, which
+// must provide the publisher's certificate. The publisher's address then has a
+// /tls/http component instead of /http.
+func TLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *config) error {
+		c.tlsConfig = tlsConfig
+		return nil
+	}
+}
+
+// TLSCertFiles makes the publisher serve HTTPS using the certificate and
+// private key in the PEM encoded files. See TLSConfig.
+func TLSCertFiles(certFile, keyFile string) Option {
+	return func(c *config) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		c.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+		return nil
+	}
+}
+
+// SyncOption is an option for configuring Sync.
+type SyncOption = syncopt.Option
+
+// BlockSizeHook sets a function that is called with the size of each block
+// fetched from a peer. Blocks that are already stored locally are not
+// reported.
+func BlockSizeHook(hook func(peer.ID, cid.Cid, uint64)) SyncOption {
+	return syncopt.BlockSizeHook(hook)
+}
+
+// RateLimitWaitHook sets a function that is called when a sync with a peer
+// waits for its rate limiter before fetching. The function is given the CID
+// being fetched, or cid.Undef when fetching the head, and the time that the
+// sync waits.
+func RateLimitWaitHook(hook func(peer.ID, cid.Cid, time.Duration)) SyncOption {
+	return syncopt.RateLimitWaitHook(hook)
+}
+
+// RateLimitBackoff configures how fetches that are rate limited are retried.
+// The wait before the first retry is minBackoff, and doubles with each retry up
+// to maxBackoff. A wait requested by the publisher, using a Retry-After header,
+// is also limited to maxBackoff. A fetch is retried at most maxRetries times.
+//
+// A minBackoff that is not positive leaves the default minimum backoff, a
+// maxBackoff less than the minimum backoff is raised to it, and a negative
+// maxRetries disables retries.
+func RateLimitBackoff(minBackoff, maxBackoff time.Duration, maxRetries int) SyncOption {
+	return syncopt.RateLimitBackoff(minBackoff, maxBackoff, maxRetries)
+}
+
+// MaxBlockSize sets the maximum size, in bytes, of a block fetched from a
+// peer. Fetching a larger block fails without reading more than maxSize bytes.
+func MaxBlockSize(maxSize int64) SyncOption {
+	return func(c *syncopt.Config) {
+		c.MaxBlockSize = maxSize
+	}
+}
+
+// FetchConcurrency sets the maximum number of blocks fetched from a peer at
+// the same time during a sync. Blocks linked to by a visited block, that the
+// selector explores, are fetched in parallel, ahead of the traversal that
+// visits them. The default is 4. With a value less than 2, blocks are fetched
+// one at a time. When fetching in parallel, the link system given to NewSync
+// must be safe for concurrent use.
+func FetchConcurrency(n int) SyncOption {
+	return func(c *syncopt.Config) {
+		c.FetchConcurrency = n
+	}
+}
+
+// RequireSignedBlocks makes a sync reject any block that is not signed by the
+// publisher being synced with. The publisher must use the SignBlocks option.
+// Since a CAR export is not signed, blocks are fetched individually.
+func RequireSignedBlocks() SyncOption {
+	return func(c *syncopt.Config) {
+		c.RequireSignedBlocks = true
+	}
+}
+
+// SignRequests makes a sync sign each request with the private key of the
+// subscriber's libp2p identity, so that a publisher configured with AllowPeer
+// can identify the subscriber.
+func SignRequests(privKey ic.PrivKey) SyncOption {
+	return func(c *syncopt.Config) {
+		c.RequestKey = privKey
+	}
+}
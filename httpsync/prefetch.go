@@ -0,0 +1,229 @@
+package httpsync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+)
+
+// defaultFetchConcurrency is the default number of blocks fetched at the same
+// time during a sync.
+const defaultFetchConcurrency = 4
+
+// prefetcher speculatively fetches the blocks linked to by blocks that a sync
+// visits, so that the traversal of the sync finds those blocks locally. Only
+// the links that the selector explores are fetched. The traversal still visits
+// blocks in selector order; only the fetching is done ahead of time.
+type prefetcher struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	syncer *Syncer
+	// sem limits the number of blocks fetched at the same time.
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	fetches map[cid.Cid]*prefetch
+	// selectors holds the selector that the traversal applies to each block
+	// whose links are to be prefetched.
+	selectors map[cid.Cid]selector.Selector
+	mutex     sync.Mutex
+}
+
+// prefetch is a fetch of a single block by the prefetcher.
+type prefetch struct {
+	// done is closed when the fetch is finished.
+	done chan struct{}
+}
+
+// newPrefetcher creates a prefetcher for the syncer's traversal of the DAG at
+// root with the selector sel, or returns nil if the fetch concurrency does not
+// allow fetching blocks in parallel.
+func (s *Syncer) newPrefetcher(ctx context.Context, root cid.Cid, sel selector.Selector) *prefetcher {
+	if s.sync.fetchConcurrency < 2 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &prefetcher{
+		ctx:     ctx,
+		cancel:  cancel,
+		syncer:  s,
+		sem:     make(chan struct{}, s.sync.fetchConcurrency),
+		fetches: make(map[cid.Cid]*prefetch),
+		selectors: map[cid.Cid]selector.Selector{
+			root: sel,
+		},
+	}
+}
+
+// close cancels any fetches in progress and waits for them to finish.
+func (p *prefetcher) close() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	p.wg.Wait()
+}
+
+// wait waits for any prefetch of the block c to finish.
+func (p *prefetcher) wait(c cid.Cid) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	pf, ok := p.fetches[c]
+	p.mutex.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case <-pf.done:
+	case <-p.ctx.Done():
+	}
+}
+
+// prefetchLinks reads the block data from r and starts fetching the blocks
+// that it links to and that the selector explores. Returns a reader of the
+// block data.
+func (p *prefetcher) prefetchLinks(l ipld.Link, r io.Reader) (io.Reader, error) {
+	if p == nil {
+		return r, nil
+	}
+	p.mutex.Lock()
+	sel, ok := p.selectors[l.(cidlink.Link).Cid]
+	p.mutex.Unlock()
+	if !ok {
+		return r, nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := p.syncer.sync.lsys.DecoderChooser(l)
+	if err != nil {
+		// The traversal reports that the block cannot be decoded.
+		return bytes.NewReader(data), nil
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err = decoder(nb, bytes.NewReader(data)); err == nil {
+		err = exploredLinks(nb.Build(), sel, func(c cid.Cid, next selector.Selector) {
+			p.mutex.Lock()
+			if _, ok := p.selectors[c]; !ok {
+				p.selectors[c] = next
+			}
+			p.mutex.Unlock()
+			p.start(c)
+		})
+		if err != nil {
+			// The traversal reports the error.
+			log.Debugw("Cannot find links to prefetch", "err", err, "cid", l)
+		}
+	}
+	return bytes.NewReader(data), nil
+}
+
+// exploredLinks calls found for each link within the block node n that the
+// selector s explores, with the selector that the traversal applies to the
+// linked block. This follows how traversal.WalkAdv explores a node, without
+// loading any links.
+func exploredLinks(n datamodel.Node, s selector.Selector, found func(cid.Cid, selector.Selector)) error {
+	if _, ok := s.(selector.Reifiable); ok {
+		// Links within an ADL cannot be found without reifying it.
+		return nil
+	}
+	switch n.Kind() {
+	case datamodel.Kind_Map, datamodel.Kind_List:
+	default:
+		return nil
+	}
+
+	explore := func(ps datamodel.PathSegment, v datamodel.Node) error {
+		next, err := s.Explore(n, ps)
+		if err != nil || next == nil {
+			return err
+		}
+		if v.Kind() == datamodel.Kind_Link {
+			lnk, _ := v.AsLink()
+			if cl, ok := lnk.(cidlink.Link); ok {
+				found(cl.Cid, next)
+			}
+			return nil
+		}
+		return exploredLinks(v, next, found)
+	}
+
+	attn := s.Interests()
+	if attn == nil {
+		for itr := selector.NewSegmentIterator(n); !itr.Done(); {
+			ps, v, err := itr.Next()
+			if err != nil {
+				return err
+			}
+			if err = explore(ps, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, ps := range attn {
+		v, err := n.LookupBySegment(ps)
+		if err != nil {
+			continue
+		}
+		if err = explore(ps, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start starts fetching the block c if it is not already being fetched.
+func (p *prefetcher) start(c cid.Cid) {
+	p.mutex.Lock()
+	if _, ok := p.fetches[c]; ok {
+		p.mutex.Unlock()
+		return
+	}
+	pf := &prefetch{
+		done: make(chan struct{}),
+	}
+	p.fetches[c] = pf
+	p.mutex.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(pf.done)
+
+		select {
+		case p.sem <- struct{}{}:
+		case <-p.ctx.Done():
+			return
+		}
+		defer func() { <-p.sem }()
+
+		lsys := p.syncer.sync.lsys
+		if r, err := lsys.StorageReadOpener(ipld.LinkContext{Ctx: p.ctx}, cidlink.Link{Cid: c}); err == nil {
+			// Already stored.
+			if closer, ok := r.(io.Closer); ok {
+				closer.Close()
+			}
+			return
+		}
+		err := p.syncer.retryRateLimited(p.ctx, c, func() error {
+			return p.syncer.fetchBlock(p.ctx, c)
+		})
+		if err != nil {
+			// The traversal fetches the block again if it needs it, and
+			// reports any error then.
+			log.Debugw("Failed to prefetch block", "err", err, "cid", c)
+		}
+	}()
+}
@@ -0,0 +1,215 @@
+package httpsync
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	maurl "github.com/filecoin-project/go-legs/httpsync/multiaddr"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorbuilder "github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestPrefetchKeepsTraversalOrder(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcLinkSys := test.MkLinkSystem(datastore.NewMapDatastore())
+	chainLnks := test.MkChain(srcLinkSys, true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	pub, err := NewPublisher("127.0.0.1:0", srcLinkSys, peerID, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	// Serve blocks slowly, without CAR export, and record the most blocks
+	// requested at the same time.
+	var inFlight, maxInFlight int
+	var mutex sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/"+carPath+"/") {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		pub.ServeHTTP(w, r)
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+	}))
+	defer ts.Close()
+	tsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := maurl.ToMultiaddr(tsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ssb := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+
+	// syncChain syncs the chain, starting with the given blocks already
+	// stored, and returns the traversal order and most parallel fetches.
+	syncChain := func(concurrency int, local ...ipld.Link) ([]cid.Cid, int) {
+		mutex.Lock()
+		maxInFlight = 0
+		mutex.Unlock()
+		var order []cid.Cid
+		blockHook := func(_ peer.ID, c cid.Cid) {
+			order = append(order, c)
+		}
+		dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+		for _, lnk := range local {
+			data, err := srcLinkSys.LoadRaw(ipld.LinkContext{}, lnk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = dstStore.Put(context.Background(), datastore.NewKey(lnk.String()), data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dstLinkSys := test.MkLinkSystem(dstStore)
+		sync := NewSync(dstLinkSys, nil, blockHook, FetchConcurrency(concurrency))
+		defer sync.Close()
+		syncer, err := sync.NewSyncer(peerID, addr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = syncer.Sync(context.Background(), headCid, sel); err != nil {
+			t.Fatal(err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		return order, maxInFlight
+	}
+
+	serialOrder, maxFetches := syncChain(1)
+	if maxFetches != 1 {
+		t.Fatal("expected blocks fetched one at a time, got", maxFetches)
+	}
+	parallelOrder, maxFetches := syncChain(4)
+	if maxFetches < 2 {
+		t.Fatal("expected blocks fetched in parallel")
+	}
+	if len(parallelOrder) != len(serialOrder) {
+		t.Fatal("parallel fetch visited a different number of blocks")
+	}
+	for i := range serialOrder {
+		if parallelOrder[i] != serialOrder[i] {
+			t.Fatal("parallel fetch changed traversal order")
+		}
+	}
+
+	// Check that the links of blocks that are already stored are also
+	// fetched in parallel. The last stored block links to two blocks that
+	// are not stored.
+	_, maxFetches = syncChain(4, chainLnks[0], chainLnks[1], chainLnks[2])
+	if maxFetches < 2 {
+		t.Fatal("expected links of stored blocks fetched in parallel")
+	}
+}
+
+func TestPrefetchOnlySelected(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcLinkSys := test.MkLinkSystem(datastore.NewMapDatastore())
+	headCid := test.MkChain(srcLinkSys, true)[0].(cidlink.Link).Cid
+	pub, err := NewPublisher("127.0.0.1:0", srcLinkSys, peerID, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	// Serve blocks without CAR export, and record the blocks requested.
+	requested := make(map[string]struct{})
+	var mutex sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/"+carPath+"/") {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		mutex.Lock()
+		requested[path.Base(r.URL.Path)] = struct{}{}
+		mutex.Unlock()
+		pub.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	tsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := maurl.ToMultiaddr(tsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	visited := make(map[string]struct{})
+	blockHook := func(_ peer.ID, c cid.Cid) {
+		visited[c.String()] = struct{}{}
+	}
+	dstLinkSys := test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore()))
+	sync := NewSync(dstLinkSys, nil, blockHook, FetchConcurrency(4))
+	defer sync.Close()
+	syncer, err := sync.NewSyncer(peerID, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Select the start of the chain, which links to blocks that are not
+	// selected.
+	ssb := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.ExploreRecursive(selector.RecursionLimitDepth(2), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	if err = syncer.Sync(context.Background(), headCid, sel); err != nil {
+		t.Fatal(err)
+	}
+	// The chain has 8 distinct blocks.
+	if len(visited) < 2 || len(visited) >= 8 {
+		t.Fatal("expected part of chain to be visited, got", len(visited))
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for c := range requested {
+		if c == "head" {
+			continue
+		}
+		if _, ok := visited[c]; !ok {
+			t.Fatal("prefetched block that selector does not visit:", c)
+		}
+	}
+}
@@ -6,18 +6,39 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/filecoin-project/go-legs/p2p/protocol/head"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	"github.com/ipld/go-ipld-prime"
-	"github.com/ipld/go-ipld-prime/codec/dagjson"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
-	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	ic "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/multiformats/go-multicodec"
+)
+
+const (
+	// rawContentType is the media type for a block served as raw bytes.
+	rawContentType = "application/vnd.ipld.raw"
+	// immutableCacheControl allows blocks to be cached indefinitely, since
+	// the data for a CID never changes.
+	immutableCacheControl = "public, max-age=29030400, immutable"
+	// privateCacheControl allows blocks to be cached indefinitely, but only
+	// by the subscriber, for a publisher that only serves allowed peers.
+	privateCacheControl = "private, max-age=29030400, immutable"
+	// signatureHeader is the response header that holds the publisher's
+	// signature of a served block.
+	signatureHeader = "X-Legs-Signature"
+	// historyPath is the path, under the publisher's root, of the signed head
+	// history.
+	historyPath = "history"
 )
 
 type publisher struct {
@@ -28,13 +49,28 @@ type publisher struct {
 	privKey ic.PrivKey
 	rl      sync.RWMutex
 	root    cid.Cid
+
+	allowPeer  func(peer.ID) bool
+	history    *head.History
+	signBlocks bool
+
+	// closed is set when the publisher is closed, after which it does not
+	// serve any requests.
+	closed    bool
+	closeOnce sync.Once
 }
 
 var _ http.Handler = (*publisher)(nil)
 
 // NewPublisher creates a new http publisher, listening on the specified
-// address.
-func NewPublisher(address string, lsys ipld.LinkSystem, peerID peer.ID, privKey ic.PrivKey) (*publisher, error) {
+// address. The publisher serves HTTPS if configured with TLSConfig or
+// TLSCertFiles.
+func NewPublisher(address string, lsys ipld.LinkSystem, peerID peer.ID, privKey ic.PrivKey, options ...Option) (*publisher, error) {
+	var cfg config
+	if err := cfg.apply(options); err != nil {
+		return nil, err
+	}
+
 	if privKey == nil {
 		return nil, errors.New("private key required to sign head requests")
 	}
@@ -50,25 +86,93 @@ func NewPublisher(address string, lsys ipld.LinkSystem, peerID peer.ID, privKey
 		return nil, err
 	}
 	proto, _ := multiaddr.NewMultiaddr("/http")
+	if cfg.tlsConfig != nil {
+		proto, _ = multiaddr.NewMultiaddr("/tls/http")
+	}
 
-	pub := &publisher{
-		addr:    multiaddr.Join(maddr, proto),
-		closer:  l,
-		lsys:    lsys,
-		peerID:  peerID,
-		privKey: privKey,
+	pub, err := newPublisher(multiaddr.Join(maddr, proto), lsys, peerID, privKey, cfg)
+	if err != nil {
+		l.Close()
+		return nil, err
 	}
 
 	// Run service on configured port.
 	server := &http.Server{
-		Handler: pub,
-		Addr:    l.Addr().String(),
+		Handler:   pub,
+		Addr:      l.Addr().String(),
+		TLSConfig: cfg.tlsConfig,
+	}
+	pub.closer = server
+	if cfg.tlsConfig != nil {
+		// Certificates are given by the TLS config.
+		go server.ServeTLS(l, "", "")
+	} else {
+		go server.Serve(l)
 	}
-	go server.Serve(l)
 
 	return pub, nil
 }
 
+// NewPublisherHandler creates a new http publisher that does not listen for
+// requests itself, so that it can be mounted as an http.Handler on an existing
+// server, under the path prefix. The address, addr, is the externally
+// reachable address of that server, such as "/dns/example.com/tcp/443/https".
+// The address of the publisher is addr with the path prefix added as an
+// httpath component.
+//
+// Closing the publisher does not affect the server; the publisher responds to
+// any further requests with a not found status.
+func NewPublisherHandler(addr multiaddr.Multiaddr, pathPrefix string, lsys ipld.LinkSystem, peerID peer.ID, privKey ic.PrivKey, options ...Option) (*publisher, error) {
+	var cfg config
+	if err := cfg.apply(options); err != nil {
+		return nil, err
+	}
+
+	if privKey == nil {
+		return nil, errors.New("private key required to sign head requests")
+	}
+	if addr == nil {
+		return nil, errors.New("server address required")
+	}
+	if cfg.tlsConfig != nil {
+		return nil, errors.New("tls is configured by the server that the publisher is mounted on")
+	}
+
+	if pathPrefix = path.Clean("/" + pathPrefix); pathPrefix != "/" {
+		httpath, err := multiaddr.NewComponent("httpath", url.PathEscape(pathPrefix))
+		if err != nil {
+			return nil, err
+		}
+		addr = multiaddr.Join(addr, httpath)
+	}
+
+	return newPublisher(addr, lsys, peerID, privKey, cfg)
+}
+
+func newPublisher(addr multiaddr.Multiaddr, lsys ipld.LinkSystem, peerID peer.ID, privKey ic.PrivKey, cfg config) (*publisher, error) {
+	pub := &publisher{
+		addr:    addr,
+		lsys:    lsys,
+		peerID:  peerID,
+		privKey: privKey,
+
+		allowPeer:  cfg.allowPeer,
+		signBlocks: cfg.signBlocks,
+	}
+	if cfg.historyLimit != 0 {
+		if cfg.historyDS != nil {
+			var err error
+			pub.history, err = head.LoadHistory(context.Background(), cfg.historyDS, "", cfg.historyLimit)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			pub.history = head.NewHistory(cfg.historyLimit)
+		}
+	}
+	return pub, nil
+}
+
 // Address returns the address, as a multiaddress, that the publisher is
 // listening on.
 func (p *publisher) Address() multiaddr.Multiaddr {
@@ -79,6 +183,9 @@ func (p *publisher) SetRoot(ctx context.Context, c cid.Cid) error {
 	p.rl.Lock()
 	defer p.rl.Unlock()
 	p.root = c
+	if p.history != nil {
+		return p.history.Add(c)
+	}
 	return nil
 }
 
@@ -90,22 +197,62 @@ func (p *publisher) UpdateRootWithAddrs(ctx context.Context, c cid.Cid, _ []mult
 	return p.UpdateRoot(ctx, c)
 }
 
+// Close stops the publisher from serving requests. If the publisher has its
+// own listener, then that is closed. It is safe to call Close more than once.
 func (p *publisher) Close() error {
-	return p.closer.Close()
+	var err error
+	p.closeOnce.Do(func() {
+		p.rl.Lock()
+		p.closed = true
+		p.rl.Unlock()
+		if p.closer != nil {
+			err = p.closer.Close()
+		}
+	})
+	return err
 }
 
 func (p *publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.rl.RLock()
+	closed := p.closed
+	p.rl.RUnlock()
+	if closed {
+		http.Error(w, "publisher closed", http.StatusNotFound)
+		return
+	}
+
+	if p.allowPeer != nil {
+		peerID, err := verifyRequest(r, p.peerID)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", authHeader)
+			http.Error(w, "request not authenticated", http.StatusUnauthorized)
+			log.Infow("Rejected unauthenticated request", "err", err, "path", r.URL.Path)
+			return
+		}
+		if !p.allowPeer(peerID) {
+			http.Error(w, "peer not allowed", http.StatusForbidden)
+			log.Infow("Rejected request from peer that is not allowed", "peer", peerID)
+			return
+		}
+	}
+
 	ask := path.Base(r.URL.Path)
+	if ask == historyPath {
+		p.serveHistory(w)
+		return
+	}
 	if ask == "head" {
 		// serve the
 		p.rl.RLock()
 		defer p.rl.RUnlock()
+		w.Header().Set(exportHeader, carExport)
 
 		marshalledMsg, err := newEncodedSignedHead(p.root, p.privKey)
 		if err != nil {
 			http.Error(w, "Failed to encode", http.StatusInternalServerError)
 			log.Errorw("Failed to serve root", "err", err)
 		} else {
+			w.Header().Set("Cache-Control", "no-cache")
 			_, _ = w.Write(marshalledMsg)
 		}
 		return
@@ -116,9 +263,19 @@ func (p *publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request: not a cid", http.StatusBadRequest)
 		return
 	}
-	item, err := p.lsys.Load(ipld.LinkContext{}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+	if path.Base(path.Dir(r.URL.Path)) == carPath {
+		p.serveCar(w, r, c)
+		return
+	}
+	contentType, ok := negotiateContentType(r.Header.Get("Accept"), c)
+	if !ok {
+		http.Error(w, "cannot serve block as any accepted type", http.StatusNotAcceptable)
+		return
+	}
+	// Serve the stored bytes, as they are, so the block round-trips exactly.
+	item, err := p.lsys.StorageReadOpener(ipld.LinkContext{Ctx: r.Context()}, cidlink.Link{Cid: c})
 	if err != nil {
-		if errors.Is(err, ipld.ErrNotExists{}) {
+		if isNotFound(err) {
 			http.Error(w, "cid not found", http.StatusNotFound)
 			return
 		}
@@ -126,8 +283,109 @@ func (p *publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		log.Errorw("Failed to load requested block", "err", err)
 		return
 	}
-	// marshal to json and serve.
-	_ = dagjson.Encode(item, w)
+	if closer, ok := item.(io.Closer); ok {
+		defer closer.Close()
+	}
+	// The data for a CID never changes, so the CID is used as the ETag. The
+	// block must exist for a cached copy of it to be confirmed as current.
+	etag := `"` + c.String() + `"`
+	cacheControl := immutableCacheControl
+	if p.allowPeer != nil {
+		// The response depends on who signed the request, so it must not be
+		// served from a shared cache.
+		cacheControl = privateCacheControl
+		w.Header().Set("Vary", "Accept, "+authHeader)
+	} else {
+		w.Header().Set("Vary", "Accept")
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if p.signBlocks {
+		sig, err := signBlock(c, p.privKey)
+		if err != nil {
+			http.Error(w, "unable to sign block", http.StatusInternalServerError)
+			log.Errorw("Failed to sign block", "err", err)
+			return
+		}
+		w.Header().Set(signatureHeader, sig)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	_, _ = io.Copy(w, item)
+}
+
+func (p *publisher) serveHistory(w http.ResponseWriter) {
+	if p.history == nil {
+		http.Error(w, "head history not enabled", http.StatusNotFound)
+		return
+	}
+	out, err := head.EncodeSignedHistory(p.history.Records(), p.privKey)
+	if err != nil {
+		http.Error(w, "Failed to encode", http.StatusInternalServerError)
+		log.Errorw("Failed to serve head history", "err", err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(out)
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, ipld.ErrNotExists{}) || errors.Is(err, datastore.ErrNotFound)
+}
 
-	// TODO: Sign message using publisher's private key.
+// codecContentType returns the media type for data encoded with the codec of
+// the CID.
+func codecContentType(c cid.Cid) string {
+	switch multicodec.Code(c.Prefix().Codec) {
+	case multicodec.Raw:
+		return rawContentType
+	case multicodec.DagCbor:
+		return "application/vnd.ipld.dag-cbor"
+	case multicodec.DagJson:
+		return "application/vnd.ipld.dag-json"
+	}
+	return "application/octet-stream"
+}
+
+// negotiateContentType returns the content type to serve the block for the
+// CID with, given the request's Accept header. The block can be served as the
+// media type of its codec, or as a raw block. Returns false if neither is
+// acceptable. A media range with a quality of zero is not acceptable.
+func negotiateContentType(accept string, c cid.Cid) (string, bool) {
+	codecType := codecContentType(c)
+	if accept == "" {
+		return codecType, true
+	}
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mediaType := params[0]
+		if zeroQuality(params[1:]) {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case codecType, "*/*", "application/*":
+			return codecType, true
+		case rawContentType:
+			return rawContentType, true
+		}
+	}
+	return "", false
+}
+
+// zeroQuality returns true if the media range parameters give a quality of
+// zero, meaning that the media range is not acceptable.
+func zeroQuality(params []string) bool {
+	for _, param := range params {
+		param = strings.TrimSpace(param)
+		if len(param) < 2 || !strings.EqualFold(param[:2], "q=") {
+			continue
+		}
+		q, err := strconv.ParseFloat(param[2:], 64)
+		return err == nil && q == 0
+	}
+	return false
 }
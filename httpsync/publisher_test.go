@@ -0,0 +1,378 @@
+package httpsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	maurl "github.com/filecoin-project/go-legs/httpsync/multiaddr"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorbuilder "github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multicodec"
+)
+
+func TestPublisherServesRawBlocks(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := datastore.NewMapDatastore()
+	lsys := test.MkLinkSystem(store)
+	lp := cidlink.LinkPrototype{
+		Prefix: cid.Prefix{
+			Version:  1,
+			Codec:    uint64(multicodec.DagCbor),
+			MhType:   uint64(multicodec.Sha2_256),
+			MhLength: -1,
+		},
+	}
+	lnk, err := lsys.Store(ipld.LinkContext{}, lp, basicnode.NewString("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := lnk.(cidlink.Link).Cid
+	stored, err := store.Get(context.Background(), datastore.NewKey(c.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := NewPublisher("127.0.0.1:0", lsys, peerID, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	pubURL, err := maurl.ToURL(pub.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockURL := pubURL.String() + "/" + c.String()
+
+	get := func(header http.Header) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", blockURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	// Without an Accept header, the block is served as its codec type.
+	resp, body := get(http.Header{})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status", resp.StatusCode)
+	}
+	if !bytes.Equal(body, stored) {
+		t.Fatal("served block does not match stored block")
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/vnd.ipld.dag-cbor" {
+		t.Fatal("unexpected content type", ct)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag != `"`+c.String()+`"` {
+		t.Fatal("unexpected etag", etag)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != immutableCacheControl {
+		t.Fatal("unexpected cache control", cc)
+	}
+
+	resp, body = get(http.Header{"Accept": {"text/html, application/vnd.ipld.raw;q=0.9"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status", resp.StatusCode)
+	}
+	if !bytes.Equal(body, stored) {
+		t.Fatal("served block does not match stored block")
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != rawContentType {
+		t.Fatal("unexpected content type", ct)
+	}
+
+	resp, _ = get(http.Header{"Accept": {"application/vnd.ipld.dag-json"}})
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Fatal("expected not acceptable status, got", resp.StatusCode)
+	}
+
+	// A media range with zero quality is not acceptable.
+	resp, _ = get(http.Header{"Accept": {"application/vnd.ipld.raw;q=0"}})
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Fatal("expected not acceptable status, got", resp.StatusCode)
+	}
+	resp, _ = get(http.Header{"Accept": {"application/vnd.ipld.dag-cbor; q=0.0, application/vnd.ipld.raw"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != rawContentType {
+		t.Fatal("unexpected content type", ct)
+	}
+
+	resp, body = get(http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatal("expected not modified status, got", resp.StatusCode)
+	}
+	if len(body) != 0 {
+		t.Fatal("expected empty body for not modified response")
+	}
+
+	// Check that a missing block is not found.
+	cids, err := test.RandomCids(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockURL = pubURL.String() + "/" + cids[0].String()
+	resp, _ = get(http.Header{})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected not found status, got", resp.StatusCode)
+	}
+	// A cached copy of a missing block is not confirmed as current.
+	resp, _ = get(http.Header{"If-None-Match": {`"` + cids[0].String() + `"`}})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected not found status, got", resp.StatusCode)
+	}
+}
+
+func TestPublisherHandler(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcLinkSys := test.MkLinkSystem(datastore.NewMapDatastore())
+	headCid := test.MkChain(srcLinkSys, true)[0].(cidlink.Link).Cid
+
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	tsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr, err := maurl.ToMultiaddr(tsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := NewPublisherHandler(serverAddr, "/legs/pub", srcLinkSys, peerID, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle("/legs/pub/", pub)
+	if err = pub.SetRoot(context.Background(), headCid); err != nil {
+		t.Fatal(err)
+	}
+
+	pubURL, err := maurl.ToURL(pub.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pubURL.String() != ts.URL+"/legs/pub" {
+		t.Fatal("unexpected publisher url", pubURL)
+	}
+
+	sync := NewSync(test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore())), nil, nil)
+	defer sync.Close()
+	syncer, err := sync.NewSyncer(peerID, pub.Address(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := syncer.GetHead(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != headCid {
+		t.Fatal("unexpected head", head)
+	}
+	ssb := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	if err = syncer.Sync(context.Background(), headCid, sel); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that the closed publisher does not serve requests, and that the
+	// server keeps running.
+	if err = pub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(pubURL.String() + "/head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected not found status from closed publisher, got", resp.StatusCode)
+	}
+}
+
+func TestPublisherHeadHistory(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcLinkSys := test.MkLinkSystem(datastore.NewMapDatastore())
+	chainLnks := test.MkChain(srcLinkSys, true)
+
+	pub, err := NewPublisher("127.0.0.1:0", srcLinkSys, peerID, privKey, HeadHistory(2, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	sync := NewSync(test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore())), nil, nil)
+	defer sync.Close()
+	syncer, err := sync.NewSyncer(peerID, pub.Address(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := syncer.GetHeadHistory(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatal("expected empty history, got", len(records))
+	}
+
+	// Publish the chain from oldest to latest.
+	for i := len(chainLnks) - 1; i >= 0; i-- {
+		if err = pub.SetRoot(context.Background(), chainLnks[i].(cidlink.Link).Cid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err = syncer.GetHeadHistory(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatal("expected 2 history records, got", len(records))
+	}
+	if records[0].Cid != chainLnks[1].(cidlink.Link).Cid || records[1].Cid != chainLnks[0].(cidlink.Link).Cid {
+		t.Fatal("history does not hold the latest heads")
+	}
+	if records[0].Seq != 3 || records[1].Seq != 4 {
+		t.Fatal("unexpected sequence numbers", records[0].Seq, records[1].Seq)
+	}
+
+	// A syncer expecting a different publisher rejects the history.
+	otherSyncer, err := sync.NewSyncer(test.MkTestHost().ID(), pub.Address(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = otherSyncer.GetHeadHistory(context.Background()); err != errHistoryFromUnexpectedPeer {
+		t.Fatal("expected history from unexpected peer error, got", err)
+	}
+}
+
+func TestPublisherHeadHistoryDisabled(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := NewPublisher("127.0.0.1:0", test.MkLinkSystem(datastore.NewMapDatastore()), peerID, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	sync := NewSync(test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore())), nil, nil)
+	defer sync.Close()
+	syncer, err := sync.NewSyncer(peerID, pub.Address(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = syncer.GetHeadHistory(context.Background()); err == nil {
+		t.Fatal("expected error getting history from publisher without history")
+	}
+}
+
+func TestPublisherPrivateCache(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subPrivKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsys := test.MkLinkSystem(datastore.NewMapDatastore())
+	headCid := test.MkChain(lsys, true)[0].(cidlink.Link).Cid
+
+	pub, err := NewPublisher("127.0.0.1:0", lsys, peerID, privKey, AllowPeer(func(peer.ID) bool { return true }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	pubURL, err := maurl.ToURL(pub.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", pubURL.String()+"/"+headCid.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = signRequest(req, peerID, subPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status", resp.StatusCode)
+	}
+	// A block served only to allowed peers must not be cached by a shared
+	// cache.
+	if cc := resp.Header.Get("Cache-Control"); cc != privateCacheControl {
+		t.Fatal("unexpected cache control", cc)
+	}
+	if vary := resp.Header.Get("Vary"); !strings.Contains(vary, authHeader) {
+		t.Fatal("response does not vary by request signature:", vary)
+	}
+}
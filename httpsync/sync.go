@@ -8,9 +8,12 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"time"
 
 	maurl "github.com/filecoin-project/go-legs/httpsync/multiaddr"
+	"github.com/filecoin-project/go-legs/internal/syncopt"
+	"github.com/filecoin-project/go-legs/p2p/protocol/head"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime"
@@ -25,27 +28,93 @@ import (
 	"golang.org/x/time/rate"
 )
 
-const defaultHttpTimeout = 10 * time.Second
+const (
+	// defaultHttpTimeout is the time to wait for the headers of a response,
+	// and for each read of the response body, so that a large response that
+	// keeps arriving is not cut off.
+	defaultHttpTimeout = 10 * time.Second
+
+	// Defaults for backing off when rate limited by the publisher.
+	defaultRateLimitMinBackoff = time.Second
+	defaultRateLimitMaxBackoff = time.Minute
+	defaultRateLimitRetries    = 10
+
+	// defaultMaxBlockSize is the default limit on the size of a fetched block.
+	defaultMaxBlockSize = 4 << 20
+)
 
 var log = logging.Logger("go-legs-httpsync")
 
+// ErrBlockTooLarge is returned when a block fetched from a publisher is larger
+// than the maximum block size.
+var ErrBlockTooLarge = errors.New("block exceeds maximum size")
+
 // Sync provides sync functionality for use with all http syncs.
 type Sync struct {
 	blockHook func(peer.ID, cid.Cid)
 	client    *http.Client
 	lsys      ipld.LinkSystem
+
+	blockSizeHook     func(peer.ID, cid.Cid, uint64)
+	rateLimitWaitHook func(peer.ID, cid.Cid, time.Duration)
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	maxRetries int
+
+	maxBlockSize     int64
+	fetchConcurrency int
+
+	requireSignedBlocks bool
+	requestKey          ic.PrivKey
+
+	// carExports is whether each publisher supports CAR export.
+	carExports carExports
 }
 
-func NewSync(lsys ipld.LinkSystem, client *http.Client, blockHook func(peer.ID, cid.Cid)) *Sync {
+func NewSync(lsys ipld.LinkSystem, client *http.Client, blockHook func(peer.ID, cid.Cid), options ...SyncOption) *Sync {
+	cfg := syncopt.Config{
+		MinBackoff: defaultRateLimitMinBackoff,
+		MaxBackoff: defaultRateLimitMaxBackoff,
+		MaxRetries: defaultRateLimitRetries,
+
+		MaxBlockSize:     defaultMaxBlockSize,
+		FetchConcurrency: defaultFetchConcurrency,
+	}
+	cfg.Apply(options)
+
 	if client == nil {
+		// Keep enough idle connections to reuse one for each parallel fetch.
+		// HTTP/2 is used when the publisher supports it over TLS, which
+		// multiplexes the parallel fetches over a single connection.
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if cfg.FetchConcurrency > transport.MaxIdleConnsPerHost {
+			transport.MaxIdleConnsPerHost = cfg.FetchConcurrency
+		}
+		// The response body is given a timeout for each read, instead of the
+		// client having a timeout for the whole response. See fetchResponse.
+		transport.ResponseHeaderTimeout = defaultHttpTimeout
 		client = &http.Client{
-			Timeout: defaultHttpTimeout,
+			Transport: transport,
 		}
 	}
 	return &Sync{
 		blockHook: blockHook,
 		client:    client,
 		lsys:      lsys,
+
+		blockSizeHook:     cfg.BlockSizeHook,
+		rateLimitWaitHook: cfg.RateLimitWaitHook,
+
+		minBackoff: cfg.MinBackoff,
+		maxBackoff: cfg.MaxBackoff,
+		maxRetries: cfg.MaxRetries,
+
+		maxBlockSize:     cfg.MaxBlockSize,
+		fetchConcurrency: cfg.FetchConcurrency,
+
+		requireSignedBlocks: cfg.RequireSignedBlocks,
+		requestKey:          cfg.RequestKey,
 	}
 }
 
@@ -68,22 +137,44 @@ func (s *Sync) Close() {
 	s.client.CloseIdleConnections()
 }
 
-var errHeadFromUnexpectedPeer = errors.New("found head signed from an unexpected peer")
+var (
+	errHeadFromUnexpectedPeer    = errors.New("found head signed from an unexpected peer")
+	errHistoryFromUnexpectedPeer = errors.New("found head history signed from an unexpected peer")
+)
+
+// BlockMismatchError is returned when the data of a block fetched from a peer
+// does not hash to the block's CID.
+type BlockMismatchError struct {
+	// PeerID is the peer that the block was fetched from.
+	PeerID peer.ID
+	// Cid is the CID of the requested block.
+	Cid cid.Cid
+}
+
+func (e *BlockMismatchError) Error() string {
+	return fmt.Sprintf("block data from %s does not match cid %s", e.PeerID, e.Cid)
+}
 
 type Syncer struct {
 	peerID      peer.ID
 	rateLimiter *rate.Limiter
 	rootURL     url.URL
 	sync        *Sync
+
+	// pubKey is the publisher's public key, once known.
+	pubKey ic.PubKey
 }
 
 func (s *Syncer) GetHead(ctx context.Context) (cid.Cid, error) {
 	var head cid.Cid
 	var pubKey ic.PubKey
-	err := s.fetch(ctx, "head", func(msg io.Reader) error {
-		var err error
-		pubKey, head, err = openSignedHeadWithIncludedPubKey(msg)
-		return err
+	err := s.retryRateLimited(ctx, cid.Undef, func() error {
+		return s.fetchResponse(ctx, "head", nil, "", cid.Undef, func(resp *http.Response) error {
+			s.setCarExport(resp.Header)
+			var err error
+			pubKey, head, err = openSignedHeadWithIncludedPubKey(resp.Body)
+			return err
+		})
 	})
 
 	if err != nil {
@@ -98,10 +189,53 @@ func (s *Syncer) GetHead(ctx context.Context) (cid.Cid, error) {
 	if peerIDFromSig != s.peerID {
 		return cid.Undef, errHeadFromUnexpectedPeer
 	}
+	s.pubKey = pubKey
 
 	return head, nil
 }
 
+// GetHeadHistory gets the publisher's signed history of heads, from oldest to
+// latest. The publisher must be configured with the HeadHistory option.
+func (s *Syncer) GetHeadHistory(ctx context.Context) ([]head.HeadRecord, error) {
+	var records []head.HeadRecord
+	err := s.retryRateLimited(ctx, cid.Undef, func() error {
+		return s.fetchResponse(ctx, historyPath, nil, "", cid.Undef, func(resp *http.Response) error {
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return err
+			}
+			signer, recs, err := head.DecodeSignedHistory(data)
+			if err != nil {
+				return err
+			}
+			if signer != s.peerID {
+				return errHistoryFromUnexpectedPeer
+			}
+			records = recs
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// loadPubKey gets the publisher's public key, needed to verify block
+// signatures. The key is taken from the peer ID if it is embedded there, and
+// otherwise from the publisher's signed head.
+func (s *Syncer) loadPubKey(ctx context.Context) error {
+	pubKey, err := s.peerID.ExtractPublicKey()
+	if err == nil {
+		s.pubKey = pubKey
+		return nil
+	}
+	if _, err = s.GetHead(ctx); err != nil {
+		return fmt.Errorf("cannot get public key of %s: %w", s.peerID, err)
+	}
+	return nil
+}
+
 func (s *Syncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error {
 	xsel, err := selector.CompileSelector(sel)
 	if err != nil {
@@ -110,11 +244,25 @@ func (s *Syncer) Sync(ctx context.Context, nextCid cid.Cid, sel ipld.Node) error
 		return errors.New(msg)
 	}
 
+	if s.sync.requireSignedBlocks && s.pubKey == nil {
+		if err = s.loadPubKey(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Fetch as many blocks as possible in a single CAR export. Any blocks that
+	// are missing after this are fetched one at a time by walkFetch.
+	if !s.sync.requireSignedBlocks && s.supportsCarExport(ctx) {
+		if err = s.fetchCar(ctx, nextCid, sel); err != nil {
+			log.Warnw("Failed to fetch CAR export; fetching blocks individually", "err", err, "root", nextCid)
+		}
+	}
+
 	cids, err := s.walkFetch(ctx, nextCid, xsel)
 	if err != nil {
 		msg := "failed to traverse requested dag"
 		log.Errorw(msg, "err", err, "root", nextCid)
-		return errors.New(msg)
+		return fmt.Errorf("%s: %w", msg, err)
 	}
 
 	// We run the block hook to emulate the behavior of graphsync's
@@ -148,36 +296,41 @@ func (s *Syncer) walkFetch(ctx context.Context, rootCid cid.Cid, sel selector.Se
 	// we have the block locally.
 	var traversalOrder []cid.Cid
 	getMissingLs := cidlink.DefaultLinkSystem()
-	// trusted because it'll be hashed/verified on the way into the link system when fetched.
+	// trusted because fetchBlock verifies each block against its CID before
+	// storing it in the link system.
 	getMissingLs.TrustedStorage = true
+	// Fetch the blocks linked to by each fetched block in parallel, so that
+	// the traversal finds most blocks locally.
+	pf := s.newPrefetcher(ctx, rootCid, sel)
+	defer pf.close()
 	getMissingLs.StorageReadOpener = func(lc ipld.LinkContext, l ipld.Link) (io.Reader, error) {
 		c := l.(cidlink.Link).Cid
+		pf.wait(c)
 		r, err := s.sync.lsys.StorageReadOpener(lc, l)
 		if err == nil {
-			// Found block read opener, so return it.
+			// Found block read opener, so return it. The blocks that a
+			// local block links to may still need to be fetched, so
+			// prefetch them too.
 			traversalOrder = append(traversalOrder, c)
-			return r, nil
+			return pf.prefetchLinks(l, r)
 		}
 
 		// Did not find block read opener, so fetch block via HTTP with re-try in case rate limit is
 		// reached.
-		for {
-			if err = s.fetchBlock(ctx, c); err != nil {
-				log.Errorw("Failed to fetch block", "err", err, "cid", c)
-				if _, ok := err.(rateLimitErr); ok {
-					// TODO: implement backoff to avoid potentially exhausting the HTTP source.
-					continue
-				}
-				return nil, err
-			}
-			break
+		err = s.retryRateLimited(ctx, c, func() error {
+			return s.fetchBlock(ctx, c)
+		})
+		if err != nil {
+			log.Errorw("Failed to fetch block", "err", err, "cid", c)
+			return nil, err
 		}
 
 		r, err = s.sync.lsys.StorageReadOpener(lc, l)
-		if err == nil {
-			traversalOrder = append(traversalOrder, c)
+		if err != nil {
+			return nil, err
 		}
-		return r, err
+		traversalOrder = append(traversalOrder, c)
+		return pf.prefetchLinks(l, r)
 	}
 
 	progress := traversal.Progress{
@@ -206,45 +359,195 @@ type rateLimitErr struct {
 	resource string
 	rootURL  url.URL
 	source   peer.ID
+	// retryAfter is the wait time requested by the publisher, if any.
+	retryAfter time.Duration
+	// local is true if the local rate limiter was exhausted, as opposed to
+	// the publisher responding that it is rate limiting.
+	local bool
 }
 
-func (r rateLimitErr) Error() string {
+func (r *rateLimitErr) Error() string {
 	return fmt.Sprintf("rate limit reached when fetching %s from %s at %s", r.resource, r.source, r.rootURL.String())
 }
 
-func (s *Syncer) fetch(ctx context.Context, rsrc string, cb func(io.Reader) error) error {
+// retryRateLimited calls fetch, and calls it again after waiting if it fails
+// due to rate limiting. The time waited after each attempt doubles, starting
+// at the minimum backoff, unless the publisher requested a specific wait time
+// with a Retry-After header. As with dtsync, hitting the local rate limit
+// waits until the rate limiter is refilled.
+func (s *Syncer) retryRateLimited(ctx context.Context, c cid.Cid, fetch func() error) error {
+	backoff := s.sync.minBackoff
+	for retries := 0; ; retries++ {
+		err := fetch()
+		var rlErr *rateLimitErr
+		if err == nil || !errors.As(err, &rlErr) || retries >= s.sync.maxRetries {
+			return err
+		}
+
+		var waitTime time.Duration
+		switch {
+		case rlErr.retryAfter != 0:
+			waitTime = rlErr.retryAfter
+		case rlErr.local && s.rateLimiter != nil:
+			waitTime = syncopt.RefillWait(s.rateLimiter)
+		default:
+			waitTime = backoff
+		}
+		if waitTime > s.sync.maxBackoff {
+			waitTime = s.sync.maxBackoff
+		}
+		backoff *= 2
+		if backoff > s.sync.maxBackoff {
+			backoff = s.sync.maxBackoff
+		}
+
+		log.Infow("Hit rate limit. Waiting and will retry later", "resource", rlErr.resource, "source_peer", s.peerID, "delay", waitTime.String())
+		if s.sync.rateLimitWaitHook != nil {
+			s.sync.rateLimitWaitHook(s.peerID, c, waitTime)
+		}
+		t := time.NewTimer(waitTime)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// parseRetryAfter returns the wait time given by a Retry-After header value,
+// which is either a number of seconds or an HTTP date. Returns zero if the
+// value is empty or invalid.
+func parseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(val); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// fetchResponse gets the resource rsrc, with the query and Accept header if
+// given, and passes the successful response to cb. The CID c is the CID being
+// fetched, or is undefined if not fetching a CID.
+func (s *Syncer) fetchResponse(ctx context.Context, rsrc string, query url.Values, accept string, c cid.Cid, cb func(*http.Response) error) error {
 	localURL := s.rootURL
 	localURL.Path = path.Join(s.rootURL.Path, rsrc)
+	if query != nil {
+		localURL.RawQuery = query.Encode()
+	}
 
 	if s.rateLimiter != nil {
-		err := s.rateLimiter.Wait(ctx)
+		err := s.waitRateLimit(ctx, c)
 		if err != nil {
 			return &rateLimitErr{
 				resource: rsrc,
 				rootURL:  s.rootURL,
 				source:   s.peerID,
+				local:    true,
 			}
 		}
 	}
 
+	// Cancel the request if reading its response stalls.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	req, err := http.NewRequestWithContext(ctx, "GET", localURL.String(), nil)
 	if err != nil {
 		return err
 	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if s.sync.requestKey != nil {
+		if err = signRequest(req, s.peerID, s.sync.requestKey); err != nil {
+			return err
+		}
+	}
 
 	resp, err := s.sync.client.Do(req)
 	if err != nil {
 		log.Errorw("Failed to execute fetch request", "err", err)
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return &rateLimitErr{
+			resource:   rsrc,
+			rootURL:    s.rootURL,
+			source:     s.peerID,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	default:
 		err := fmt.Errorf("non success http code at %s: %d", localURL.String(), resp.StatusCode)
 		log.Errorw("Fetch was not successful", "err", err)
 		return err
 	}
 
-	defer resp.Body.Close()
-	return cb(resp.Body)
+	timer := time.AfterFunc(defaultHttpTimeout, cancel)
+	defer timer.Stop()
+	resp.Body = &idleTimeoutReader{
+		ReadCloser: resp.Body,
+		timer:      timer,
+		timeout:    defaultHttpTimeout,
+	}
+	return cb(resp)
+}
+
+// idleTimeoutReader restarts its timer after each read, so that the timer only
+// fires if reading stalls for longer than the timeout.
+type idleTimeoutReader struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.timer.Reset(r.timeout)
+	return n, err
+}
+
+// waitRateLimit waits until the rate limiter allows another fetch, and reports
+// any wait to the rate limit wait hook.
+func (s *Syncer) waitRateLimit(ctx context.Context, c cid.Cid) error {
+	r := s.rateLimiter.Reserve()
+	if !r.OK() {
+		return errors.New("rate limiter burst is zero")
+	}
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	if dl, ok := ctx.Deadline(); ok && time.Until(dl) < delay {
+		r.Cancel()
+		return errors.New("rate limit wait exceeds context deadline")
+	}
+	if s.sync.rateLimitWaitHook != nil {
+		s.sync.rateLimitWaitHook(s.peerID, c, delay)
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
 }
 
 // fetchBlock fetches an item into the datastore at c if not locally available.
@@ -255,20 +558,58 @@ func (s *Syncer) fetchBlock(ctx context.Context, c cid.Cid) error {
 		return nil
 	}
 
-	return s.fetch(ctx, c.String(), func(data io.Reader) error {
-		writer, committer, err := s.sync.lsys.StorageWriteOpener(ipld.LinkContext{})
-		if err != nil {
-			log.Errorw("Failed to get write opener", "err", err)
-			return err
-		}
-		if _, err := io.Copy(writer, data); err != nil {
-			return err
+	// Ask for the block exactly as stored, so that it hashes to its CID.
+	return s.fetchResponse(ctx, c.String(), nil, rawContentType, c, func(resp *http.Response) error {
+		if s.sync.requireSignedBlocks {
+			err := verifyBlockSig(s.pubKey, s.peerID, c, resp.Header.Get(signatureHeader))
+			if err != nil {
+				log.Errorw("Fetched block failed verification", "err", err)
+				return err
+			}
 		}
-		err = committer(cidlink.Link{Cid: c})
+		// Read at most one byte more than the limit to detect an oversized block.
+		data, err := io.ReadAll(io.LimitReader(resp.Body, s.sync.maxBlockSize+1))
 		if err != nil {
-			log.Errorw("Failed to commit ")
 			return err
 		}
-		return nil
+		if int64(len(data)) > s.sync.maxBlockSize {
+			return fmt.Errorf("%w: %s from %s is larger than %d bytes", ErrBlockTooLarge, c, s.peerID, s.sync.maxBlockSize)
+		}
+		return s.storeBlock(c, data)
 	})
 }
+
+// storeBlock checks that the data hashes to the CID c, and then stores the
+// data as the block for c.
+func (s *Syncer) storeBlock(c cid.Cid, data []byte) error {
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !sum.Equals(c) {
+		err = &BlockMismatchError{
+			PeerID: s.peerID,
+			Cid:    c,
+		}
+		log.Errorw("Fetched block failed verification", "err", err)
+		return err
+	}
+
+	writer, committer, err := s.sync.lsys.StorageWriteOpener(ipld.LinkContext{})
+	if err != nil {
+		log.Errorw("Failed to get write opener", "err", err)
+		return err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return err
+	}
+	err = committer(cidlink.Link{Cid: c})
+	if err != nil {
+		log.Errorw("Failed to commit ")
+		return err
+	}
+	if s.sync.blockSizeHook != nil {
+		s.sync.blockSizeHook(s.peerID, c, uint64(len(data)))
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package httpsync
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	maurl "github.com/filecoin-project/go-legs/httpsync/multiaddr"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorbuilder "github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter(""); d != 0 {
+		t.Fatal("expected zero wait for empty value, got", d)
+	}
+	if d := parseRetryAfter("bogus"); d != 0 {
+		t.Fatal("expected zero wait for invalid value, got", d)
+	}
+	if d := parseRetryAfter("-3"); d != 0 {
+		t.Fatal("expected zero wait for negative value, got", d)
+	}
+	if d := parseRetryAfter("3"); d != 3*time.Second {
+		t.Fatal("expected 3s wait, got", d)
+	}
+	d := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if d <= 59*time.Minute || d > time.Hour {
+		t.Fatal("expected wait of about 1h, got", d)
+	}
+}
+
+func TestRateLimitBackoff(t *testing.T) {
+	srcStore := datastore.NewMapDatastore()
+	srcLinkSys := test.MkLinkSystem(srcStore)
+	headCid := test.MkChain(srcLinkSys, true)[0].(cidlink.Link).Cid
+	data, err := srcStore.Get(context.Background(), datastore.NewKey(headCid.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const limitedRequests = 3
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimPrefix(r.URL.Path, "/") != headCid.String() {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		requests++
+		if requests <= limitedRequests {
+			http.Error(w, "", http.StatusTooManyRequests)
+			return
+		}
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	var waits []time.Duration
+	waitHook := func(_ peer.ID, _ cid.Cid, wait time.Duration) {
+		waits = append(waits, wait)
+	}
+	dstLinkSys := test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore()))
+	sync := NewSync(dstLinkSys, nil, nil, RateLimitWaitHook(waitHook), RateLimitBackoff(time.Millisecond, 3*time.Millisecond, limitedRequests))
+	defer sync.Close()
+
+	tsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := maurl.ToMultiaddr(tsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncer, err := sync.NewSyncer(test.MkTestHost().ID(), addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = syncer.retryRateLimited(context.Background(), headCid, func() error {
+		return syncer.fetchBlock(context.Background(), headCid)
+	})
+	if err != nil {
+		t.Fatal("expected fetch to succeed after retries:", err)
+	}
+	expectWaits := []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond}
+	if len(waits) != len(expectWaits) {
+		t.Fatalf("expected %d waits, got %d", len(expectWaits), len(waits))
+	}
+	for i := range waits {
+		if waits[i] != expectWaits[i] {
+			t.Fatalf("expected wait %s, got %s", expectWaits[i], waits[i])
+		}
+	}
+
+	// Check that fetching gives up after the maximum number of retries.
+	requests = 0
+	sync = NewSync(test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore())), nil, nil, RateLimitBackoff(time.Millisecond, time.Millisecond, limitedRequests-1))
+	defer sync.Close()
+	syncer, err = sync.NewSyncer(test.MkTestHost().ID(), addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncer.retryRateLimited(context.Background(), headCid, func() error {
+		return syncer.fetchBlock(context.Background(), headCid)
+	})
+	var rlErr *rateLimitErr
+	if !errors.As(err, &rlErr) {
+		t.Fatal("expected rate limit error after exceeding retries, got", err)
+	}
+	if requests != limitedRequests {
+		t.Fatalf("expected %d requests, got %d", limitedRequests, requests)
+	}
+}
+
+func TestRateLimitBackoffClamped(t *testing.T) {
+	sync := NewSync(test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore())), nil, nil, RateLimitBackoff(0, -time.Second, -1))
+	defer sync.Close()
+	if sync.minBackoff != defaultRateLimitMinBackoff {
+		t.Fatalf("expected minimum backoff %s, got %s", defaultRateLimitMinBackoff, sync.minBackoff)
+	}
+	if sync.maxBackoff != sync.minBackoff {
+		t.Fatalf("expected maximum backoff %s, got %s", sync.minBackoff, sync.maxBackoff)
+	}
+	if sync.maxRetries != 0 {
+		t.Fatalf("expected no retries, got %d", sync.maxRetries)
+	}
+
+	sync = NewSync(test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore())), nil, nil, RateLimitBackoff(time.Second, time.Millisecond, 3))
+	defer sync.Close()
+	if sync.maxBackoff != time.Second {
+		t.Fatalf("expected maximum backoff raised to %s, got %s", time.Second, sync.maxBackoff)
+	}
+}
+
+func TestFetchBlockVerification(t *testing.T) {
+	srcStore := datastore.NewMapDatastore()
+	chainLnks := test.MkChain(test.MkLinkSystem(srcStore), true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	otherCid := chainLnks[1].(cidlink.Link).Cid
+	// Serve the data of a different block in place of the requested block.
+	data, err := srcStore.Get(context.Background(), datastore.NewKey(otherCid.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer ts.Close()
+	tsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := maurl.ToMultiaddr(tsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	sync := NewSync(test.MkLinkSystem(dstStore), nil, nil)
+	defer sync.Close()
+	pubID := test.MkTestHost().ID()
+	syncer, err := sync.NewSyncer(pubID, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = syncer.fetchBlock(context.Background(), headCid)
+	var mismatchErr *BlockMismatchError
+	if !errors.As(err, &mismatchErr) {
+		t.Fatal("expected block mismatch error, got", err)
+	}
+	if mismatchErr.PeerID != pubID || mismatchErr.Cid != headCid {
+		t.Fatal("block mismatch error has wrong peer or cid:", err)
+	}
+	if has, _ := dstStore.Has(context.Background(), datastore.NewKey(headCid.String())); has {
+		t.Fatal("block that failed verification was stored")
+	}
+
+	// Check that the block is stored when its data matches.
+	if err = syncer.fetchBlock(context.Background(), otherCid); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := dstStore.Has(context.Background(), datastore.NewKey(otherCid.String())); !has {
+		t.Fatal("verified block was not stored")
+	}
+
+	// Check that a block larger than the maximum size is rejected.
+	sync = NewSync(test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore())), nil, nil, MaxBlockSize(int64(len(data)-1)))
+	defer sync.Close()
+	syncer, err = sync.NewSyncer(pubID, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syncer.fetchBlock(context.Background(), otherCid); err == nil {
+		t.Fatal("expected error fetching block larger than maximum size")
+	}
+}
+
+func TestRequireSignedBlocks(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcLinkSys := test.MkLinkSystem(datastore.NewMapDatastore())
+	headCid := test.MkChain(srcLinkSys, true)[0].(cidlink.Link).Cid
+
+	ssb := selectorbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+
+	syncFrom := func(pub *publisher) error {
+		defer pub.Close()
+		sync := NewSync(test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore())), nil, nil, RequireSignedBlocks())
+		defer sync.Close()
+		syncer, err := sync.NewSyncer(peerID, pub.Address(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return syncer.Sync(context.Background(), headCid, sel)
+	}
+
+	pub, err := NewPublisher("127.0.0.1:0", srcLinkSys, peerID, privKey, SignBlocks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syncFrom(pub); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that blocks from a publisher that does not sign them are rejected.
+	pub, err = NewPublisher("127.0.0.1:0", srcLinkSys, peerID, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syncFrom(pub); !errors.Is(err, ErrBlockSignature) {
+		t.Fatal("expected block signature error, got", err)
+	}
+
+	// Check that blocks signed by a different peer are rejected.
+	otherKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err = NewPublisher("127.0.0.1:0", srcLinkSys, peerID, otherKey, SignBlocks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syncFrom(pub); !errors.Is(err, ErrBlockSignature) {
+		t.Fatal("expected block signature error, got", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Package syncopt provides the sync options that are shared by the dtsync and
+// httpsync packages.
+package syncopt
+
+import (
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/time/rate"
+)
+
+// Config contains all options for configuring a dtsync or httpsync Sync.
+type Config struct {
+	BlockSizeHook     func(peer.ID, cid.Cid, uint64)
+	RateLimitWaitHook func(peer.ID, cid.Cid, time.Duration)
+
+	// The following options are only used by httpsync.
+
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	MaxRetries int
+
+	MaxBlockSize     int64
+	FetchConcurrency int
+
+	RequireSignedBlocks bool
+	RequestKey          ic.PrivKey
+}
+
+// Option sets an option in Config.
+type Option func(*Config)
+
+// Apply applies the given options to this config.
+func (c *Config) Apply(opts []Option) {
+	for _, opt := range opts {
+		opt(c)
+	}
+}
+
+// BlockSizeHook sets a function that is called with the size of each block
+// received from a peer.
+func BlockSizeHook(hook func(peer.ID, cid.Cid, uint64)) Option {
+	return func(c *Config) {
+		c.BlockSizeHook = hook
+	}
+}
+
+// RateLimitWaitHook sets a function that is called when a sync with a peer
+// waits because it is rate limited.
+func RateLimitWaitHook(hook func(peer.ID, cid.Cid, time.Duration)) Option {
+	return func(c *Config) {
+		c.RateLimitWaitHook = hook
+	}
+}
+
+// RateLimitBackoff sets how fetches that are rate limited are retried. The
+// arguments are clamped to valid values: a minBackoff that is not positive
+// leaves the minimum backoff unchanged, a maxBackoff less than the minimum
+// backoff is raised to it, and a negative maxRetries is treated as zero.
+func RateLimitBackoff(minBackoff, maxBackoff time.Duration, maxRetries int) Option {
+	return func(c *Config) {
+		if minBackoff > 0 {
+			c.MinBackoff = minBackoff
+		}
+		if maxBackoff < c.MinBackoff {
+			maxBackoff = c.MinBackoff
+		}
+		c.MaxBackoff = maxBackoff
+		if maxRetries < 0 {
+			maxRetries = 0
+		}
+		c.MaxRetries = maxRetries
+	}
+}
+
+// RefillWait returns the time it takes for the rate limiter to be fully
+// refilled. Returns zero if the limiter is not limited, or never refills.
+func RefillWait(limiter *rate.Limiter) time.Duration {
+	if limiter.Limit() == rate.Inf || limiter.Limit() == 0 {
+		return 0
+	}
+	waitMsec := 1000.0 * float64(limiter.Burst()) / float64(limiter.Limit())
+	waitTime := time.Duration(waitMsec) * time.Millisecond
+	if waitTime == 0 {
+		waitTime = time.Duration(1000*waitMsec) * time.Microsecond
+	}
+	return waitTime
+}
@@ -0,0 +1,112 @@
+package legs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// DefaultLatestSyncPrefix is the datastore key prefix under which
+// DsLatestSyncHandler stores latest synced CIDs if no other prefix is given.
+const DefaultLatestSyncPrefix = "/legs/latestSync"
+
+var _ LatestSyncHandler = (*DsLatestSyncHandler)(nil)
+
+// DsLatestSyncHandler is a LatestSyncHandler that persists the latest synced
+// CID for each publisher in a datastore, so that it survives restarts. Each
+// CID is stored under a key made of the configured prefix followed by the
+// publisher's peer ID.
+//
+// The Subscriber only sets the latest sync after a sync has completed
+// successfully, so a process that stops mid-sync resumes from the last
+// completed sync.
+type DsLatestSyncHandler struct {
+	ds     datastore.Datastore
+	prefix datastore.Key
+}
+
+// NewDsLatestSyncHandler creates a LatestSyncHandler that stores latest syncs
+// in the given datastore under the given key prefix. If prefix is empty, then
+// DefaultLatestSyncPrefix is used.
+func NewDsLatestSyncHandler(ds datastore.Datastore, prefix string) *DsLatestSyncHandler {
+	if prefix == "" {
+		prefix = DefaultLatestSyncPrefix
+	}
+	return &DsLatestSyncHandler{
+		ds:     ds,
+		prefix: datastore.NewKey(prefix),
+	}
+}
+
+// SetLatestSync stores the latest synced CID for the peer. Since the
+// LatestSyncHandler interface does not allow returning an error, any failure
+// to write to the datastore is logged.
+func (h *DsLatestSyncHandler) SetLatestSync(p peer.ID, c cid.Cid) {
+	ctx := context.Background()
+	key := h.peerKey(p)
+	err := h.ds.Put(ctx, key, c.Bytes())
+	if err != nil {
+		log.Errorw("Failed to persist latest sync", "err", err, "peer", p, "cid", c)
+		return
+	}
+	// Sync so that the latest sync is not lost if the process crashes.
+	if err = h.ds.Sync(ctx, key); err != nil {
+		log.Errorw("Failed to sync latest sync to datastore", "err", err, "peer", p)
+	}
+}
+
+// GetLatestSync reads the latest synced CID for the peer from the datastore.
+func (h *DsLatestSyncHandler) GetLatestSync(p peer.ID) (cid.Cid, bool) {
+	val, err := h.ds.Get(context.Background(), h.peerKey(p))
+	if err != nil {
+		if err != datastore.ErrNotFound {
+			log.Errorw("Failed to read latest sync", "err", err, "peer", p)
+		}
+		return cid.Undef, false
+	}
+	_, c, err := cid.CidFromBytes(val)
+	if err != nil {
+		log.Errorw("Failed to decode latest sync", "err", err, "peer", p)
+		return cid.Undef, false
+	}
+	return c, true
+}
+
+// LatestSyncs returns the latest synced CID of every publisher that has one
+// stored in the datastore.
+func (h *DsLatestSyncHandler) LatestSyncs(ctx context.Context) (map[peer.ID]cid.Cid, error) {
+	// End the prefix with a separator so that keys under a sibling prefix,
+	// that starts with the same string, are not matched.
+	results, err := h.ds.Query(ctx, query.Query{Prefix: h.prefix.String() + "/"})
+	if err != nil {
+		return nil, fmt.Errorf("cannot query latest syncs: %w", err)
+	}
+	defer results.Close()
+
+	latest := make(map[peer.ID]cid.Cid)
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, fmt.Errorf("cannot read latest sync: %w", r.Error)
+		}
+		p, err := peer.Decode(datastore.RawKey(r.Key).BaseNamespace())
+		if err != nil {
+			log.Errorw("Ignoring latest sync with invalid peer ID", "err", err, "key", r.Key)
+			continue
+		}
+		_, c, err := cid.CidFromBytes(r.Value)
+		if err != nil {
+			log.Errorw("Ignoring latest sync with invalid cid", "err", err, "peer", p)
+			continue
+		}
+		latest[p] = c
+	}
+	return latest, nil
+}
+
+func (h *DsLatestSyncHandler) peerKey(p peer.ID) datastore.Key {
+	return h.prefix.ChildString(p.String())
+}
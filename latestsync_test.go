@@ -0,0 +1,68 @@
+package legs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDsLatestSyncHandler(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	lsys := test.MkLinkSystem(ds)
+	chainLnks := test.MkChain(lsys, true)
+	c1 := chainLnks[0].(cidlink.Link).Cid
+	c2 := chainLnks[1].(cidlink.Link).Cid
+
+	p1 := test.MkTestHost().ID()
+	p2 := test.MkTestHost().ID()
+
+	h := NewDsLatestSyncHandler(ds, "")
+	_, ok := h.GetLatestSync(p1)
+	require.False(t, ok)
+
+	h.SetLatestSync(p1, c1)
+	h.SetLatestSync(p2, c2)
+
+	// Check that latest syncs are read by a new handler on the same datastore.
+	h = NewDsLatestSyncHandler(ds, DefaultLatestSyncPrefix)
+	c, ok := h.GetLatestSync(p1)
+	require.True(t, ok)
+	require.Equal(t, c1, c)
+
+	latest, err := h.LatestSyncs(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[peer.ID]cid.Cid{p1: c1, p2: c2}, latest)
+
+	// Check that a handler with a different prefix does not see them.
+	other := NewDsLatestSyncHandler(ds, "/other/prefix")
+	_, ok = other.GetLatestSync(p1)
+	require.False(t, ok)
+	latest, err = other.LatestSyncs(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, latest)
+
+	// Check that a handler whose prefix shares the same string, but is a
+	// sibling key, does not see them, and they do not see its latest syncs.
+	sibling := NewDsLatestSyncHandler(ds, DefaultLatestSyncPrefix+"Other")
+	latest, err = sibling.LatestSyncs(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, latest)
+	sibling.SetLatestSync(p1, c2)
+	latest, err = h.LatestSyncs(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[peer.ID]cid.Cid{p1: c1, p2: c2}, latest)
+}
+
+func TestPersistLatestSyncRequiresDatastore(t *testing.T) {
+	h := test.MkTestHost()
+	lsys := test.MkLinkSystem(dssync.MutexWrap(datastore.NewMapDatastore()))
+	_, err := NewSubscriber(h, nil, lsys, testTopic, nil, PersistLatestSync(""))
+	require.Error(t, err)
+}
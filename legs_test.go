@@ -1,7 +1,9 @@
 package legs_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"log"
 	"os"
 	"runtime"
@@ -10,16 +12,20 @@ import (
 
 	"github.com/filecoin-project/go-legs"
 	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/gpubsub"
 	"github.com/filecoin-project/go-legs/test"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
 	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
 	_ "github.com/ipld/go-ipld-prime/codec/dagjson"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
 )
 
 func TestMain(m *testing.M) {
@@ -32,7 +38,7 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-func initPubSub(t *testing.T, srcStore, dstStore datastore.Batching) (host.Host, host.Host, legs.Publisher, *legs.Subscriber, error) {
+func initPubSub(t *testing.T, srcStore, dstStore datastore.Batching, pubOptions ...dtsync.Option) (host.Host, host.Host, legs.Publisher, *legs.Subscriber, error) {
 	srcHost := test.MkTestHost()
 	dstHost := test.MkTestHost()
 
@@ -40,7 +46,8 @@ func initPubSub(t *testing.T, srcStore, dstStore datastore.Batching) (host.Host,
 
 	srcLnkS := test.MkLinkSystem(srcStore)
 
-	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic, dtsync.Topic(topics[0]), dtsync.WithExtraData([]byte("t01000")))
+	pubOptions = append([]dtsync.Option{dtsync.Topic(topics[0]), dtsync.WithExtraData([]byte("t01000"))}, pubOptions...)
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, srcLnkS, testTopic, pubOptions...)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
@@ -136,6 +143,323 @@ func TestAllowPeerAllows(t *testing.T) {
 	}
 }
 
+func TestSignedAnnounce(t *testing.T) {
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	srcHost, dstHost, pub, sub, err := initPubSub(t, srcStore, dstStore, dtsync.SignAnnounces())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srcHost.Close()
+	defer dstHost.Close()
+	defer pub.Close()
+	defer sub.Close()
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	// Announce a head, and then a later head, of the same chain.
+	chainLnks := test.MkChain(test.MkLinkSystem(srcStore), true)
+	for _, lnk := range []ipld.Link{chainLnks[2], chainLnks[0]} {
+		c := lnk.(cidlink.Link).Cid
+		if err = pub.UpdateRoot(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-time.After(updateTimeout):
+			t.Fatal("timed out waiting for SyncFinished")
+		case event := <-watcher:
+			if event.Cid != c {
+				t.Fatalf("expected sync to %s, got %s", c, event.Cid)
+			}
+		}
+	}
+}
+
+func TestStreamAnnounce(t *testing.T) {
+	srcHost := test.MkTestHost()
+	dstHost := test.MkTestHost()
+	defer srcHost.Close()
+	defer dstHost.Close()
+	srcHost.Peerstore().AddAddrs(dstHost.ID(), dstHost.Addrs(), time.Hour)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	sub, err := legs.NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil, legs.StreamAnnounce())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// A subscriber that cannot be reached does not stop the announce from
+	// being sent to the others.
+	goneHost := test.MkTestHost()
+	goneInfo := goneHost.Peerstore().PeerInfo(goneHost.ID())
+	goneHost.Close()
+
+	// The publisher does not use pubsub, so it can only announce over the
+	// announce stream protocol.
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, test.MkLinkSystem(srcStore), testTopic,
+		dtsync.NoPubsub(), dtsync.StreamAnnounce(goneInfo, dstHost.Peerstore().PeerInfo(dstHost.ID())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	chainLnks := test.MkChain(test.MkLinkSystem(srcStore), true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+	if err = pub.UpdateRoot(context.Background(), headCid); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for SyncFinished")
+	case event := <-watcher:
+		if event.Cid != headCid {
+			t.Fatalf("expected sync to %s, got %s", headCid, event.Cid)
+		}
+		if event.PeerID != srcHost.ID() {
+			t.Fatal("sync with wrong publisher", event.PeerID)
+		}
+	}
+}
+
+func TestNoPubsubSubscriber(t *testing.T) {
+	srcHost := test.MkTestHost()
+	dstHost := test.MkTestHost()
+	defer srcHost.Close()
+	defer dstHost.Close()
+	srcHost.Peerstore().AddAddrs(dstHost.ID(), dstHost.Addrs(), time.Hour)
+	dstHost.Peerstore().AddAddrs(srcHost.ID(), srcHost.Addrs(), time.Hour)
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstLnkS := test.MkLinkSystem(dstStore)
+
+	_, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, legs.NoPubsub(), legs.ResendAnnounce(true))
+	if err == nil {
+		t.Fatal("expected error using ResendAnnounce with NoPubsub")
+	}
+
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, legs.NoPubsub())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, test.MkLinkSystem(srcStore), testTopic, dtsync.NoPubsub())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	chainLnks := test.MkChain(test.MkLinkSystem(srcStore), true)
+
+	// Sync explicitly to the latest root.
+	c := chainLnks[2].(cidlink.Link).Cid
+	if err = pub.SetRoot(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	syncCid, err := sub.Sync(context.Background(), srcHost.ID(), cid.Undef, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if syncCid != c {
+		t.Fatalf("expected sync to %s, got %s", c, syncCid)
+	}
+	select {
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for SyncFinished")
+	case event := <-watcher:
+		if event.Cid != c {
+			t.Fatalf("expected sync to %s, got %s", c, event.Cid)
+		}
+	}
+
+	// Sync from a direct announce.
+	c = chainLnks[0].(cidlink.Link).Cid
+	if err = pub.SetRoot(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if err = sub.Announce(context.Background(), c, srcHost.ID(), srcHost.Addrs()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(updateTimeout):
+		t.Fatal("timed out waiting for SyncFinished")
+	case event := <-watcher:
+		if event.Cid != c {
+			t.Fatalf("expected sync to %s, got %s", c, event.Cid)
+		}
+	}
+}
+
+func TestPubsubOptions(t *testing.T) {
+	srcHost := test.MkTestHost()
+	dstHost := test.MkTestHost()
+	defer srcHost.Close()
+	defer dstHost.Close()
+
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	dstLnkS := test.MkLinkSystem(dstStore)
+
+	_, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil, legs.NoPubsub(),
+		legs.PubsubOptions(gpubsub.DirectPeers(*host.InfoFromHost(srcHost))))
+	if err == nil {
+		t.Fatal("expected error using PubsubOptions with NoPubsub")
+	}
+	_, err = legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil,
+		legs.PubsubOptions(gpubsub.MeshDegree(4, 5, 8)))
+	if err == nil {
+		t.Fatal("expected error using invalid mesh degree")
+	}
+
+	// Make the hosts direct peers of each other, so that messages are sent
+	// between them without waiting for a mesh to form.
+	sub, err := legs.NewSubscriber(dstHost, dstStore, dstLnkS, testTopic, nil,
+		legs.PubsubOptions(
+			gpubsub.DirectPeers(*host.InfoFromHost(srcHost)),
+			gpubsub.TopicScore(gpubsub.DefaultTopicScoreParams()),
+			gpubsub.MeshDegree(4, 3, 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	pub, err := dtsync.NewPublisher(srcHost, srcStore, test.MkLinkSystem(srcStore), testTopic,
+		dtsync.SignAnnounces(),
+		dtsync.PubsubOptions(
+			gpubsub.DirectPeers(*host.InfoFromHost(dstHost)),
+			gpubsub.PeerScore(nil, nil),
+			gpubsub.TopicScore(gpubsub.DefaultTopicScoreParams())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	watcher, cncl := sub.OnSyncFinished()
+	defer cncl()
+
+	chainLnks := test.MkChain(test.MkLinkSystem(srcStore), true)
+	headCid := chainLnks[0].(cidlink.Link).Cid
+
+	// Announce until the subscriber receives the announce, since the hosts
+	// may not have exchanged subscriptions yet. Announces are signed so that
+	// each has a new sequence number, and is not dropped as a duplicate.
+	timeout := time.After(10 * time.Second)
+	for {
+		if err = pub.UpdateRoot(context.Background(), headCid); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for SyncFinished")
+		case <-time.After(200 * time.Millisecond):
+			continue
+		case event := <-watcher:
+			if event.Cid != headCid {
+				t.Fatalf("expected sync to %s, got %s", headCid, event.Cid)
+			}
+		}
+		break
+	}
+}
+
+func TestRelayedAnnounceVerified(t *testing.T) {
+	relayHost := test.MkTestHost()
+	dstHost := test.MkTestHost()
+	defer relayHost.Close()
+	defer dstHost.Close()
+	topics := test.WaitForMeshWithMessage(t, testTopic, relayHost, dstHost)
+
+	// Queue announces so that each one that is accepted is synced.
+	dstStore := dssync.MutexWrap(datastore.NewMapDatastore())
+	sub, err := legs.NewSubscriber(dstHost, dstStore, test.MkLinkSystem(dstStore), testTopic, nil,
+		legs.Topic(topics[1]), legs.AnnounceQueue(3, legs.DropNewest), legs.RejectUnsignedRelays())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	failed, cncl := sub.OnSyncFailed()
+	defer cncl()
+
+	origKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origPeer, err := peer.IDFromPrivateKey(origKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cids, err := test.RandomCids(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Announce an HTTP address with nothing listening on it, so that syncs
+	// fail quickly.
+	httpAddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1/http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := []multiaddr.Multiaddr{httpAddr}
+
+	relay := func(msg dtsync.Message) {
+		msg.OrigPeer = origPeer.String()
+		buf := bytes.NewBuffer(nil)
+		if err := msg.MarshalCBOR(buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := topics[0].Publish(context.Background(), buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Relay an unsigned announce.
+	unsigned := dtsync.Message{Cid: cids[0]}
+	unsigned.SetAddrs(addrs)
+	relay(unsigned)
+
+	// Relay an announce signed by the relay instead of the original publisher.
+	forged := dtsync.Message{Cid: cids[1], Seq: 1, Timestamp: time.Now().UnixNano()}
+	forged.SetAddrs(addrs)
+	if err = forged.Sign(relayHost.Peerstore().PrivKey(relayHost.ID())); err != nil {
+		t.Fatal(err)
+	}
+	relay(forged)
+
+	// Relay an announce signed by the original publisher.
+	signed := dtsync.Message{Cid: cids[2], Seq: 1, Timestamp: time.Now().UnixNano()}
+	signed.SetAddrs(addrs)
+	if err = signed.Sign(origKey); err != nil {
+		t.Fatal(err)
+	}
+	relay(signed)
+
+	// Only the signed announce is handled. Its sync fails since the original
+	// publisher cannot be reached.
+	select {
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for sync of signed announce")
+	case event := <-failed:
+		if event.Cid != cids[2] {
+			t.Fatalf("unexpected sync of %s", event.Cid)
+		}
+		if event.PeerID != origPeer {
+			t.Fatalf("sync with wrong publisher %s", event.PeerID)
+		}
+	}
+}
+
 func TestPublisherRejectsPeer(t *testing.T) {
 	// Init legs publisher and subscriber
 	srcStore := dssync.MutexWrap(datastore.NewMapDatastore())
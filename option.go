@@ -1,12 +1,15 @@
 package legs
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
 	"time"
 
 	dt "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-legs/gpubsub"
+	"github.com/filecoin-project/go-legs/httpsync"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
@@ -26,18 +29,44 @@ type config struct {
 	dtManager     dt.Manager
 	graphExchange graphsync.GraphExchange
 
-	blockHook  BlockHookFunc
-	httpClient *http.Client
+	blockHook       BlockHookFunc
+	httpClient      *http.Client
+	httpSyncOptions []httpsync.SyncOption
 
 	syncRecLimit selector.RecursionLimit
 
 	idleHandlerTTL    time.Duration
 	latestSyncHandler LatestSyncHandler
+	latestSyncPrefix  string
+	persistLatestSync bool
+
+	checkpointPrefix string
+	resumableSync    bool
 
 	rateLimiterFor RateLimiterFor
 	resendAnnounce bool
 
+	rejectUnsignedRelays bool
+	streamAnnounce       bool
+	noPubsub             bool
+	pubsubOptions        []gpubsub.Option
+
+	resubBaseBackoff time.Duration
+	resubMaxBackoff  time.Duration
+
 	segDepthLimit int64
+
+	announceQueueDepth  int
+	announceQueuePolicy AnnounceQueuePolicy
+
+	retryPolicy *RetryPolicy
+
+	forkPolicy ChainForkPolicy
+	forkDecide func(ChainFork) bool
+
+	checkHeadHistory bool
+
+	announceTimeSkew time.Duration
 }
 
 type Option func(*config) error
@@ -70,7 +99,8 @@ func AddrTTL(addrTTL time.Duration) Option {
 	}
 }
 
-// Topic provides an existing pubsub topic.
+// Topic provides an existing pubsub topic. The caller may register a validator
+// created by dtsync.NewValidator for the topic.
 func Topic(topic *pubsub.Topic) Option {
 	return func(c *config) error {
 		c.topic = topic
@@ -78,6 +108,42 @@ func Topic(topic *pubsub.Topic) Option {
 	}
 }
 
+// NoPubsub makes the Subscriber not join a pubsub topic, so that it does not
+// receive announce messages over pubsub. Syncs may still be started by calling
+// Sync or Announce, or by announces received over the announce stream protocol
+// if StreamAnnounce is used. This option cannot be used with Topic or
+// ResendAnnounce.
+func NoPubsub() Option {
+	return func(c *config) error {
+		c.noPubsub = true
+		return nil
+	}
+}
+
+// PubsubOptions configures the gossipsub router and topic that the Subscriber
+// creates. This option cannot be used with Topic or NoPubsub.
+func PubsubOptions(options ...gpubsub.Option) Option {
+	return func(c *config) error {
+		c.pubsubOptions = append(c.pubsubOptions, options...)
+		return nil
+	}
+}
+
+// ResubscribeBackoff sets the time to wait before attempts to resubscribe to
+// the pubsub topic after the subscription fails. The wait starts at base and
+// doubles after each failed attempt, up to max. The default is 1 second,
+// increasing to 1 minute.
+func ResubscribeBackoff(base, max time.Duration) Option {
+	return func(c *config) error {
+		if base <= 0 || max < base {
+			return errors.New("resubscribe backoff must be positive and base must not exceed max")
+		}
+		c.resubBaseBackoff = base
+		c.resubMaxBackoff = max
+		return nil
+	}
+}
+
 // DtManager provides an existing datatransfer manager.
 func DtManager(dtManager dt.Manager, gs graphsync.GraphExchange) Option {
 	return func(c *config) error {
@@ -95,6 +161,15 @@ func HttpClient(client *http.Client) Option {
 	}
 }
 
+// HttpSyncOptions provides options to configure syncs over HTTP, such as
+// httpsync.RequireSignedBlocks or httpsync.FetchConcurrency.
+func HttpSyncOptions(options ...httpsync.SyncOption) Option {
+	return func(c *config) error {
+		c.httpSyncOptions = append(c.httpSyncOptions, options...)
+		return nil
+	}
+}
+
 // BlockHook adds a hook that is run when a block is received via Subscriber.Sync along with a
 // SegmentSyncActions to control the sync flow if segmented sync is enabled.
 // Note that if segmented sync is disabled, calls on SegmentSyncActions will have no effect.
@@ -145,7 +220,9 @@ func SyncRecursionLimit(limit selector.RecursionLimit) Option {
 }
 
 // ResendAnnounce determines whether to resend the direct announce mesages
-// (those that are not received via pubsub) over pubsub.
+// (those that are not received via pubsub) over pubsub. If FilterIPs is
+// enabled, then private addresses are removed from a resent message unless it
+// is signed, since that would invalidate its signature.
 func ResendAnnounce(enable bool) Option {
 	return func(c *config) error {
 		c.resendAnnounce = enable
@@ -153,6 +230,44 @@ func ResendAnnounce(enable bool) Option {
 	}
 }
 
+// RejectUnsignedRelays makes the Subscriber ignore announce messages that were
+// re-published by a peer other than the original publisher, unless the message
+// is signed by the original publisher. Signed messages are always verified
+// against the original publisher's key. See dtsync.SignAnnounces.
+func RejectUnsignedRelays() Option {
+	return func(c *config) error {
+		c.rejectUnsignedRelays = true
+		return nil
+	}
+}
+
+// AnnounceTimeSkew sets how far from the current time the timestamp of a
+// signed announce message with a sequence number may be. An announce outside
+// of this window is rejected with ErrAnnounceTimeSkew. This limits how long an
+// announce can be replayed when its publisher's last sequence number is not
+// known, such as after a restart if latest syncs are not persisted. The
+// default is 10 minutes.
+func AnnounceTimeSkew(skew time.Duration) Option {
+	return func(c *config) error {
+		if skew <= 0 {
+			return errors.New("announce time skew must be positive")
+		}
+		c.announceTimeSkew = skew
+		return nil
+	}
+}
+
+// StreamAnnounce makes the Subscriber receive announce messages sent directly
+// to it over the libp2p announce protocol for its topic, in addition to those
+// received over pubsub. This lets publishers that cannot use gossipsub announce
+// to the Subscriber. See dtsync.StreamAnnounce.
+func StreamAnnounce() Option {
+	return func(c *config) error {
+		c.streamAnnounce = true
+		return nil
+	}
+}
+
 type RateLimiterFor func(publisher peer.ID) *rate.Limiter
 
 // RateLimiter configures a function that is called for each sync to get the
@@ -196,6 +311,136 @@ func UseLatestSyncHandler(h LatestSyncHandler) Option {
 	}
 }
 
+// PersistLatestSync makes the Subscriber store the latest synced CID of each
+// publisher in the datastore given to NewSubscriber, under the given key
+// prefix, using a DsLatestSyncHandler. If prefix is empty, then
+// DefaultLatestSyncPrefix is used. This option is ignored if a handler is set
+// with UseLatestSyncHandler, and requires a datastore to be given to
+// NewSubscriber.
+//
+// The sequence number of the last accepted announce from each publisher is
+// also stored in the datastore, under DefaultAnnounceSeqPrefix, so that
+// announces from before a restart are rejected with ErrStaleAnnounce. This is
+// done even if a handler is set with UseLatestSyncHandler, as long as a
+// datastore is given to NewSubscriber.
+func PersistLatestSync(prefix string) Option {
+	return func(c *config) error {
+		c.persistLatestSync = true
+		c.latestSyncPrefix = prefix
+		return nil
+	}
+}
+
+// ResumableSync makes the Subscriber checkpoint the progress of syncs that use
+// the default selector sequence, in the datastore given to NewSubscriber and
+// under the given key prefix. If a sync is interrupted, for example by the
+// process being stopped, then the next sync with the same publisher resumes
+// from the checkpoint instead of starting over at the head. If prefix is
+// empty, then DefaultCheckpointPrefix is used. Requires a datastore to be given
+// to NewSubscriber.
+//
+// A checkpoint is written when a sync starts, periodically as blocks are
+// synced, and when the sync fails, and is removed when the sync completes. The
+// checkpoint records the frontier of the sync: the links to blocks that are
+// selected but not yet synced, along with the number of recursion edges
+// followed to reach them. A resumed sync continues from the frontier, and is
+// counted against the recursion limit of the interrupted sync. The blocks
+// synced after the last checkpoint was written are synced again. The synced
+// CIDs of a resumed sync are only those synced after it was resumed.
+func ResumableSync(prefix string) Option {
+	return func(c *config) error {
+		c.resumableSync = true
+		c.checkpointPrefix = prefix
+		return nil
+	}
+}
+
+// AnnounceQueue makes each publisher handler keep a queue of up to depth
+// announces that are waiting to be handled, instead of only keeping the latest
+// one. The policy determines what happens when a new announce arrives and the
+// queue is full. Announces from a publisher are handled in the order they are
+// queued. The number of discarded announces is reported by
+// Subscriber.AnnounceStats.
+func AnnounceQueue(depth int, policy AnnounceQueuePolicy) Option {
+	return func(c *config) error {
+		if depth < 1 {
+			return errors.New("announce queue depth must be at least 1")
+		}
+		switch policy {
+		case DropOldest, DropNewest, CoalesceSameChain:
+		default:
+			return fmt.Errorf("unknown announce queue policy: %d", policy)
+		}
+		c.announceQueueDepth = depth
+		c.announceQueuePolicy = policy
+		return nil
+	}
+}
+
+// SyncRetry sets the policy for retrying syncs that were started by announce
+// messages and that failed. By default, failed syncs are not retried.
+func SyncRetry(policy RetryPolicy) Option {
+	return func(c *config) error {
+		if policy.MaxAttempts < 1 {
+			return errors.New("retry max attempts must be at least 1")
+		}
+		if policy.BaseBackoff < 0 || policy.MaxBackoff < 0 {
+			return errors.New("retry backoff cannot be negative")
+		}
+		if policy.Jitter < 0 || policy.Jitter > 1 {
+			return errors.New("retry jitter must be between 0 and 1")
+		}
+		c.retryPolicy = &policy
+		return nil
+	}
+}
+
+// OnChainFork sets what is done when a synced head does not lead to the latest
+// synced CID, meaning that the publisher has rewound or forked its chain. The
+// decide function is required by the ForkDecide policy, and returns true to
+// accept the new chain. It is called while the sync with the publisher is in
+// progress, so it must not sync with the same publisher. The default policy is
+// ForkAccept.
+//
+// Unless the policy is ForkAccept, every such sync also sends a
+// SyncEventChainFork to OnSyncEvent readers. Whether the head leads to the
+// latest synced CID is found by walking back from the head through the locally
+// stored blocks, so a sync that stops short of the latest synced CID, such as
+// because of a recursion limit, is not seen as a chain fork. If the walk cannot
+// tell, because a block on the way is not stored or the chain is too long to
+// walk, then the new head is accepted and no chain fork is reported.
+func OnChainFork(policy ChainForkPolicy, decide func(ChainFork) bool) Option {
+	return func(c *config) error {
+		switch policy {
+		case ForkAccept, ForkReject, ForkResync:
+		case ForkDecide:
+			if decide == nil {
+				return errors.New("chain fork decide function required")
+			}
+		default:
+			return fmt.Errorf("unknown chain fork policy: %d", policy)
+		}
+		c.forkPolicy = policy
+		c.forkDecide = decide
+		return nil
+	}
+}
+
+// CheckHeadHistory makes the Subscriber check each announced head against the
+// publisher's signed head history before syncing it. The sync fails with
+// ErrHeadHistory if the history does not show monotonic progress, does not
+// contain the announced head, or shows that the announced head was published
+// before the latest synced head, as when the publisher rolled back its chain.
+// Heads that were published after the latest synced head, but before the
+// announced head, are logged as skipped. Publishers must serve their head
+// history, using the dtsync.HeadHistory or httpsync.HeadHistory option.
+func CheckHeadHistory() Option {
+	return func(c *config) error {
+		c.checkHeadHistory = true
+		return nil
+	}
+}
+
 type syncCfg struct {
 	alwaysUpdateLatest bool
 	rateLimiter        *rate.Limiter
@@ -0,0 +1,122 @@
+// Package announce sends announce messages directly to subscribers over a
+// libp2p stream protocol, for deployments that cannot use gossipsub. Messages
+// are sent encoded, the same as they are published over pubsub.
+package announce
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+var log = logging.Logger("go-legs/announce")
+
+const (
+	// maxMessageSize is the largest encoded announce message accepted.
+	maxMessageSize = 1 << 20
+	// maxResponseSize is the largest error response read by the sender.
+	maxResponseSize = 1024
+	// streamTimeout limits the time to send or receive an announce.
+	streamTimeout = time.Minute
+)
+
+// HandlerFunc is called with each encoded announce message received, and the
+// peer that sent it. A returned error is sent back to the sender.
+type HandlerFunc func(ctx context.Context, from peer.ID, data []byte) error
+
+// Receiver receives announce messages on a libp2p host.
+type Receiver struct {
+	host    host.Host
+	pid     protocol.ID
+	handler HandlerFunc
+}
+
+func deriveProtocolID(topic string) protocol.ID {
+	return protocol.ID(path.Join("/legs/announce", topic, "0.0.1"))
+}
+
+// NewReceiver starts receiving announce messages for the topic on the host,
+// and passes each message to the handler. Messages are received until Close
+// is called.
+func NewReceiver(host host.Host, topic string, handler HandlerFunc) *Receiver {
+	r := &Receiver{
+		host:    host,
+		pid:     deriveProtocolID(topic),
+		handler: handler,
+	}
+	host.SetStreamHandler(r.pid, r.handleStream)
+	log.Infow("Receiving announce messages", "host", host.ID(), "protocolID", r.pid)
+	return r
+}
+
+// Close stops receiving announce messages.
+func (r *Receiver) Close() {
+	r.host.RemoveStreamHandler(r.pid)
+}
+
+func (r *Receiver) handleStream(s network.Stream) {
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(streamTimeout))
+	from := s.Conn().RemotePeer()
+
+	data, err := io.ReadAll(io.LimitReader(s, maxMessageSize+1))
+	if err != nil {
+		log.Errorw("Cannot read announce message", "err", err, "peer", from)
+		_ = s.Reset()
+		return
+	}
+	if len(data) > maxMessageSize {
+		err = errors.New("announce message too large")
+	} else {
+		// The handler may continue handling the announce after the stream is
+		// closed, so it is not given a context that ends with the stream.
+		err = r.handler(context.Background(), from, data)
+	}
+	if err != nil {
+		_, _ = io.WriteString(s, err.Error())
+	}
+}
+
+// Send sends an encoded announce message to the subscriber, peerID, over the
+// announce protocol for the topic. An error is returned if the subscriber
+// rejects the message.
+func Send(ctx context.Context, host host.Host, topic string, peerID peer.ID, data []byte) error {
+	s, err := host.NewStream(ctx, peerID, deriveProtocolID(topic))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	} else {
+		_ = s.SetDeadline(time.Now().Add(streamTimeout))
+	}
+
+	if _, err = s.Write(data); err != nil {
+		_ = s.Reset()
+		return err
+	}
+	if err = s.CloseWrite(); err != nil {
+		_ = s.Reset()
+		return err
+	}
+
+	// The subscriber closes the stream without a response if it accepts the
+	// message.
+	resp, err := io.ReadAll(io.LimitReader(s, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if len(resp) != 0 {
+		return errors.New("announce rejected: " + string(resp))
+	}
+	return nil
+}
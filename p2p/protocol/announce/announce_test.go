@@ -0,0 +1,79 @@
+package announce_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/p2p/protocol/announce"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+)
+
+func TestSend(t *testing.T) {
+	receiverHost, err := libp2p.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiverHost.Close()
+	senderHost, err := libp2p.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer senderHost.Close()
+	senderHost.Peerstore().AddAddrs(receiverHost.ID(), receiverHost.Addrs(), peerstore.PermanentAddrTTL)
+
+	type received struct {
+		from peer.ID
+		data []byte
+	}
+	recvChan := make(chan received, 1)
+	r := announce.NewReceiver(receiverHost, "test", func(ctx context.Context, from peer.ID, data []byte) error {
+		if bytes.Equal(data, []byte("bad")) {
+			return errors.New("bad message")
+		}
+		recvChan <- received{from, data}
+		return nil
+	})
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	msg := []byte("hello")
+	if err = announce.Send(ctx, senderHost, "test", receiverHost.ID(), msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case recv := <-recvChan:
+		if recv.from != senderHost.ID() {
+			t.Fatal("wrong sender", recv.from)
+		}
+		if !bytes.Equal(recv.data, msg) {
+			t.Fatalf("expected %q, got %q", msg, recv.data)
+		}
+	default:
+		t.Fatal("message was not received")
+	}
+
+	// Check that an error from the handler is returned to the sender.
+	err = announce.Send(ctx, senderHost, "test", receiverHost.ID(), []byte("bad"))
+	if err == nil || !strings.Contains(err.Error(), "bad message") {
+		t.Fatal("expected rejected message error, got", err)
+	}
+
+	// Check that the protocol is specific to the topic.
+	if err = announce.Send(ctx, senderHost, "other", receiverHost.ID(), msg); err == nil {
+		t.Fatal("expected error sending to topic without receiver")
+	}
+
+	// Check that messages are not received after close.
+	r.Close()
+	if err = announce.Send(ctx, senderHost, "test", receiverHost.ID(), msg); err == nil {
+		t.Fatal("expected error sending to closed receiver")
+	}
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
@@ -28,6 +29,9 @@ type Publisher struct {
 	rl     sync.RWMutex
 	root   cid.Cid
 	server *http.Server
+
+	history *History
+	privKey ic.PrivKey
 }
 
 func NewPublisher() *Publisher {
@@ -38,6 +42,21 @@ func NewPublisher() *Publisher {
 	return p
 }
 
+// NewPublisherWithHistory creates a Publisher that adds each head to the
+// history, and serves the history signed by privKey. See QueryHistory.
+func NewPublisherWithHistory(history *History, privKey ic.PrivKey) (*Publisher, error) {
+	if history == nil {
+		return nil, errors.New("head history is nil")
+	}
+	if privKey == nil {
+		return nil, errors.New("private key is required to sign head history")
+	}
+	p := NewPublisher()
+	p.history = history
+	p.privKey = privKey
+	return p, nil
+}
+
 func deriveProtocolID(topic string) protocol.ID {
 	return protocol.ID(path.Join("/legs/head", topic, "0.0.1"))
 }
@@ -54,7 +73,40 @@ func (p *Publisher) Serve(host host.Host, topic string) error {
 }
 
 func QueryRootCid(ctx context.Context, host host.Host, topic string, peerID peer.ID) (cid.Cid, error) {
-	client := http.Client{
+	client := newClient(host, topic, peerID)
+
+	// The httpclient expects there to be a host here. `.invalid` is a reserved
+	// TLD for this purpose. See
+	// https://datatracker.ietf.org/doc/html/rfc2606#section-2
+	resp, err := client.Get("http://unused.invalid/head")
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer resp.Body.Close()
+
+	cidStr, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("cannot fully read response body: %w", err)
+	}
+	if len(cidStr) == 0 {
+		log.Debug("No head is set; returning cid.Undef")
+		return cid.Undef, nil
+	}
+
+	cs := string(cidStr)
+	decode, err := cid.Decode(cs)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to decode CID %s: %w", cs, err)
+	}
+
+	log.Debugw("Sucessfully queried latest head", "head", decode)
+	return decode, nil
+}
+
+// newClient creates an http client that connects to the head publisher of
+// the peer over libp2p.
+func newClient(host host.Host, topic string, peerID peer.ID) http.Client {
+	return http.Client{
 		Transport: &http.Transport{
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 				addrInfo := peer.AddrInfo{
@@ -83,37 +135,46 @@ func QueryRootCid(ctx context.Context, host host.Host, topic string, peerID peer
 			},
 		},
 	}
+}
 
-	// The httpclient expects there to be a host here. `.invalid` is a reserved
-	// TLD for this purpose. See
-	// https://datatracker.ietf.org/doc/html/rfc2606#section-2
-	resp, err := client.Get("http://unused.invalid/head")
+// QueryHistory gets the signed head history from the head publisher of the
+// peer, and verifies that it is signed by the peer. Returns the head records
+// from oldest to latest.
+func QueryHistory(ctx context.Context, host host.Host, topic string, peerID peer.ID) ([]HeadRecord, error) {
+	client := newClient(host, topic, peerID)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://unused.invalid/history", nil)
 	if err != nil {
-		return cid.Undef, err
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	cidStr, err := io.ReadAll(resp.Body)
+	resp, err := client.Do(req)
 	if err != nil {
-		return cid.Undef, fmt.Errorf("cannot fully read response body: %w", err)
+		return nil, err
 	}
-	if len(cidStr) == 0 {
-		log.Debug("No head is set; returning cid.Undef")
-		return cid.Undef, nil
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("head history not available from %s: status %d", peerID, resp.StatusCode)
 	}
-
-	cs := string(cidStr)
-	decode, err := cid.Decode(cs)
+	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return cid.Undef, fmt.Errorf("failed to decode CID %s: %w", cs, err)
+		return nil, fmt.Errorf("cannot fully read response body: %w", err)
 	}
-
-	log.Debugw("Sucessfully queried latest head", "head", decode)
-	return decode, nil
+	signer, records, err := DecodeSignedHistory(data)
+	if err != nil {
+		return nil, err
+	}
+	if signer != peerID {
+		return nil, errors.New("found head history signed by an unexpected peer")
+	}
+	return records, nil
 }
 
 func (p *Publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	base := path.Base(r.URL.Path)
+	if base == "history" {
+		p.serveHistory(w)
+		return
+	}
 	if base != "head" {
 		log.Debug("Only head is supported; rejecting request with different base path")
 		http.Error(w, "", http.StatusNotFound)
@@ -137,10 +198,29 @@ func (p *Publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (p *Publisher) serveHistory(w http.ResponseWriter) {
+	if p.history == nil {
+		http.Error(w, "head history not enabled", http.StatusNotFound)
+		return
+	}
+	out, err := EncodeSignedHistory(p.history.Records(), p.privKey)
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		log.Errorw("Failed to encode head history", "err", err)
+		return
+	}
+	if _, err = w.Write(out); err != nil {
+		log.Errorw("Failed to write response", "err", err)
+	}
+}
+
 func (p *Publisher) UpdateRoot(_ context.Context, c cid.Cid) error {
 	p.rl.Lock()
 	defer p.rl.Unlock()
 	p.root = c
+	if p.history != nil {
+		return p.history.Add(c)
+	}
 	return nil
 }
 
@@ -0,0 +1,251 @@
+package head
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// historySigDomain is prepended to the encoded records to create the data
+	// that is signed for a head history. This keeps a history signature from
+	// being valid as any other kind of signature.
+	historySigDomain = "/legs/head/history:"
+
+	// DefaultHistoryKey is the datastore key under which a head history is
+	// stored if no other key is given to LoadHistory.
+	DefaultHistoryKey = "/legs/headHistory"
+)
+
+// HeadRecord is an entry in a publisher's history of heads.
+type HeadRecord struct {
+	// Seq is the sequence number of the head. Each head published has a
+	// sequence number one greater than the previous head. Sequence numbers
+	// restart when the publisher restarts, unless the history is stored in a
+	// datastore. See LoadHistory.
+	Seq uint64 `json:"seq"`
+	// Time is when the head was published.
+	Time time.Time `json:"time"`
+	// Cid is the head CID.
+	Cid cid.Cid `json:"cid"`
+}
+
+// History is a bounded history of the heads published by a publisher.
+type History struct {
+	limit   int
+	mutex   sync.Mutex
+	nextSeq uint64
+	records []HeadRecord
+
+	// ds and dsKey are where the history is stored, if it is persisted.
+	ds    datastore.Datastore
+	dsKey datastore.Key
+}
+
+// storedHistory is the encoding of a head history in a datastore.
+type storedHistory struct {
+	NextSeq uint64       `json:"nextSeq"`
+	Records []HeadRecord `json:"records"`
+}
+
+// signedHistory is the signed encoding of a head history. It includes the
+// public key of the signer so the receiver can verify it and convert it to a
+// peer id.
+type signedHistory struct {
+	Records json.RawMessage `json:"records"`
+	PubKey  string          `json:"pubkey"`
+	Sig     string          `json:"sig"`
+}
+
+// NewHistory creates a History that keeps the most recent limit heads. At
+// least one head is kept. The history is only kept in memory.
+func NewHistory(limit int) *History {
+	if limit < 1 {
+		limit = 1
+	}
+	return &History{
+		limit:   limit,
+		nextSeq: 1,
+	}
+}
+
+// LoadHistory creates a History that keeps the most recent limit heads, and
+// that is stored in the datastore under key. The history and its sequence
+// number are loaded from the datastore, so that sequence numbers continue
+// from where they were when the publisher restarts. If key is empty, then
+// DefaultHistoryKey is used.
+func LoadHistory(ctx context.Context, ds datastore.Datastore, key string, limit int) (*History, error) {
+	if key == "" {
+		key = DefaultHistoryKey
+	}
+	h := NewHistory(limit)
+	h.ds = ds
+	h.dsKey = datastore.NewKey(key)
+
+	data, err := ds.Get(ctx, h.dsKey)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return h, nil
+		}
+		return nil, fmt.Errorf("cannot read head history: %w", err)
+	}
+	var stored storedHistory
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("cannot decode head history: %w", err)
+	}
+	if stored.NextSeq > h.nextSeq {
+		h.nextSeq = stored.NextSeq
+	}
+	if len(stored.Records) > h.limit {
+		stored.Records = stored.Records[len(stored.Records)-h.limit:]
+	}
+	h.records = stored.Records
+	return h, nil
+}
+
+// Add adds a head to the history, removing the oldest head if the history is
+// full. The head is not added if it is undefined or is the same as the latest
+// head. If the history is stored in a datastore, an error is returned if the
+// history cannot be written.
+func (h *History) Add(c cid.Cid) error {
+	if c == cid.Undef {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.records) != 0 && h.records[len(h.records)-1].Cid == c {
+		return nil
+	}
+	if len(h.records) >= h.limit {
+		copy(h.records, h.records[1:])
+		h.records = h.records[:len(h.records)-1]
+	}
+	h.records = append(h.records, HeadRecord{
+		Seq:  h.nextSeq,
+		Time: time.Now().UTC(),
+		Cid:  c,
+	})
+	h.nextSeq++
+	return h.store()
+}
+
+// store writes the history to its datastore, if it has one. The caller must
+// hold the mutex.
+func (h *History) store() error {
+	if h.ds == nil {
+		return nil
+	}
+	data, err := json.Marshal(storedHistory{
+		NextSeq: h.nextSeq,
+		Records: h.records,
+	})
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err = h.ds.Put(ctx, h.dsKey, data); err != nil {
+		return fmt.Errorf("cannot write head history: %w", err)
+	}
+	// Sync so that a sequence number is never reused after a crash.
+	if err = h.ds.Sync(ctx, h.dsKey); err != nil {
+		return fmt.Errorf("cannot sync head history: %w", err)
+	}
+	return nil
+}
+
+// Records returns the heads in the history, from oldest to latest.
+func (h *History) Records() []HeadRecord {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	records := make([]HeadRecord, len(h.records))
+	copy(records, h.records)
+	return records
+}
+
+// EncodeSignedHistory encodes the head records and signs them with the
+// publisher's private key.
+func EncodeSignedHistory(records []HeadRecord, privKey ic.PrivKey) ([]byte, error) {
+	if records == nil {
+		records = []HeadRecord{}
+	}
+	encRecords, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := privKey.Sign(append([]byte(historySigDomain), encRecords...))
+	if err != nil {
+		return nil, err
+	}
+	pubKeyBytes, err := ic.MarshalPublicKey(privKey.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(signedHistory{
+		Records: encRecords,
+		PubKey:  base64.StdEncoding.EncodeToString(pubKeyBytes),
+		Sig:     base64.StdEncoding.EncodeToString(sig),
+	})
+}
+
+// DecodeSignedHistory verifies the signature of an encoded head history, and
+// returns the ID of the peer that signed it and the head records. The caller
+// must check that the signer is the expected publisher.
+func DecodeSignedHistory(data []byte) (peer.ID, []HeadRecord, error) {
+	var sh signedHistory
+	if err := json.Unmarshal(data, &sh); err != nil {
+		return "", nil, fmt.Errorf("cannot decode signed history: %w", err)
+	}
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(sh.PubKey)
+	if err != nil {
+		return "", nil, err
+	}
+	pubKey, err := ic.UnmarshalPublicKey(pubKeyBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(sh.Sig)
+	if err != nil {
+		return "", nil, err
+	}
+	ok, err := pubKey.Verify(append([]byte(historySigDomain), sh.Records...), sig)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		return "", nil, errors.New("invalid history signature")
+	}
+	signer, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var records []HeadRecord
+	if err = json.Unmarshal(sh.Records, &records); err != nil {
+		return "", nil, fmt.Errorf("cannot decode history records: %w", err)
+	}
+	return signer, records, nil
+}
+
+// CheckHistory checks that the head records, ordered from oldest to latest,
+// show monotonic progress: each record has a greater sequence number, and a
+// time no earlier, than the previous record.
+func CheckHistory(records []HeadRecord) error {
+	for i := 1; i < len(records); i++ {
+		if records[i].Seq <= records[i-1].Seq {
+			return fmt.Errorf("head sequence %d does not follow %d", records[i].Seq, records[i-1].Seq)
+		}
+		if records[i].Time.Before(records[i-1].Time) {
+			return fmt.Errorf("head %s published before previous head %s", records[i].Cid, records[i-1].Cid)
+		}
+	}
+	return nil
+}
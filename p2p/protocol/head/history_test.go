@@ -0,0 +1,214 @@
+package head_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/p2p/protocol/head"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestHistory(t *testing.T) {
+	cids, err := test.RandomCids(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := head.NewHistory(3)
+	for _, c := range cids {
+		h.Add(c)
+		// Repeating the latest head does not add a record.
+		h.Add(c)
+	}
+
+	records := h.Records()
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+	for i, rec := range records {
+		if rec.Cid != cids[i+1] {
+			t.Fatalf("record %d has wrong cid", i)
+		}
+		if rec.Seq != uint64(i+2) {
+			t.Fatalf("record %d has sequence %d", i, rec.Seq)
+		}
+	}
+	if err = head.CheckHistory(records); err != nil {
+		t.Fatal(err)
+	}
+
+	records[1].Seq = records[0].Seq
+	if err = head.CheckHistory(records); err == nil {
+		t.Fatal("expected error for repeated sequence number")
+	}
+}
+
+func TestLoadHistory(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+	cids, err := test.RandomCids(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := head.LoadHistory(ctx, ds, "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cids[:3] {
+		if err = h.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reload the history with a smaller limit, as if the publisher restarted.
+	h, err = head.LoadHistory(ctx, ds, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := h.Records()
+	if len(records) != 2 || records[0].Cid != cids[1] || records[1].Cid != cids[2] {
+		t.Fatal("unexpected records after reload", records)
+	}
+
+	// Sequence numbers continue from before the restart.
+	if err = h.Add(cids[3]); err != nil {
+		t.Fatal(err)
+	}
+	records = h.Records()
+	if last := records[len(records)-1]; last.Cid != cids[3] || last.Seq != 4 {
+		t.Fatalf("expected sequence 4 for new head, got %d", last.Seq)
+	}
+	if err = head.CheckHistory(records); err != nil {
+		t.Fatal(err)
+	}
+
+	// Histories stored under different keys are separate.
+	other, err := head.LoadHistory(ctx, ds, "/other", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other.Records()) != 0 {
+		t.Fatal("expected empty history under other key")
+	}
+}
+
+func TestSignedHistory(t *testing.T) {
+	privKey, pubKey, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cids, err := test.RandomCids(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := head.NewHistory(10)
+	for _, c := range cids {
+		h.Add(c)
+	}
+	data, err := head.EncodeSignedHistory(h.Records(), privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, records, err := head.DecodeSignedHistory(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer != peerID {
+		t.Fatal("wrong signer")
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+	for i, rec := range h.Records() {
+		if records[i].Cid != rec.Cid || records[i].Seq != rec.Seq || !records[i].Time.Equal(rec.Time) {
+			t.Fatalf("record %d does not match", i)
+		}
+	}
+
+	// Replace the signed records with different records.
+	var signed map[string]json.RawMessage
+	if err = json.Unmarshal(data, &signed); err != nil {
+		t.Fatal(err)
+	}
+	records[0].Seq = 9
+	if signed["records"], err = json.Marshal(records); err != nil {
+		t.Fatal(err)
+	}
+	tampered, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = head.DecodeSignedHistory(tampered); err == nil {
+		t.Fatal("expected error decoding tampered history")
+	}
+}
+
+func TestQueryHistory(t *testing.T) {
+	publisher, _ := libp2p.New()
+	client, _ := libp2p.New()
+	client.Peerstore().AddAddrs(publisher.ID(), publisher.Addrs(), time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Publisher without history.
+	p := head.NewPublisher()
+	go p.Serve(publisher, "nohistory")
+	defer p.Close()
+	if _, err := head.QueryHistory(ctx, client, "nohistory", publisher.ID()); err == nil {
+		t.Fatal("expected error querying publisher without history")
+	}
+
+	if _, err := head.NewPublisherWithHistory(head.NewHistory(5), nil); err == nil {
+		t.Fatal("expected error creating publisher with history and no private key")
+	}
+	p, err := head.NewPublisherWithHistory(head.NewHistory(5), publisher.Peerstore().PrivKey(publisher.ID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(publisher, "test")
+	defer p.Close()
+
+	cids, err := test.RandomCids(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cids {
+		if err := p.UpdateRoot(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := head.QueryHistory(ctx, client, "test", publisher.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Cid != cids[0] || records[1].Cid != cids[1] {
+		t.Fatal("unexpected head history", records)
+	}
+	if err = head.CheckHistory(records); err != nil {
+		t.Fatal(err)
+	}
+
+	// The latest head is still served as before.
+	c, err := head.QueryRootCid(ctx, client, "test", publisher.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != cids[1] {
+		t.Fatal("wrong head")
+	}
+}
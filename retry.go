@@ -0,0 +1,132 @@
+package legs
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/ipfs/go-cid"
+)
+
+// RetryPolicy determines how failed syncs, that were started by announce
+// messages, are retried. A sync waits before each retry, with the wait time
+// doubling after each attempt. A retry is cancelled if another announce from
+// the same publisher arrives while waiting, since the new announce supersedes
+// the failed one.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a sync is attempted,
+	// including the first attempt.
+	MaxAttempts int
+	// BaseBackoff is the time to wait before the first retry.
+	BaseBackoff time.Duration
+	// MaxBackoff limits the time to wait before any retry. Zero means no
+	// limit.
+	MaxBackoff time.Duration
+	// Jitter is the fraction, from 0 to 1, of each wait time that is
+	// randomized to avoid retrying syncs with many publishers in lockstep.
+	Jitter float64
+	// Retryable determines whether a sync that failed with the given error is
+	// retried. If nil, all errors are retried except for context cancellation
+	// and errors that a retry cannot fix: ErrChainFork, an invalid signature,
+	// or a block that is too large.
+	Retryable func(error) bool
+}
+
+// retryable returns true if a sync that failed with err should be retried.
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	switch {
+	case errors.Is(err, context.Canceled),
+		errors.Is(err, ErrChainFork),
+		errors.Is(err, dtsync.ErrBadSignature),
+		errors.Is(err, httpsync.ErrBlockSignature),
+		errors.Is(err, httpsync.ErrBlockTooLarge):
+		return false
+	}
+	return true
+}
+
+// backoff returns the time to wait after the given number of failed attempts.
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+	d := p.BaseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if p.MaxBackoff != 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff != 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter != 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// waitRetry waits before retrying a failed sync. Returns false if the retry is
+// cancelled because another announce is waiting to be handled, the context is
+// cancelled, the Subscriber is closed, or the latest sync changed while
+// waiting.
+//
+// The caller must hold latestSyncMu, which is released while waiting so that
+// other syncs with the publisher are not blocked, and is held again when
+// waitRetry returns.
+func (h *handler) waitRetry(ctx context.Context, d time.Duration) bool {
+	h.qlock.Lock()
+	if h.pendingCid != cid.Undef || len(h.queue) != 0 {
+		h.qlock.Unlock()
+		return false
+	}
+	cancelRetry := make(chan struct{})
+	h.retryCancel = cancelRetry
+	h.qlock.Unlock()
+
+	defer func() {
+		h.qlock.Lock()
+		if h.retryCancel == cancelRetry {
+			h.retryCancel = nil
+		}
+		h.qlock.Unlock()
+	}()
+
+	latest, _ := h.subscriber.latestSyncHander.GetLatestSync(h.peerID)
+	h.latestSyncMu.Unlock()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	var timedOut bool
+	select {
+	case <-t.C:
+		timedOut = true
+	case <-cancelRetry:
+		log.Infow("Retry cancelled by new announce", "peer", h.peerID)
+	case <-ctx.Done():
+	case <-h.subscriber.closing:
+	}
+	h.latestSyncMu.Lock()
+	if !timedOut {
+		return false
+	}
+
+	// A sync that completed while waiting, such as an explicit call to Sync,
+	// supersedes the retry. Retrying would sync an older head, which does not
+	// lead to the latest sync.
+	if c, _ := h.subscriber.latestSyncHander.GetLatestSync(h.peerID); c != latest {
+		log.Infow("Retry superseded by newer sync", "peer", h.peerID, "latestSync", c)
+		return false
+	}
+	return true
+}
+
+// cancelRetry cancels any retry that is waiting. The caller must hold qlock.
+func (h *handler) cancelRetry() {
+	if h.retryCancel != nil {
+		close(h.retryCancel)
+		h.retryCancel = nil
+	}
+}
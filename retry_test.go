@@ -0,0 +1,199 @@
+package legs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-legs/dtsync"
+	"github.com/filecoin-project/go-legs/httpsync"
+	"github.com/filecoin-project/go-legs/test"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{
+		MaxAttempts: 10,
+		BaseBackoff: time.Second,
+		MaxBackoff:  5 * time.Second,
+	}
+	require.Equal(t, time.Second, p.backoff(1))
+	require.Equal(t, 2*time.Second, p.backoff(2))
+	require.Equal(t, 4*time.Second, p.backoff(3))
+	require.Equal(t, 5*time.Second, p.backoff(4))
+	require.Equal(t, 5*time.Second, p.backoff(100))
+
+	p.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		d := p.backoff(2)
+		require.LessOrEqual(t, d, 2*time.Second)
+		require.GreaterOrEqual(t, d, time.Second)
+	}
+
+	require.True(t, p.retryable(context.DeadlineExceeded))
+	require.False(t, p.retryable(context.Canceled))
+	require.False(t, p.retryable(fmt.Errorf("sync handler failed: %w", ErrChainFork)))
+	require.False(t, p.retryable(fmt.Errorf("%w: signed by someone else", dtsync.ErrBadSignature)))
+	require.False(t, p.retryable(httpsync.ErrBlockSignature))
+	require.False(t, p.retryable(httpsync.ErrBlockTooLarge))
+}
+
+func TestSyncRetry(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		BaseBackoff: 10 * time.Millisecond,
+	}
+	sub, err := NewSubscriber(test.MkTestHost(), ds, test.MkLinkSystem(ds), testTopic, nil, SyncRetry(policy))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	failed, cancel := sub.OnSyncFailed()
+	defer cancel()
+
+	// Nothing is listening on this address, so every attempt fails.
+	addrs := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/1/http")}
+	pubID := test.MkTestHost().ID()
+	cids, err := test.RandomCids(2)
+	require.NoError(t, err)
+
+	require.NoError(t, sub.Announce(context.Background(), cids[0], pubID, addrs))
+	select {
+	case event := <-failed:
+		require.Equal(t, cids[0], event.Cid)
+		require.Equal(t, 3, event.Attempts)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sync failed event")
+	}
+}
+
+func TestSyncRetryCancel(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		BaseBackoff: time.Hour,
+	}
+	sub, err := NewSubscriber(test.MkTestHost(), ds, test.MkLinkSystem(ds), testTopic, nil, SyncRetry(policy))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	failed, cancel := sub.OnSyncFailed()
+	defer cancel()
+
+	addrs := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/1/http")}
+	pubID := test.MkTestHost().ID()
+	cids, err := test.RandomCids(2)
+	require.NoError(t, err)
+
+	require.NoError(t, sub.Announce(context.Background(), cids[0], pubID, addrs))
+	hnd, err := sub.getOrCreateHandler(pubID, true)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		hnd.qlock.Lock()
+		defer hnd.qlock.Unlock()
+		return hnd.retryCancel != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Check that a waiting retry does not block other syncs with the
+	// publisher.
+	syncErr := make(chan error, 1)
+	go func() {
+		_, err := sub.Sync(context.Background(), pubID, cids[1], nil, addrs[0], AlwaysUpdateLatest())
+		syncErr <- err
+	}()
+	select {
+	case err = <-syncErr:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync blocked by waiting retry")
+	}
+
+	// Check that a new announce cancels a waiting retry.
+	require.NoError(t, sub.Announce(context.Background(), cids[1], pubID, addrs))
+	select {
+	case event := <-failed:
+		require.Equal(t, cids[0], event.Cid)
+		require.Equal(t, 1, event.Attempts)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sync failed event")
+	}
+}
+
+func TestSyncRetrySuperseded(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		BaseBackoff: 200 * time.Millisecond,
+	}
+	sub, err := NewSubscriber(test.MkTestHost(), ds, test.MkLinkSystem(ds), testTopic, nil, SyncRetry(policy))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	failed, cancel := sub.OnSyncFailed()
+	defer cancel()
+
+	addrs := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/1/http")}
+	pubID := test.MkTestHost().ID()
+	cids, err := test.RandomCids(2)
+	require.NoError(t, err)
+
+	require.NoError(t, sub.Announce(context.Background(), cids[0], pubID, addrs))
+	hnd, err := sub.getOrCreateHandler(pubID, true)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		hnd.qlock.Lock()
+		defer hnd.qlock.Unlock()
+		return hnd.retryCancel != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Advance the latest sync while the retry is waiting. The retry is then
+	// dropped instead of syncing the older head.
+	require.NoError(t, sub.SetLatestSync(pubID, cids[1]))
+	select {
+	case event := <-failed:
+		require.Equal(t, cids[0], event.Cid)
+		require.Equal(t, 1, event.Attempts)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sync failed event")
+	}
+	require.Equal(t, cids[1], sub.GetLatestSync(pubID).(cidlink.Link).Cid)
+}
+
+func TestSyncRetryOption(t *testing.T) {
+	var cfg config
+	require.Error(t, cfg.apply([]Option{SyncRetry(RetryPolicy{})}))
+	require.Error(t, cfg.apply([]Option{SyncRetry(RetryPolicy{MaxAttempts: 1, Jitter: 2})}))
+	require.NoError(t, cfg.apply([]Option{SyncRetry(RetryPolicy{MaxAttempts: 1})}))
+}
+
+func TestSyncFailedSlowReader(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	sub, err := NewSubscriber(test.MkTestHost(), ds, test.MkLinkSystem(ds), testTopic, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	failed, cancel := sub.OnSyncFailed()
+	defer cancel()
+
+	// Sending more notifications than the channel holds must not block while
+	// the reader is not reading.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < syncFailedBufferSize+1; i++ {
+			sub.sendSyncFailed(SyncFailed{Attempts: i + 1})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out sending sync failed notifications")
+	}
+	require.Len(t, failed, syncFailedBufferSize)
+	require.Equal(t, 1, (<-failed).Attempts)
+}
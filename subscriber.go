@@ -6,12 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/filecoin-project/go-legs/dtsync"
 	"github.com/filecoin-project/go-legs/gpubsub"
 	"github.com/filecoin-project/go-legs/httpsync"
 	"github.com/filecoin-project/go-legs/mautil"
+	"github.com/filecoin-project/go-legs/p2p/protocol/announce"
 	"github.com/hashicorp/go-multierror"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
@@ -41,6 +43,20 @@ const (
 	// defaultIdleHandlerTTL is the default time after which idle publisher
 	// handlers are removed.
 	defaultIdleHandlerTTL = time.Hour
+
+	// defaultResubscribeBaseBackoff and defaultResubscribeMaxBackoff are the
+	// default waits before attempts to resubscribe to a failed pubsub
+	// subscription.
+	defaultResubscribeBaseBackoff = time.Second
+	defaultResubscribeMaxBackoff  = time.Minute
+
+	// defaultAnnounceTimeSkew is the default of how far the timestamp of a
+	// signed announce may be from the current time.
+	defaultAnnounceTimeSkew = 10 * time.Minute
+
+	// syncFailedBufferSize is the capacity of each OnSyncFailed channel.
+	// Notifications are dropped for a reader whose channel is full.
+	syncFailedBufferSize = 16
 )
 
 // errSourceNotAllowed is the error returned when a message source peer's
@@ -48,6 +64,24 @@ const (
 // pre-allocated here as it may occur frequently.
 var errSourceNotAllowed = errors.New("message source not allowed")
 
+// errUnsignedRelay is the reason given for ignoring a re-published announce
+// that is not signed by the original publisher. See RejectUnsignedRelays.
+var errUnsignedRelay = errors.New("re-published announce not signed by original publisher")
+
+// errNoSource is the reason given for ignoring an announce that is neither
+// re-published nor from a known source, such as an unsigned pubsub message.
+var errNoSource = errors.New("announce has no source or original publisher")
+
+// ErrStaleAnnounce is returned when an announce message has a sequence number
+// that is not greater than that of the last accepted announce from the same
+// publisher.
+var ErrStaleAnnounce = errors.New("announce is older than last accepted announce")
+
+// ErrAnnounceTimeSkew is returned when a signed announce message with a
+// sequence number has a timestamp that is too far from the current time. See
+// AnnounceTimeSkew.
+var ErrAnnounceTimeSkew = errors.New("announce timestamp outside of allowed time skew")
+
 // AllowPeerFunc is the signature of a function given to Subscriber that
 // determines whether to allow or reject messages originating from a peer
 // passed into the function. Returning true or false indicates that messages
@@ -64,10 +98,11 @@ type BlockHookFunc func(peer.ID, cid.Cid, SegmentSyncActions)
 //
 // Messages from separate peers are handled concurrently, and multiple messages
 // from the same peer are handled serially. If a handler is busy handling a
-// message, and more messages arrive from the same peer, then the last message
-// replaces the previous unhandled message to avoid having to maintain queues
-// of messages. Handlers do not have persistent goroutines, but start a new
-// goroutine to handle a single message.
+// message, and more messages arrive from the same peer, then by default the
+// last message replaces the previous unhandled message to avoid having to
+// maintain queues of messages. The AnnounceQueue option can be used to keep a
+// bounded queue of unhandled messages instead. Handlers do not have persistent
+// goroutines, but start a new goroutine to handle messages.
 type Subscriber struct {
 	// dss captures the default selector sequence passed to
 	// ExploreRecursiveWithStopNode.
@@ -76,9 +111,16 @@ type Subscriber struct {
 
 	addrTTL   time.Duration
 	filterIPs bool
-	psub      *pubsub.Subscription
-	topic     *pubsub.Topic
-	topicName string
+	// psub and topic are nil if the Subscriber does not use pubsub. psub is
+	// replaced when the watch function resubscribes to the topic.
+	psub       *pubsub.Subscription
+	psubMutex  sync.Mutex
+	topic      *pubsub.Topic
+	topicName  string
+	resubRetry RetryPolicy
+	// announceReceiver receives announce messages sent over the announce
+	// stream protocol, if enabled.
+	announceReceiver *announce.Receiver
 
 	allowPeer     AllowPeerFunc
 	handlers      map[peer.ID]*handler
@@ -100,6 +142,14 @@ type Subscriber struct {
 	outEventsChans []chan SyncFinished
 	outEventsMutex sync.Mutex
 
+	// outFailedChans is a slice of channels, where each channel delivers a
+	// copy of a SyncFailed to an OnSyncFailed reader.
+	outFailedChans []chan SyncFailed
+	outFailedMutex sync.Mutex
+
+	// syncEvents delivers SyncEvents to OnSyncEvent readers.
+	syncEvents *syncEvents
+
 	// closing signals that the Subscriber is closing.
 	closing chan struct{}
 	// cancelps cancels pubsub.
@@ -112,6 +162,7 @@ type Subscriber struct {
 
 	dtSync       *dtsync.Sync
 	httpSync     *httpsync.Sync
+	lsys         ipld.LinkSystem
 	syncRecLimit selector.RecursionLimit
 
 	// A separate peerstore is used to store HTTP addresses. This is necessary
@@ -125,10 +176,34 @@ type Subscriber struct {
 	idleHandlerTTL   time.Duration
 	latestSyncHander LatestSyncHandler
 
+	// checkpoints stores the progress of syncs so that they can be resumed.
+	// This is nil if resumable sync is not enabled.
+	checkpoints *checkpointStore
+
 	segDepthLimit int64
 
 	rateLimiterFor RateLimiterFor
 	resendAnnounce bool
+	// rejectUnsignedRelays is true if re-published announces must be signed
+	// by the original publisher.
+	rejectUnsignedRelays bool
+
+	announceQueueDepth  int
+	announceQueuePolicy AnnounceQueuePolicy
+	retryPolicy         *RetryPolicy
+	forkPolicy          ChainForkPolicy
+	forkDecide          func(ChainFork) bool
+	// checkHeadHistory is true if announced heads are checked against the
+	// publisher's head history.
+	checkHeadHistory bool
+	// announceSeqs holds the sequence number of the last accepted announce
+	// from each publisher.
+	announceSeqs     *announceSeqs
+	announceTimeSkew time.Duration
+	// droppedAnnounces and coalescedAnnounces count unhandled announces. These
+	// are accessed atomically.
+	droppedAnnounces   uint64
+	coalescedAnnounces uint64
 }
 
 // SyncFinished notifies an OnSyncFinished reader that a specified peer
@@ -145,6 +220,24 @@ type SyncFinished struct {
 	SyncedCids []cid.Cid
 }
 
+// SyncFailed notifies an OnSyncFailed reader that a sync with a publisher,
+// started by an announce message, failed. Failures of syncs started by calling
+// Sync are returned to the caller instead.
+type SyncFailed struct {
+	// Cid is the CID that the failed sync was syncing to.
+	Cid cid.Cid
+	// PeerID identifies the publisher that the sync was with.
+	PeerID peer.ID
+	// Addrs are the publisher addresses given in the announce message.
+	Addrs []multiaddr.Multiaddr
+	// Transport is the transport that the sync used.
+	Transport Transport
+	// Err is the error that caused the sync to fail.
+	Err error
+	// Attempts is the number of times the sync was attempted.
+	Attempts int
+}
+
 // handler holds state that is specific to a peer
 type handler struct {
 	subscriber *Subscriber
@@ -161,7 +254,17 @@ type handler struct {
 	pendingCid cid.Cid
 	// pendingSyncer is a syncer queued for handling pendingCid.
 	pendingSyncer Syncer
-	// qlock protects the pendingCid and pendingSyncer.
+	// pendingAddrs are the publisher addresses announced with pendingCid.
+	pendingAddrs []multiaddr.Multiaddr
+	// queue holds announces waiting to be handled, if an announce queue is
+	// configured.
+	queue []pendingAnnounce
+	// queueRunning is true while a goroutine is handling queued announces.
+	queueRunning bool
+	// retryCancel, if not nil, is closed to cancel a retry that is waiting.
+	retryCancel chan struct{}
+	// qlock protects the pendingCid, pendingSyncer, pendingAddrs, queue, and
+	// retryCancel.
 	qlock sync.Mutex
 	// expires is the time the handler is removed if it remains idle.
 	expires time.Time
@@ -182,46 +285,69 @@ func wrapBlockHook() (*sync.RWMutex, map[peer.ID]func(peer.ID, cid.Cid), func(pe
 	}
 }
 
-// NewSubscriber creates a new Subscriber that process pubsub messages.
+// NewSubscriber creates a new Subscriber that process pubsub messages, unless
+// the NoPubsub option is used. The link system must be safe for concurrent
+// use, since syncs over HTTP fetch blocks in parallel. See
+// httpsync.FetchConcurrency.
 func NewSubscriber(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem, topic string, dss ipld.Node, options ...Option) (*Subscriber, error) {
 	cfg := config{
 		addrTTL:        defaultAddrTTL,
 		idleHandlerTTL: defaultIdleHandlerTTL,
 		segDepthLimit:  defaultSegDepthLimit,
+
+		resubBaseBackoff: defaultResubscribeBaseBackoff,
+		resubMaxBackoff:  defaultResubscribeMaxBackoff,
+
+		announceTimeSkew: defaultAnnounceTimeSkew,
 	}
 	err := cfg.apply(options)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.persistLatestSync && cfg.latestSyncHandler == nil && ds == nil {
+		return nil, errors.New("datastore required to persist latest sync")
+	}
+	if cfg.resumableSync && ds == nil {
+		return nil, errors.New("datastore required for resumable sync")
+	}
 
-	ctx, cancelPubsub := context.WithCancel(context.Background())
-
-	var pubsubTopic *pubsub.Topic
-	if cfg.topic == nil {
-		pubsubTopic, err = gpubsub.MakePubsub(ctx, host, topic)
-		if err != nil {
-			cancelPubsub()
-			return nil, err
-		}
-		cfg.topic = pubsubTopic
+	if len(cfg.pubsubOptions) != 0 && (cfg.topic != nil || cfg.noPubsub) {
+		return nil, errors.New("pubsub options cannot be used with Topic or NoPubsub option")
 	}
-	psub, err := cfg.topic.Subscribe()
-	if err != nil {
-		cancelPubsub()
-		return nil, err
+	if cfg.noPubsub {
+		if cfg.topic != nil {
+			return nil, errors.New("topic cannot be used with NoPubsub option")
+		}
+		if cfg.resendAnnounce {
+			return nil, errors.New("resend announce cannot be used with NoPubsub option")
+		}
 	}
 
+	ctx, cancelPubsub := context.WithCancel(context.Background())
+
 	scopedBlockHookMutex, scopedBlockHook, blockHook := wrapBlockHook()
+	syncEvents := newSyncEvents()
+
+	var checkpoints *checkpointStore
+	if cfg.resumableSync {
+		checkpoints = newCheckpointStore(ds, cfg.checkpointPrefix)
+		// Observe the blocks written by syncs, to track their frontiers.
+		lsys.StorageWriteOpener = checkpoints.observeWrites(lsys.StorageWriteOpener)
+	}
 
 	var dtSync *dtsync.Sync
+	dtOpts := []dtsync.SyncOption{
+		dtsync.BlockSizeHook(syncEvents.blockReceived),
+		dtsync.RateLimitWaitHook(syncEvents.rateLimitWait),
+	}
 	if cfg.dtManager != nil {
 		if ds != nil {
 			cancelPubsub()
 			return nil, fmt.Errorf("datastore cannot be used with DtManager option")
 		}
-		dtSync, err = dtsync.NewSyncWithDT(host, cfg.dtManager, cfg.graphExchange, &lsys, blockHook)
+		dtSync, err = dtsync.NewSyncWithDT(host, cfg.dtManager, cfg.graphExchange, &lsys, blockHook, dtOpts...)
 	} else {
-		dtSync, err = dtsync.NewSync(host, ds, lsys, blockHook)
+		dtSync, err = dtsync.NewSync(host, ds, lsys, blockHook, dtOpts...)
 	}
 	if err != nil {
 		cancelPubsub()
@@ -236,7 +362,25 @@ func NewSubscriber(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem,
 
 	latestSyncHandler := cfg.latestSyncHandler
 	if latestSyncHandler == nil {
-		latestSyncHandler = &DefaultLatestSyncHandler{}
+		if cfg.persistLatestSync {
+			latestSyncHandler = NewDsLatestSyncHandler(ds, cfg.latestSyncPrefix)
+		} else {
+			latestSyncHandler = &DefaultLatestSyncHandler{}
+		}
+	}
+
+	// The hooks that report sync events are applied last, so that they are
+	// not replaced by the configured options.
+	httpSyncOptions := append(cfg.httpSyncOptions,
+		httpsync.BlockSizeHook(syncEvents.blockReceived),
+		httpsync.RateLimitWaitHook(syncEvents.rateLimitWait))
+	httpSync := httpsync.NewSync(lsys, cfg.httpClient, blockHook, httpSyncOptions...)
+
+	// Announce sequence numbers are persisted along with the latest syncs, so
+	// that announces from before a restart cannot be replayed.
+	var seqStore datastore.Datastore
+	if cfg.persistLatestSync && ds != nil {
+		seqStore = ds
 	}
 
 	s := &Subscriber{
@@ -245,9 +389,12 @@ func NewSubscriber(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem,
 
 		addrTTL:   cfg.addrTTL,
 		filterIPs: cfg.filterIPs,
-		psub:      psub,
-		topic:     cfg.topic,
-		topicName: cfg.topic.String(),
+		topicName: topic,
+		resubRetry: RetryPolicy{
+			BaseBackoff: cfg.resubBaseBackoff,
+			MaxBackoff:  cfg.resubMaxBackoff,
+			Jitter:      0.1,
+		},
 		closing:   make(chan struct{}),
 		cancelps:  cancelPubsub,
 		watchDone: make(chan struct{}),
@@ -256,8 +403,11 @@ func NewSubscriber(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem,
 		handlers:  make(map[peer.ID]*handler),
 		inEvents:  make(chan SyncFinished, 1),
 
+		syncEvents: syncEvents,
+
 		dtSync:       dtSync,
-		httpSync:     httpsync.NewSync(lsys, cfg.httpClient, blockHook),
+		httpSync:     httpSync,
+		lsys:         lsys,
 		syncRecLimit: cfg.syncRecLimit,
 
 		httpPeerstore: httpPeerstore,
@@ -268,14 +418,56 @@ func NewSubscriber(host host.Host, ds datastore.Batching, lsys ipld.LinkSystem,
 
 		idleHandlerTTL:   cfg.idleHandlerTTL,
 		latestSyncHander: latestSyncHandler,
+		checkpoints:      checkpoints,
 
 		segDepthLimit:  cfg.segDepthLimit,
 		rateLimiterFor: cfg.rateLimiterFor,
 		resendAnnounce: cfg.resendAnnounce,
+
+		rejectUnsignedRelays: cfg.rejectUnsignedRelays,
+
+		announceQueueDepth:  cfg.announceQueueDepth,
+		announceQueuePolicy: cfg.announceQueuePolicy,
+		retryPolicy:         cfg.retryPolicy,
+		forkPolicy:          cfg.forkPolicy,
+		forkDecide:          cfg.forkDecide,
+		checkHeadHistory:    cfg.checkHeadHistory,
+		announceSeqs:        newAnnounceSeqs(seqStore),
+		announceTimeSkew:    cfg.announceTimeSkew,
+	}
+
+	// The pubsub topic is joined after the Subscriber is created, so that
+	// the topic validator can check messages against its AllowPeerFunc.
+	if !cfg.noPubsub {
+		if cfg.topic == nil {
+			psOpts := append(cfg.pubsubOptions, gpubsub.Validator(dtsync.NewValidator(s.isPeerAllowed)))
+			cfg.topic, err = gpubsub.MakePubsub(ctx, host, topic, psOpts...)
+			if err != nil {
+				cancelPubsub()
+				dtSync.Close()
+				return nil, err
+			}
+		}
+		s.psub, err = cfg.topic.Subscribe()
+		if err != nil {
+			cancelPubsub()
+			dtSync.Close()
+			return nil, err
+		}
+		s.topic = cfg.topic
+		s.topicName = cfg.topic.String()
+	}
+
+	if cfg.streamAnnounce {
+		s.announceReceiver = announce.NewReceiver(host, s.topicName, s.handleAnnounceData)
 	}
 
 	// Start watcher to read pubsub messages.
-	go s.watch(ctx)
+	if s.psub != nil {
+		go s.watch(ctx)
+	} else {
+		close(s.watchDone)
+	}
 	// Start distributor to send SyncFinished messages to interested parties.
 	go s.distributeEvents()
 	// Start goroutine to remove idle publisher handlers.
@@ -329,6 +521,14 @@ func (s *Subscriber) SetAllowPeer(allowPeer AllowPeerFunc) {
 	s.allowPeer = allowPeer
 }
 
+// isPeerAllowed returns true if the AllowPeerFunc allows messages from the
+// peer.
+func (s *Subscriber) isPeerAllowed(peerID peer.ID) bool {
+	s.handlersMutex.Lock()
+	defer s.handlersMutex.Unlock()
+	return s.allowPeer == nil || s.allowPeer(peerID)
+}
+
 // Close shuts down the Subscriber.
 func (s *Subscriber) Close() error {
 	var err error
@@ -342,8 +542,19 @@ func (s *Subscriber) doClose() error {
 	// Cancel idle handler cleaner.
 	close(s.closing)
 
+	if s.announceReceiver != nil {
+		s.announceReceiver.Close()
+	}
+
 	// Cancel pubsub and Wait for pubsub watcher to exit.
-	s.psub.Cancel()
+	// Cancel the subscription while holding the lock, so that the watch
+	// function, having seen that the Subscriber is closing, does not
+	// resubscribe.
+	s.psubMutex.Lock()
+	if s.psub != nil {
+		s.psub.Cancel()
+	}
+	s.psubMutex.Unlock()
 	<-s.watchDone
 	s.asyncWG.Wait()
 
@@ -367,6 +578,13 @@ func (s *Subscriber) doClose() error {
 	}
 	s.outEventsChans = nil
 	s.outEventsMutex.Unlock()
+	s.outFailedMutex.Lock()
+	for _, ch := range s.outFailedChans {
+		close(ch)
+	}
+	s.outFailedChans = nil
+	s.outFailedMutex.Unlock()
+	s.syncEvents.close()
 
 	// Shutdown pubsub services.
 	s.cancelps()
@@ -409,6 +627,55 @@ func (s *Subscriber) OnSyncFinished() (<-chan SyncFinished, context.CancelFunc)
 	return ch, cncl
 }
 
+// OnSyncFailed creates a channel that receives notifications of failed syncs
+// that were started by announce messages, and adds that channel to the list of
+// notification channels.
+//
+// A notification is dropped if the channel is full, so the reader must read
+// the channel promptly to receive every notification.
+//
+// Calling the returned cancel function removes the notification channel from
+// the list of channels to be notified, and it closes the channel to allow any
+// reading goroutines to stop waiting on the channel.
+func (s *Subscriber) OnSyncFailed() (<-chan SyncFailed, context.CancelFunc) {
+	// Channel is buffered so that a reader that is not reading the channel
+	// immediately does not miss notifications.
+	ch := make(chan SyncFailed, syncFailedBufferSize)
+	s.outFailedMutex.Lock()
+	defer s.outFailedMutex.Unlock()
+
+	s.outFailedChans = append(s.outFailedChans, ch)
+	cncl := func() {
+		s.outFailedMutex.Lock()
+		defer s.outFailedMutex.Unlock()
+		for i, ca := range s.outFailedChans {
+			if ca == ch {
+				s.outFailedChans[i] = s.outFailedChans[len(s.outFailedChans)-1]
+				s.outFailedChans[len(s.outFailedChans)-1] = nil
+				s.outFailedChans = s.outFailedChans[:len(s.outFailedChans)-1]
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cncl
+}
+
+// sendSyncFailed delivers the SyncFailed to all OnSyncFailed channel readers.
+// The notification is dropped for a reader whose channel is full, so that a
+// slow reader does not block the handler.
+func (s *Subscriber) sendSyncFailed(event SyncFailed) {
+	s.outFailedMutex.Lock()
+	defer s.outFailedMutex.Unlock()
+	for _, ch := range s.outFailedChans {
+		select {
+		case ch <- event:
+		default:
+			log.Warnw("Dropped sync failed notification for slow reader", "peer", event.PeerID)
+		}
+	}
+}
+
 // RemoveHandler removes a handler for a publisher.
 func (s *Subscriber) RemoveHandler(peerID peer.ID) bool {
 	s.handlersMutex.Lock()
@@ -642,72 +909,168 @@ func (s *Subscriber) idleHandlerCleaner() {
 // consulted to determine if the peer's messages are allowed. If allowed, a new
 // handler is created. Otherwise, the message is ignored.
 func (s *Subscriber) watch(ctx context.Context) {
+	defer close(s.watchDone)
+
+	psub := s.psub
 	for {
-		msg, err := s.psub.Next(ctx)
+		msg, err := psub.Next(ctx)
 		if err != nil {
-			if ctx.Err() != nil || err == pubsub.ErrSubscriptionCancelled {
+			if s.isClosing() || ctx.Err() != nil {
 				// This is a normal result of shutting down the Subscriber.
 				log.Debug("Canceled watching pubsub subscription")
-			} else {
-				log.Errorw("Error reading from pubsub", "err", err)
-				// TODO: restart subscription.
+				return
+			}
+			log.Errorw("Error reading from pubsub", "err", err)
+			if psub = s.resubscribe(ctx, err); psub == nil {
+				log.Debug("Canceled resubscribing to pubsub topic")
+				return
 			}
-			break
-		}
-
-		srcPeer, err := peer.IDFromBytes(msg.From)
-		if err != nil {
-			continue
-		}
-
-		// Decode CID and originator addresses from message.
-		m := dtsync.Message{}
-		if err = m.UnmarshalCBOR(bytes.NewBuffer(msg.Data)); err != nil {
-			log.Errorw("Could not decode pubsub message", "err", err)
 			continue
 		}
 
-		// Read publisher addresses from message.
-		var addrs []multiaddr.Multiaddr
-		if len(m.Addrs) != 0 {
-			addrs, err = m.GetAddrs()
+		// A message that is not signed by its source, because of the pubsub
+		// signature policy, has no source. It can still be handled if it
+		// was re-published with its original publisher.
+		var srcPeer peer.ID
+		if len(msg.From) != 0 {
+			srcPeer, err = peer.IDFromBytes(msg.From)
 			if err != nil {
-				log.Errorw("Could not decode pubsub message", "err", err)
 				continue
 			}
 		}
 
-		// If message has original peer set, then this is a republished message.
-		if m.OrigPeer != "" {
-			// Ignore re-published announce from this host.
-			if srcPeer == s.host.ID() {
-				log.Debug("Ignored rebuplished announce from self")
-				continue
-			}
+		if err = s.handleAnnounceData(ctx, srcPeer, msg.Data); err != nil {
+			logAnnounceErr(err, srcPeer)
+		}
+	}
+}
 
-			// Read the original publisher.
-			relayPeer := srcPeer
-			srcPeer, err = peer.Decode(m.OrigPeer)
-			if err != nil {
-				log.Errorw("Cannot read peerID from republished announce", "err", err)
-				continue
-			}
-			log.Infow("Handling re-published pubsub announce", "originPeer", srcPeer, "relayPeer", relayPeer)
-		} else {
-			log.Infow("Handling pubsub announce", "peer", srcPeer)
+// resubscribe subscribes to the pubsub topic again, after the subscription
+// failed with err. It waits, with increasing backoff, between attempts to
+// subscribe. Returns nil if the Subscriber is closed before it resubscribes.
+func (s *Subscriber) resubscribe(ctx context.Context, err error) *pubsub.Subscription {
+	s.syncEvents.pubsubLost(err)
+	lostAt := time.Now()
+
+	for attempts := 1; ; attempts++ {
+		backoff := s.resubRetry.backoff(attempts)
+		log.Infow("Resubscribing to pubsub topic", "topic", s.topicName, "delay", backoff.String())
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-s.closing:
+			timer.Stop()
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
 		}
 
-		if s.filterIPs {
-			addrs = mautil.FilterPrivateIPs(addrs)
+		// Check for closing while holding the lock, so that a subscription
+		// is not created after Close cancels the current one.
+		s.psubMutex.Lock()
+		if s.isClosing() {
+			s.psubMutex.Unlock()
+			return nil
 		}
-		err = s.announce(ctx, m.Cid, srcPeer, addrs)
+		psub, err := s.topic.Subscribe()
+		if err == nil {
+			s.psub = psub
+		}
+		s.psubMutex.Unlock()
 		if err != nil {
-			log.Errorw("Cannot process message", "err", err)
+			log.Errorw("Cannot resubscribe to pubsub topic", "err", err, "topic", s.topicName, "attempts", attempts)
 			continue
 		}
+
+		outage := time.Since(lostAt)
+		log.Infow("Resubscribed to pubsub topic", "topic", s.topicName, "outage", outage.String())
+		s.syncEvents.pubsubRestored(outage)
+		return psub
+	}
+}
+
+// isClosing returns true if the Subscriber is closing.
+func (s *Subscriber) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleAnnounceData decodes and handles an announce message that was received
+// from srcPeer over pubsub or over the announce stream protocol. If the message
+// was re-published by a peer other than the original publisher, then it is
+// handled as an announce from the original publisher. Otherwise, srcPeer must
+// not be empty, as it is for an unsigned pubsub message.
+func (s *Subscriber) handleAnnounceData(ctx context.Context, srcPeer peer.ID, data []byte) error {
+	// Decode CID and originator addresses from message.
+	m := dtsync.Message{}
+	if err := m.UnmarshalCBOR(bytes.NewBuffer(data)); err != nil {
+		return fmt.Errorf("%w: %s", dtsync.ErrBadEncoding, err)
+	}
+
+	// Read publisher addresses from message.
+	var addrs []multiaddr.Multiaddr
+	if len(m.Addrs) != 0 {
+		var err error
+		addrs, err = m.GetAddrs()
+		if err != nil {
+			return fmt.Errorf("%w: %s", dtsync.ErrBadEncoding, err)
+		}
+	}
+
+	// If message has original peer set, then this is a republished message.
+	if m.OrigPeer != "" {
+		// Ignore re-published announce from this host.
+		if srcPeer == s.host.ID() {
+			log.Debug("Ignored rebuplished announce from self")
+			return nil
+		}
+
+		// Read the original publisher.
+		relayPeer := srcPeer
+		var err error
+		srcPeer, err = peer.Decode(m.OrigPeer)
+		if err != nil {
+			return fmt.Errorf("cannot read peerID from republished announce: %w", err)
+		}
+		if s.rejectUnsignedRelays && len(m.Signature) == 0 {
+			return errUnsignedRelay
+		}
+		log.Infow("Handling re-published announce", "originPeer", srcPeer, "relayPeer", relayPeer)
+	} else {
+		if srcPeer == "" {
+			return errNoSource
+		}
+		log.Infow("Handling announce", "peer", srcPeer)
+	}
+
+	if err := s.verifyAnnounce(srcPeer, &m); err != nil {
+		if err == errSourceNotAllowed {
+			log.Infow("Ignored announcement", "reason", err, "peer", srcPeer)
+			return nil
+		}
+		return err
 	}
 
-	close(s.watchDone)
+	if s.filterIPs {
+		addrs = mautil.FilterPrivateIPs(addrs)
+	}
+	return s.announce(ctx, m.Cid, srcPeer, addrs)
+}
+
+// logAnnounceErr logs the reason that an announce message from srcPeer was
+// not handled.
+func logAnnounceErr(err error, srcPeer peer.ID) {
+	switch {
+	case errors.Is(err, errUnsignedRelay), errors.Is(err, errNoSource), errors.Is(err, ErrStaleAnnounce), errors.Is(err, ErrAnnounceTimeSkew), errors.Is(err, dtsync.ErrBadSignature):
+		log.Infow("Ignored announcement", "reason", err, "peer", srcPeer)
+	default:
+		log.Errorw("Cannot process message", "err", err, "peer", srcPeer)
+	}
 }
 
 // Announce handles a direct announce message, that has not arrived over
@@ -717,24 +1080,92 @@ func (s *Subscriber) Announce(ctx context.Context, nextCid cid.Cid, peerID peer.
 	if s.filterIPs {
 		peerAddrs = mautil.FilterPrivateIPs(peerAddrs)
 	}
+	msg := dtsync.Message{
+		Cid: nextCid,
+	}
+	msg.SetAddrs(peerAddrs)
+	return s.AnnounceMessage(ctx, peerID, msg)
+}
 
-	err := s.announce(ctx, nextCid, peerID, peerAddrs)
+// AnnounceMessage handles a direct announce message from the publisher,
+// peerID, that has not arrived over pubsub. Unlike Announce, it keeps any
+// sequence number and signature in the message, so that an announce that is
+// older than the last accepted announce from the publisher is rejected with
+// ErrStaleAnnounce. If resendAnnounce is enabled, then the message is resent
+// over pubsub with the original peerID encoded into the message.
+func (s *Subscriber) AnnounceMessage(ctx context.Context, peerID peer.ID, msg dtsync.Message) error {
+	if err := s.verifyAnnounce(peerID, &msg); err != nil {
+		if err == errSourceNotAllowed {
+			log.Infow("Ignored announcement", "reason", err, "peer", peerID)
+			return nil
+		}
+		return err
+	}
+
+	peerAddrs, err := msg.GetAddrs()
+	if err != nil {
+		return fmt.Errorf("cannot decode announce addresses: %w", err)
+	}
+	if s.filterIPs {
+		peerAddrs = mautil.FilterPrivateIPs(peerAddrs)
+	}
+
+	err = s.announce(ctx, msg.Cid, peerID, peerAddrs)
 	if err != nil {
 		return err
 	}
 
 	if s.resendAnnounce {
-		err = s.republish(ctx, nextCid, peerID, peerAddrs)
+		// The addresses of a signed message cannot be changed without
+		// invalidating the signature, so it is re-published unchanged, and its
+		// receivers filter the addresses themselves.
+		if len(msg.Signature) == 0 && s.filterIPs {
+			msg.SetAddrs(peerAddrs)
+		}
+		err = s.republish(ctx, msg, peerID)
 		if err != nil {
 			log.Errorw("Cannot republish announce", "err", err)
 			return nil
 		}
-		log.Infow("Re-published direct announce message in pubsub channel", "cid", nextCid, "originPeer", peerID)
+		log.Infow("Re-published direct announce message in pubsub channel", "cid", msg.Cid, "originPeer", peerID)
 	}
 
 	return nil
 }
 
+// verifyAnnounce checks that the publisher is allowed, and that an announce
+// message with a sequence number, or a signature, is signed by the publisher.
+// A message with a sequence number must also have a timestamp within the
+// allowed time skew, and be newer than the last accepted announce from the
+// publisher. For a re-published message, peerID is the original publisher, so
+// a relay cannot forge a signed announce from another publisher. Messages
+// without a sequence number or signature are accepted from allowed
+// publishers.
+func (s *Subscriber) verifyAnnounce(peerID peer.ID, msg *dtsync.Message) error {
+	if !s.isPeerAllowed(peerID) {
+		return errSourceNotAllowed
+	}
+	if msg.Seq == 0 && len(msg.Signature) == 0 {
+		return nil
+	}
+	signer, err := msg.VerifySignature()
+	if err != nil {
+		return err
+	}
+	if signer != peerID {
+		return fmt.Errorf("%w: signed by %s instead of publisher", dtsync.ErrBadSignature, signer)
+	}
+	if msg.Seq == 0 {
+		return nil
+	}
+
+	skew := time.Since(time.Unix(0, msg.Timestamp))
+	if msg.Timestamp == 0 || skew > s.announceTimeSkew || skew < -s.announceTimeSkew {
+		return ErrAnnounceTimeSkew
+	}
+	return s.announceSeqs.accept(peerID, msg.Seq)
+}
+
 func (s *Subscriber) announce(ctx context.Context, nextCid cid.Cid, peerID peer.ID, peerAddrs []multiaddr.Multiaddr) error {
 	hnd, err := s.getOrCreateHandler(peerID, false)
 	if err != nil {
@@ -752,17 +1183,13 @@ func (s *Subscriber) announce(ctx context.Context, nextCid cid.Cid, peerID peer.
 
 	// Start a new goroutine to handle this message instead of having a
 	// persistent goroutine for each peer.
-	hnd.handleAsync(ctx, nextCid, syncer)
+	hnd.handleAsync(ctx, nextCid, peerAddrs, syncer)
 
 	return nil
 }
 
-func (s *Subscriber) republish(ctx context.Context, nextCid cid.Cid, peerID peer.ID, addrs []multiaddr.Multiaddr) error {
-	msg := dtsync.Message{
-		Cid:      nextCid,
-		OrigPeer: peerID.String(),
-	}
-	msg.SetAddrs(addrs)
+func (s *Subscriber) republish(ctx context.Context, msg dtsync.Message, peerID peer.ID) error {
+	msg.OrigPeer = peerID.String()
 	msgBuf := bytes.NewBuffer(nil)
 	if err := msg.MarshalCBOR(msgBuf); err != nil {
 		return err
@@ -832,8 +1259,22 @@ func firstHTTPAddr(peerAddrs []multiaddr.Multiaddr) multiaddr.Multiaddr {
 // received over pubsub or HTTP. If there is already a goroutine handling a
 // sync, then there will be at most one more goroutine waiting to handle the
 // pending sync.
-func (h *handler) handleAsync(ctx context.Context, nextCid cid.Cid, syncer Syncer) {
+//
+// If an announce queue is configured, then the announce is queued instead of
+// replacing any pending announce. See AnnounceQueue.
+func (h *handler) handleAsync(ctx context.Context, nextCid cid.Cid, addrs []multiaddr.Multiaddr, syncer Syncer) {
+	if h.subscriber.announceQueueDepth > 0 {
+		h.enqueueAsync(ctx, pendingAnnounce{
+			c:      nextCid,
+			addrs:  addrs,
+			syncer: syncer,
+		})
+		return
+	}
+
 	h.qlock.Lock()
+	// A new announce supersedes any failed sync waiting to be retried.
+	h.cancelRetry()
 	// If pendingSync is undef, then previous goroutine has already handled any
 	// pendingSync, so start a new go routine to handle the pending sync. If
 	// pending sync is not undef, then there is an existing goroutine that has
@@ -848,36 +1289,86 @@ func (h *handler) handleAsync(ctx context.Context, nextCid cid.Cid, syncer Synce
 
 			// Wait for the parent goroutine to assign pending CID and unlock.
 			h.qlock.Lock()
-			c := h.pendingCid
+			pa := pendingAnnounce{
+				c:      h.pendingCid,
+				addrs:  h.pendingAddrs,
+				syncer: h.pendingSyncer,
+			}
 			h.pendingCid = cid.Undef
-			syncer := h.pendingSyncer
 			h.pendingSyncer = nil
+			h.pendingAddrs = nil
 			h.qlock.Unlock()
 
-			// Wait for this handler to become available. This only wraps the
-			// handler. This is to free up the handler in case someone else
-			// needs it while we wait to send on the events chan.
-			syncedCids, err := h.handle(ctx, c, h.subscriber.dss, true, syncer, h.subscriber.generalBlockHook, h.subscriber.segDepthLimit)
-			if err != nil {
-				// Log error for now.
-				log.Errorw("Cannot process message", "err", err, "peer", h.peerID)
-				return
-			}
-
-			// Update latest head seen.
-			log.Infow("Updating latest sync")
-			h.subscriber.latestSyncHander.SetLatestSync(h.peerID, c)
-			h.subscriber.inEvents <- SyncFinished{Cid: c, PeerID: h.peerID, SyncedCids: syncedCids}
+			h.syncAnnounced(ctx, pa)
 		}()
 	} else {
 		log.Infow("Pending update replaced by new", "previous_cid", h.pendingCid, "new_cid", nextCid)
+		atomic.AddUint64(&h.subscriber.droppedAnnounces, 1)
 	}
 	// Set the CID to be handled by the waiting goroutine.
 	h.pendingCid = nextCid
 	h.pendingSyncer = syncer
+	h.pendingAddrs = addrs
 	h.qlock.Unlock()
 }
 
+// syncAnnounced syncs the announced CID and updates the latest sync. The
+// caller must hold latestSyncMu.
+func (h *handler) syncAnnounced(ctx context.Context, pa pendingAnnounce) {
+	c := pa.c
+	if h.subscriber.checkHeadHistory {
+		if err := h.checkHeadHistory(ctx, c, pa.syncer); err != nil {
+			log.Errorw("Announced head failed head history check", "err", err, "peer", h.peerID, "cid", c)
+			h.subscriber.sendSyncFailed(SyncFailed{
+				Cid:       c,
+				PeerID:    h.peerID,
+				Addrs:     pa.addrs,
+				Transport: syncerTransport(pa.syncer),
+				Err:       err,
+				Attempts:  1,
+			})
+			return
+		}
+	}
+
+	retry := h.subscriber.retryPolicy
+	var syncedCids []cid.Cid
+	var err error
+	for attempts := 1; ; attempts++ {
+		// Wait for this handler to become available. This only wraps the
+		// handler. This is to free up the handler in case someone else
+		// needs it while we wait to send on the events chan.
+		syncedCids, err = h.handle(ctx, c, h.subscriber.dss, true, pa.syncer, h.subscriber.generalBlockHook, h.subscriber.segDepthLimit)
+		if err == nil {
+			break
+		}
+		log.Errorw("Cannot process message", "err", err, "peer", h.peerID, "attempts", attempts)
+
+		if retry != nil && attempts < retry.MaxAttempts && retry.retryable(err) {
+			backoff := retry.backoff(attempts)
+			log.Infow("Retrying failed sync", "cid", c, "peer", h.peerID, "delay", backoff.String())
+			if h.waitRetry(ctx, backoff) {
+				continue
+			}
+		}
+
+		h.subscriber.sendSyncFailed(SyncFailed{
+			Cid:       c,
+			PeerID:    h.peerID,
+			Addrs:     pa.addrs,
+			Transport: syncerTransport(pa.syncer),
+			Err:       err,
+			Attempts:  attempts,
+		})
+		return
+	}
+
+	// Update latest head seen.
+	log.Infow("Updating latest sync")
+	h.subscriber.latestSyncHander.SetLatestSync(h.peerID, c)
+	h.subscriber.inEvents <- SyncFinished{Cid: c, PeerID: h.peerID, SyncedCids: syncedCids}
+}
+
 var _ SegmentSyncActions = (*segmentedSync)(nil)
 
 type (
@@ -938,15 +1429,30 @@ func (ss *segmentedSync) reset() {
 func (h *handler) handle(ctx context.Context, nextCid cid.Cid, sel ipld.Node, wrapSel bool, syncer Syncer, bh BlockHookFunc, segdl int64) ([]cid.Cid, error) {
 	h.syncMutex.Lock()
 	defer h.syncMutex.Unlock()
+
+	h.subscriber.syncEvents.start(h.peerID, nextCid, syncerTransport(syncer))
+	syncedCids, err := h.handleSync(ctx, nextCid, sel, wrapSel, syncer, bh, segdl)
+	h.subscriber.syncEvents.end(h.peerID, err)
+	return syncedCids, err
+}
+
+// handleSync does the work of handle while the handler's syncMutex is held.
+func (h *handler) handleSync(ctx context.Context, nextCid cid.Cid, sel ipld.Node, wrapSel bool, syncer Syncer, bh BlockHookFunc, segdl int64) ([]cid.Cid, error) {
 	log := log.With("cid", nextCid, "peer", h.peerID)
 
-	segSync := &segmentedSync{
-		nextSyncCid: &nextCid,
-	}
+	segSync := &segmentedSync{}
 
+	// If tracker is not nil, then the frontier of the sync is checkpointed
+	// until the sync completes, so that the sync can be resumed if it is
+	// interrupted.
+	var tracker *frontierTracker
 	var syncedCids []cid.Cid
 	hook := func(p peer.ID, c cid.Cid) {
 		syncedCids = append(syncedCids, c)
+		if tracker != nil {
+			// Explore the block before the block hook can remove it.
+			tracker.blockSynced(c)
+		}
 		if bh != nil {
 			bh(p, c, segSync)
 		}
@@ -960,19 +1466,147 @@ func (h *handler) handle(ctx context.Context, nextCid cid.Cid, sel ipld.Node, wr
 		h.subscriber.scopedBlockHookMutex.Unlock()
 	}()
 
+	// latestSync is the stop link of the sync, if the selector is wrapped.
+	latestSync := cid.Undef
+	// If cp is not nil, then the sync resumes from its frontier instead of
+	// starting at nextCid.
+	var cp *syncCheckpoint
+	seq := sel
+	var latestSyncLink ipld.Link
 	if wrapSel {
-		var latestSyncLink ipld.Link
-		latestSync, ok := h.subscriber.latestSyncHander.GetLatestSync(h.peerID)
-		if ok && latestSync != cid.Undef {
+		if c, ok := h.subscriber.latestSyncHander.GetLatestSync(h.peerID); ok && c != cid.Undef {
+			latestSync = c
 			latestSyncLink = cidlink.Link{Cid: latestSync}
 		}
-		sel = ExploreRecursiveWithStopNode(h.subscriber.syncRecLimit, sel, latestSyncLink)
+		sel = ExploreRecursiveWithStopNode(h.subscriber.syncRecLimit, seq, latestSyncLink)
+
+		if cs := h.subscriber.checkpoints; cs != nil {
+			cp = cs.get(h.peerID)
+			if cp != nil && cp.Stop != latestSync {
+				log.Infow("Discarding sync checkpoint with outdated stop link", "stop", cp.Stop)
+				cp = nil
+			}
+			var err error
+			tracker, err = h.trackFrontier(nextCid, latestSync, sel, seq, latestSyncLink, cp)
+			if err != nil {
+				return nil, err
+			}
+			defer cs.track(tracker)()
+			cs.put(h.peerID, tracker.checkpoint())
+		}
 	}
 
+	if err := h.syncFrontier(ctx, nextCid, sel, seq, latestSyncLink, cp, tracker, syncer, segSync, bh, segdl); err != nil {
+		if tracker != nil {
+			h.subscriber.checkpoints.put(h.peerID, tracker.checkpoint())
+		}
+		return nil, err
+	}
+	if tracker != nil {
+		h.subscriber.checkpoints.remove(h.peerID)
+	}
+	resync, err := h.checkChainFork(ctx, nextCid, latestSync, seq)
+	if err != nil {
+		return nil, err
+	}
+	if resync {
+		log.Infow("Syncing forked chain again from head")
+		// The sync is complete, so there is no frontier to checkpoint.
+		tracker = nil
+		syncedCids = nil
+		segSync = &segmentedSync{}
+		sel = ExploreRecursiveWithStopNode(h.subscriber.syncRecLimit, seq, nil)
+		if err := h.syncSel(ctx, nextCid, sel, syncer, segSync, bh, segdl); err != nil {
+			return nil, err
+		}
+	}
+	return syncedCids, nil
+}
+
+// trackFrontier creates a tracker of the frontier of a sync, which starts with
+// the frontier of the checkpoint if the sync is resumed.
+func (h *handler) trackFrontier(nextCid, latestSync cid.Cid, sel, seq ipld.Node, latestSyncLink ipld.Link, cp *syncCheckpoint) (*frontierTracker, error) {
+	tracker, err := newFrontierTracker(h.subscriber.lsys, nextCid, latestSync, seq, func(cp *syncCheckpoint) {
+		h.subscriber.checkpoints.put(h.peerID, cp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cp == nil {
+		compiled, err := selector.CompileSelector(sel)
+		if err != nil {
+			return nil, err
+		}
+		tracker.add(nextCid, 0, compiled)
+		return tracker, nil
+	}
+	if cp.Head != nextCid {
+		compiled, err := selector.CompileSelector(ExploreRecursiveWithStopNode(h.subscriber.syncRecLimit, seq, cidlink.Link{Cid: cp.Head}))
+		if err != nil {
+			return nil, err
+		}
+		tracker.add(nextCid, 0, compiled)
+	}
+	for _, fl := range cp.Frontier {
+		compiled, err := selector.CompileSelector(h.frontierSel(seq, fl.Depth, latestSyncLink))
+		if err != nil {
+			return nil, err
+		}
+		tracker.add(fl.Cid, fl.Depth, compiled)
+	}
+	return tracker, nil
+}
+
+// frontierSel returns the selector that continues a sync from a link that
+// was reached by following depth recursion edges, which counts the resumed
+// sync against the recursion limit of the interrupted sync.
+func (h *handler) frontierSel(seq ipld.Node, depth int64, latestSyncLink ipld.Link) ipld.Node {
+	return ExploreRecursiveWithStopNode(remainingLimit(h.subscriber.syncRecLimit, depth), seq, latestSyncLink)
+}
+
+// syncFrontier syncs the DAG rooted at nextCid, or continues the interrupted
+// sync recorded by cp if cp is not nil.
+func (h *handler) syncFrontier(ctx context.Context, nextCid cid.Cid, sel, seq ipld.Node, latestSyncLink ipld.Link, cp *syncCheckpoint, tracker *frontierTracker, syncer Syncer, segSync *segmentedSync, bh BlockHookFunc, segdl int64) error {
+	if cp == nil {
+		return h.syncSel(ctx, nextCid, sel, syncer, segSync, bh, segdl)
+	}
+	log := log.With("cid", nextCid, "peer", h.peerID)
+
+	if cp.Head != nextCid {
+		// Sync the part of the DAG that is newer than the interrupted sync,
+		// stopping at the head of the interrupted sync.
+		log.Infow("Syncing new head before resuming interrupted sync", "resumeHead", cp.Head)
+		newSel := ExploreRecursiveWithStopNode(h.subscriber.syncRecLimit, seq, cidlink.Link{Cid: cp.Head})
+		if err := h.syncSel(ctx, nextCid, newSel, syncer, segSync, bh, segdl); err != nil {
+			return err
+		}
+	}
+
+	log.Infow("Resuming interrupted sync", "frontier", len(cp.Frontier))
+	for _, fl := range cp.Frontier {
+		// A link that was explored while syncing an earlier link is already
+		// synced.
+		if !tracker.isPending(fl.Cid) {
+			continue
+		}
+		// The block may have been synced after the checkpoint was saved.
+		tracker.blockSynced(fl.Cid)
+		if err := h.syncSel(ctx, fl.Cid, h.frontierSel(seq, fl.Depth, latestSyncLink), syncer, segSync, bh, segdl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncSel syncs the DAG rooted at nextCid using the given selector, in
+// segments if segmented sync is enabled.
+func (h *handler) syncSel(ctx context.Context, nextCid cid.Cid, sel ipld.Node, syncer Syncer, segSync *segmentedSync, bh BlockHookFunc, segdl int64) error {
+	log := log.With("cid", nextCid, "peer", h.peerID)
+
 	stopNode, stopNodeOK := getStopNode(sel)
 	if stopNodeOK && stopNode.(cidlink.Link).Cid == nextCid {
 		log.Infow("cid to sync to is the stop node. Nothing to do")
-		return nil, nil
+		return nil
 	}
 
 	var syncBySegment bool
@@ -1005,14 +1639,15 @@ func (h *handler) handle(ctx context.Context, nextCid cid.Cid, sel ipld.Node, wr
 		log.Debugw("Falling back on sync in one go", "segDepthLimit", segdl)
 		err := syncer.Sync(ctx, nextCid, sel)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		log.Infow("Sync completed")
-		return syncedCids, nil
+		return nil
 	}
 
 	var nextDepth = segdl
 	var depthSoFar int64
+	segSync.SetNextSyncCid(nextCid)
 
 SegSyncLoop:
 	for {
@@ -1020,18 +1655,20 @@ SegSyncLoop:
 		if !ok {
 			// This should not happen if we were able to extract origLimit from sel.
 			// If this happens there is likely a bug. Fail fast.
-			return nil, fmt.Errorf("failed to construct segment selector with recursion depth limit of %d", nextDepth)
+			return fmt.Errorf("failed to construct segment selector with recursion depth limit of %d", nextDepth)
 		}
 		nextCid = *segSync.nextSyncCid
 		segSync.reset()
+		h.subscriber.syncEvents.segment(h.peerID, nextCid, false)
 		err := syncer.Sync(ctx, nextCid, segmentSel)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		h.subscriber.syncEvents.segment(h.peerID, nextCid, true)
 		depthSoFar += nextDepth
 
 		if segSync.err != nil {
-			return nil, segSync.err
+			return segSync.err
 		}
 
 		// If hook action is not called, or next CID is set to cid.Undef then break out of the
@@ -1058,10 +1695,10 @@ SegSyncLoop:
 				nextDepth = remainingDepth
 			}
 		default:
-			return nil, fmt.Errorf("unknown recursion limit mode: %v", origLimit.Mode())
+			return fmt.Errorf("unknown recursion limit mode: %v", origLimit.Mode())
 		}
 	}
 
-	log.Infow("Segmented sync completed", "syncedCidCount", len(syncedCids))
-	return syncedCids, nil
+	log.Infow("Segmented sync completed", "depth", depthSoFar)
+	return nil
 }